@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+
+	// accessLogTime is the %t time format of the Apache logs
+	accessLogTime = "02/Jan/2006:15:04:05 -0700"
+)
+
+// accessLogFormats are the Apache LogFormat templates of the named formats
+var accessLogFormats = map[string]string{
+	AccessLogCommon:   `%h %l %u %t "%r" %>s %b`,
+	AccessLogCombined: `%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-Agent}i"`,
+}
+
+var accessLog *AccessLogSink
+
+// AccessLogSink writes a line per record to a file, in an Apache LogFormat template
+type AccessLogSink struct {
+	path   string
+	format []accessLogField
+	file   *os.File
+	lock   sync.Mutex
+}
+
+// accessLogField is a part of a template: text written as is, or a directive such as
+// %h, or %{User-Agent}i whose arg is the header name
+type accessLogField struct {
+	text      string
+	directive byte
+	arg       string
+}
+
+// NewAccessLogSink opens path for appending, format is common, combined or a template of
+// the directives %h %l %u %t %r %s %>s %b %B %D %T %m %U %q %H %v %p and %{Header}i
+func NewAccessLogSink(path, format string) (*AccessLogSink, error) {
+	if v, ok := accessLogFormats[format]; ok {
+		format = v
+	}
+	fields, err := parseAccessLogFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	s := &AccessLogSink{path: path, format: fields}
+	if err := s.Reopen(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parseAccessLogFormat(format string) ([]accessLogField, error) {
+	var ret []accessLogField
+	var text strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			text.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i == len(format) {
+			return nil, fmt.Errorf("access log format %q ends with %%", format)
+		}
+		if format[i] == '%' {
+			text.WriteByte('%')
+			continue
+		}
+
+		field := accessLogField{}
+		if format[i] == '{' {
+			end := strings.IndexByte(format[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("access log format %q has an unclosed %%{", format)
+			}
+			field.arg = format[i+1 : i+end]
+			i += end + 1
+			if i == len(format) || format[i] != 'i' {
+				return nil, fmt.Errorf("access log format %q: only %%{Header}i is supported", format)
+			}
+		} else if format[i] == '>' && i+1 < len(format) && format[i+1] == 's' {
+			i++
+		}
+		if !strings.ContainsRune("hlutrsbBDTmUqHvpi", rune(format[i])) {
+			return nil, fmt.Errorf("access log format %q: unknown directive %%%c", format, format[i])
+		}
+		field.directive = format[i]
+		if field.directive == 'i' && len(field.arg) == 0 {
+			return nil, fmt.Errorf("access log format %q: %%i needs a header name, e.g. %%{Referer}i", format)
+		}
+
+		if text.Len() > 0 {
+			ret = append(ret, accessLogField{text: text.String()})
+			text.Reset()
+		}
+		ret = append(ret, field)
+	}
+	if text.Len() > 0 {
+		ret = append(ret, accessLogField{text: text.String()})
+	}
+	return ret, nil
+}
+
+// Reopen reopens the file, e.g. after logrotate moved it away on SIGHUP
+func (s *AccessLogSink) Reopen() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open access log %s: %w", s.path, err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = f
+	return nil
+}
+
+// Publish writes the line of a record, records without a request are not logged
+func (s *AccessLogSink) Publish(md model) {
+	if len(md.RequestMethod) == 0 || md.TLS != nil {
+		return
+	}
+	line := accessLogLine(s.format, md, time.Now())
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := s.file.WriteString(line); err != nil {
+		rateLog.Printf("[ERROR] write access log %s (%s)", s.path, err.Error())
+	}
+}
+
+// accessLogLine formats the line of a record logged at now in a parsed template
+func accessLogLine(format []accessLogField, md model, now time.Time) string {
+	var b strings.Builder
+	for _, v := range format {
+		if v.directive == 0 {
+			b.WriteString(v.text)
+			continue
+		}
+		b.WriteString(accessLogValue(md, v, now))
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// accessLogValue formats a directive for a record logged at now, "-" when it is unknown
+func accessLogValue(md model, field accessLogField, now time.Time) string {
+	dash := func(v string) string {
+		if len(v) == 0 {
+			return "-"
+		}
+		return escapeAccessLog(v)
+	}
+
+	latency := time.Duration(md.Latency) * time.Microsecond
+	switch field.directive {
+	case 'h':
+		return md.RequestSrcIP
+	case 'l', 'u':
+		return "-"
+	case 't':
+		// the time the request was captured, estimated from the latency for the records
+		// without it
+		if md.CapturedAt > 0 {
+			return "[" + time.Unix(int64(md.CapturedAt), 0).Format(accessLogTime) + "]"
+		}
+		return "[" + now.Add(-latency).Format(accessLogTime) + "]"
+	case 'r':
+		return escapeAccessLog(md.RequestMethod + " " + requestTarget(md) + " " + requestVersion(md))
+	case 's':
+		if md.ResponseStatus == 0 {
+			return "-"
+		}
+		return strconv.Itoa(md.ResponseStatus)
+	case 'b':
+		if md.ResponseBodySize == 0 {
+			return "-"
+		}
+		return strconv.Itoa(md.ResponseBodySize)
+	case 'B':
+		return strconv.Itoa(md.ResponseBodySize)
+	case 'D':
+		return strconv.Itoa(md.Latency)
+	case 'T':
+		return strconv.Itoa(int(latency.Seconds()))
+	case 'm':
+		return escapeAccessLog(md.RequestMethod)
+	case 'U':
+		return escapeAccessLog(md.RequestURL)
+	case 'q':
+		if len(md.RequestParma) == 0 {
+			return ""
+		}
+		return "?" + escapeAccessLog(url.Values(md.RequestParma).Encode())
+	case 'H':
+		return escapeAccessLog(requestVersion(md))
+	case 'v':
+		return dash(md.host())
+	case 'p':
+		return md.RequestDstPort
+	case 'i':
+		return dash(headerValue(md.RequestHeaders, field.arg))
+	}
+	return "-"
+}
+
+// requestTarget is the path and query of a request, the query being rebuilt from the
+// parsed parameters
+func requestTarget(md model) string {
+	if len(md.RequestParma) == 0 {
+		return md.RequestURL
+	}
+	return md.RequestURL + "?" + url.Values(md.RequestParma).Encode()
+}
+
+// requestVersion is the protocol of a request, HTTP/1.1 for the records stored before it
+// was recorded
+func requestVersion(md model) string {
+	if md.Grpc != nil {
+		return "HTTP/2.0"
+	}
+	if len(md.RequestVersion) == 0 {
+		return HTTP + "/1.1"
+	}
+	return md.RequestVersion
+}
+
+// escapeAccessLog escapes quotes, backslashes and control characters as Apache does, so
+// that a header cannot break a line or a quoted field
+func escapeAccessLog(v string) string {
+	if !strings.ContainsAny(v, "\"\\") && strings.IndexFunc(v, func(r rune) bool { return r < 0x20 || r == 0x7f }) < 0 {
+		return v
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cpuAffinity is the set parsed from -cpu-affinity, nil when the flag is not set
+var cpuAffinity *unix.CPUSet
+
+// parseCPUList parses a cpu list such as "0-3,6"
+func parseCPUList(s string) (*unix.CPUSet, error) {
+	var set unix.CPUSet
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("bad cpu %q in cpu list %q", lo, s)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil, fmt.Errorf("bad cpu range %q in cpu list %q", part, s)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			set.Set(cpu)
+		}
+	}
+	return &set, nil
+}
+
+// pinThread locks the calling goroutine to its OS thread and binds that thread to the
+// -cpu-affinity set. Only the pinned goroutines are bound, the Go scheduler still runs
+// the others on up to GOMAXPROCS threads on any cpu; set GOMAXPROCS to the size of the
+// set to keep every goroutine busy on it.
+func pinThread() {
+	if cpuAffinity == nil {
+		return
+	}
+	runtime.LockOSThread()
+	if err := unix.SchedSetaffinity(0, cpuAffinity); err != nil {
+		log.Printf("[ERROR] set cpu affinity (%s)", err.Error())
+	}
+}
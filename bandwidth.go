@@ -0,0 +1,130 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// bandwidth is an observer of the bytes of every captured record for /stats?group=bytes
+var bandwidth = NewBandwidthTable()
+
+// HostBytes is the request and response bytes, headers and bodies, captured for a host
+// or a path of it
+type HostBytes struct {
+	Host     string `json:"host"`
+	Path     string `json:"path,omitempty"`
+	Requests int    `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type hostPath struct {
+	host string
+	path string
+}
+
+// BandwidthTable save the bytes captured since prism started, by host and by host and
+// path without the query. Past -max-endpoints paths the new ones are counted under
+// otherPath, as the paths of /metrics are.
+type BandwidthTable struct {
+	hosts map[string]*HostBytes
+	paths map[hostPath]*HostBytes
+	lock  sync.RWMutex
+}
+
+func NewBandwidthTable() *BandwidthTable {
+	return &BandwidthTable{hosts: map[string]*HostBytes{}, paths: map[hostPath]*HostBytes{}}
+}
+
+func (b *BandwidthTable) Publish(md model) {
+	size := int64(md.RequestSize + md.ResponseSize)
+	key := hostPath{host: md.host(), path: md.path()}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	host, ok := b.hosts[key.host]
+	if !ok {
+		host = &HostBytes{Host: key.host}
+		b.hosts[key.host] = host
+	}
+	host.Requests++
+	host.Bytes += size
+
+	path, ok := b.paths[key]
+	if !ok {
+		if MaxEndpoints > 0 && len(b.paths) >= MaxEndpoints {
+			key.path = otherPath
+			path = b.paths[key]
+		}
+		if path == nil {
+			path = &HostBytes{Host: key.host, Path: key.path}
+			b.paths[key] = path
+		}
+	}
+	path.Requests++
+	path.Bytes += size
+}
+
+// Hosts returns the bytes of every host, the most first
+func (b *BandwidthTable) Hosts() []HostBytes {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	ret := make([]HostBytes, 0, len(b.hosts))
+	for _, v := range b.hosts {
+		ret = append(ret, *v)
+	}
+	sortBytes(ret)
+	return ret
+}
+
+// TopPaths returns the n paths with the most bytes, the most first
+func (b *BandwidthTable) TopPaths(n int) []HostBytes {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	ret := make([]HostBytes, 0, len(b.paths))
+	for _, v := range b.paths {
+		ret = append(ret, *v)
+	}
+	sortBytes(ret)
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+func sortBytes(s []HostBytes) {
+	sort.Slice(s, func(i, j int) bool {
+		if s[i].Bytes != s[j].Bytes {
+			return s[i].Bytes > s[j].Bytes
+		}
+		return s[i].Host+s[i].Path < s[j].Host+s[j].Path
+	})
+}
+
+// recordSize is the bytes of a record the listing sorts by with ?sort=size
+func recordSize(md *model) int {
+	return md.RequestSize + md.ResponseSize
+}
+
+// sizeHeap keeps the largest records read by the listing, the smallest of them on top
+type sizeHeap []model
+
+func (h sizeHeap) Len() int            { return len(h) }
+func (h sizeHeap) Less(i, j int) bool  { return recordSize(&h[i]) < recordSize(&h[j]) }
+func (h sizeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sizeHeap) Push(x interface{}) { *h = append(*h, x.(model)) }
+func (h *sizeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// largest returns the records of the heap, the largest first
+func (h *sizeHeap) largest() []model {
+	ret := make([]model, h.Len())
+	for i := len(ret) - 1; i >= 0; i-- {
+		ret[i] = heap.Pop(h).(model)
+	}
+	return ret
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// blobRefs counts the stored records referencing each blob file
+var blobRefs = BlobRefTable{mp: map[string]int{}}
+
+// blobDir is where bodies above -blob-threshold are stored, one file per content hash
+func blobDir() string {
+	if len(BlobDir) > 0 {
+		return BlobDir
+	}
+	return filepath.Join(DataPath, "blobs")
+}
+
+// storeBlob writes a body to the blob directory and returns its hash. Blobs are content
+// addressed, so identical bodies share one file.
+func storeBlob(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	name := filepath.Join(blobDir(), hash)
+	if _, err := os.Stat(name); err == nil {
+		return hash, nil
+	}
+
+	if err := os.MkdirAll(blobDir(), 0750); err != nil {
+		return "", err
+	}
+	// write then rename, a reader never sees a partial blob
+	tmp, err := os.CreateTemp(blobDir(), hash+".tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return hash, nil
+}
+
+func readBlob(hash string) ([]byte, error) {
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+		return nil, errors.New("invalid blob hash")
+	}
+	return os.ReadFile(filepath.Join(blobDir(), hash))
+}
+
+// externalizeBodies moves the bodies larger than -blob-threshold out of the record
+func externalizeBodies(md *model) error {
+	// a replay references the blob of the record it replayed
+	if len(md.RequestBodyBlob) > 0 {
+		blobRefs.Retain(md.RequestBodyBlob)
+	}
+	if BlobThreshold <= 0 {
+		return nil
+	}
+
+	if len(md.RequestBody) > BlobThreshold {
+		hash, err := blobRefs.Store([]byte(md.RequestBody))
+		if err != nil {
+			return err
+		}
+		md.RequestBodyBlob, md.RequestBody = hash, ""
+	}
+	if body, ok := md.ResponseBody.(string); ok && len(body) > BlobThreshold {
+		hash, err := blobRefs.Store([]byte(body))
+		if err != nil {
+			return err
+		}
+		md.ResponseBodyBlob, md.ResponseBody = hash, nil
+	}
+	return nil
+}
+
+// BlobRefTable save how many stored records reference each blob file, so that a blob is
+// deleted with the last record referencing it. It is loaded from the stored records at
+// start, a blob it does not count is never deleted.
+type BlobRefTable struct {
+	mp   map[string]int
+	lock sync.Mutex
+}
+
+// Load counts the blobs referenced by the records of db
+func (b *BlobRefTable) Load(db *leveldb.DB) error {
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for iter.Next() {
+		md := model{}
+		if err := decodeRecord(iter.Value(), &md); err != nil {
+			continue
+		}
+		for _, hash := range []string{md.RequestBodyBlob, md.ResponseBodyBlob} {
+			if len(hash) > 0 {
+				b.mp[hash]++
+			}
+		}
+	}
+	return iter.Error()
+}
+
+// Store writes a blob unless it already is and adds a reference to it, under the lock so
+// that a blob being released is not deleted once referenced again
+func (b *BlobRefTable) Store(data []byte) (string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	hash, err := storeBlob(data)
+	if err != nil {
+		return "", err
+	}
+	b.mp[hash]++
+	return hash, nil
+}
+
+// Retain adds a reference to a blob already stored, e.g. by the record a replay copied
+// its request body from
+func (b *BlobRefTable) Retain(hash string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.mp[hash]++
+}
+
+// Release removes a reference to a blob, deleting its file with the last reference
+func (b *BlobRefTable) Release(hash string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	n, ok := b.mp[hash]
+	if !ok {
+		return nil
+	}
+	if n > 1 {
+		b.mp[hash] = n - 1
+		return nil
+	}
+	delete(b.mp, hash)
+	if err := os.Remove(filepath.Join(blobDir(), hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// resolveBlobs puts the bodies stored in blob files back into a record
+func resolveBlobs(md *model) error {
+	if len(md.RequestBodyBlob) > 0 {
+		body, err := readBlob(md.RequestBodyBlob)
+		if err != nil {
+			return err
+		}
+		md.RequestBody, md.RequestBodyBlob = string(body), ""
+	}
+	if len(md.ResponseBodyBlob) > 0 {
+		body, err := readBlob(md.ResponseBodyBlob)
+		if err != nil {
+			return err
+		}
+		md.ResponseBody, md.ResponseBodyBlob = string(body), ""
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"log"
+	"path/filepath"
+	"sync"
+)
+
+// bodies is set with -dedupe-threshold, nil otherwise
+var bodies *BodyStore
+
+// BodyStore save the bodies above -dedupe-threshold once, in a leveldb of their own under
+// the data path. Records reference them by hash and a body is deleted with its last reference.
+type BodyStore struct {
+	db   *leveldb.DB
+	lock sync.Mutex
+}
+
+func OpenBodyStore(o *opt.Options) (*BodyStore, error) {
+	db, err := leveldb.OpenFile(filepath.Join(DataPath, "bodies"), o)
+	if err != nil {
+		return nil, err
+	}
+	return &BodyStore{db: db}, nil
+}
+
+func bodyKey(hash string) []byte {
+	return []byte("body/" + hash)
+}
+
+func refKey(hash string) []byte {
+	return []byte("ref/" + hash)
+}
+
+func (b *BodyStore) refs(hash string) (uint64, error) {
+	value, err := b.db.Get(refKey(hash), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, _ := binary.Uvarint(value)
+	return n, nil
+}
+
+// Ref stores a body unless it already is and adds a reference to it. It returns the hash
+// of the body and whether it was already stored.
+func (b *BodyStore) Ref(data []byte) (string, bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	n, err := b.refs(hash)
+	if err != nil {
+		return "", false, err
+	}
+
+	var batch leveldb.Batch
+	if n == 0 {
+		batch.Put(bodyKey(hash), data)
+	}
+	batch.Put(refKey(hash), appendUvarint(nil, n+1))
+	if err := b.db.Write(&batch, nil); err != nil {
+		return "", false, err
+	}
+	return hash, n > 0, nil
+}
+
+// Release removes a reference to a body, deleting the body with its last reference
+func (b *BodyStore) Release(hash string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	n, err := b.refs(hash)
+	if err != nil || n == 0 {
+		return err
+	}
+
+	var batch leveldb.Batch
+	if n == 1 {
+		batch.Delete(bodyKey(hash))
+		batch.Delete(refKey(hash))
+	} else {
+		batch.Put(refKey(hash), appendUvarint(nil, n-1))
+	}
+	return b.db.Write(&batch, nil)
+}
+
+func (b *BodyStore) Get(hash string) ([]byte, error) {
+	return b.db.Get(bodyKey(hash), nil)
+}
+
+// dedupeBodies moves the bodies larger than -dedupe-threshold out of the record
+func dedupeBodies(md *model) error {
+	if bodies == nil {
+		return nil
+	}
+
+	if len(md.RequestBody) > DedupeThreshold {
+		hash, stored, err := bodies.Ref([]byte(md.RequestBody))
+		if err != nil {
+			return err
+		}
+		if stored {
+			stats.Add(StatDedupedBytes, int64(len(md.RequestBody)))
+		}
+		md.RequestBodyRef, md.RequestBody = hash, ""
+	}
+	if body, ok := md.ResponseBody.(string); ok && len(body) > DedupeThreshold {
+		hash, stored, err := bodies.Ref([]byte(body))
+		if err != nil {
+			return err
+		}
+		if stored {
+			stats.Add(StatDedupedBytes, int64(len(body)))
+		}
+		md.ResponseBodyRef, md.ResponseBody = hash, nil
+	}
+	return nil
+}
+
+// releaseBodies removes the references of a record that is overwritten or evicted, to
+// its deduplicated bodies and its blob files
+func releaseBodies(md model) {
+	for _, hash := range []string{md.RequestBodyBlob, md.ResponseBodyBlob} {
+		if len(hash) == 0 {
+			continue
+		}
+		if err := blobRefs.Release(hash); err != nil {
+			log.Printf("[ERROR] release blob %s (%s)", hash, err.Error())
+		}
+	}
+	if bodies == nil {
+		return
+	}
+	for _, hash := range []string{md.RequestBodyRef, md.ResponseBodyRef} {
+		if len(hash) == 0 {
+			continue
+		}
+		if err := bodies.Release(hash); err != nil {
+			log.Printf("[ERROR] release body %s (%s)", hash, err.Error())
+		}
+	}
+}
+
+// releaseStored removes the references of the record stored under id, if any
+func releaseStored(db *leveldb.DB, id string) {
+	if bodies == nil && BlobThreshold <= 0 {
+		return
+	}
+	value, err := db.Get([]byte(id), nil)
+	if err != nil {
+		return
+	}
+	var md model
+	if err := decodeRecord(value, &md); err != nil {
+		log.Printf("[ERROR] decode overwritten record %s (%s)", id, err.Error())
+		return
+	}
+	releaseBodies(md)
+}
+
+// resolveBodies puts the referenced bodies back into a record
+func resolveBodies(md *model) error {
+	if len(md.RequestBodyRef) == 0 && len(md.ResponseBodyRef) == 0 {
+		return nil
+	}
+	if bodies == nil {
+		return errors.New("record references deduplicated bodies, run prism with -dedupe-threshold")
+	}
+
+	if len(md.RequestBodyRef) > 0 {
+		body, err := bodies.Get(md.RequestBodyRef)
+		if err != nil {
+			return err
+		}
+		md.RequestBody = string(body)
+	}
+	if len(md.ResponseBodyRef) > 0 {
+		body, err := bodies.Get(md.ResponseBodyRef)
+		if err != nil {
+			return err
+		}
+		md.ResponseBody = string(body)
+	}
+	return nil
+}
@@ -12,9 +12,11 @@
 #define TC_ACT_REDIRECT 7
 
 #define ETH_P_IP 0x0800 /* Internet Protocol packet        */
+#define ETH_P_IPV6 0x86DD /* IPv6 over bluebook            */
 
 #define ETH_HLEN sizeof(struct ethhdr)
 #define IP_HLEN sizeof(struct iphdr)
+#define IPV6_HLEN sizeof(struct ipv6hdr)
 #define TCP_HLEN sizeof(struct tcphdr)
 #define UDP_HLEN sizeof(struct udphdr)
 #define DNS_HLEN sizeof(struct dns_hdr)
@@ -30,6 +32,8 @@ struct http_data_event {
   __u32 data_len;
   __u32 max_len;
   __u32 truncation;
+  // the interface the packet was captured on, the interfaces share the event buffer
+  __u32 ifindex;
 };
 
 // BPF ringbuf map
@@ -49,6 +53,97 @@ struct
     __uint(max_entries, 1);
 } data_buffer_heap SEC(".maps");
 
+// Ports to capture when port_filter is on, in host byte order
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, __u16);
+    __type(value, __u8);
+    __uint(max_entries, 64);
+} http_ports SEC(".maps");
+
+// capture_settings[0] is port_filter: 0 captures any port, 1 only the http_ports
+// capture_settings[1] is head_bytes: 0 copies whole packets, N only the first N bytes of
+// the payloads starting a message
+// capture_settings[2] is report_syn: 1 copies the SYN and bare FIN segments too, for
+// -new-connections-only
+// capture_settings[3] is detect_quic: 1 copies the QUIC Initial packets, on any port
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __type(key, __u32);
+    __type(value, __u32);
+    __uint(max_entries, 4);
+} capture_settings SEC(".maps");
+
+static __inline int is_http_port(struct tcphdr *tcph) {
+  __u32 kZero = 0;
+  __u32 *port_filter = bpf_map_lookup_elem(&capture_settings, &kZero);
+  if (port_filter == NULL || *port_filter == 0) {
+    return 1;
+  }
+
+  __u16 sport = bpf_ntohs(tcph->source);
+  __u16 dport = bpf_ntohs(tcph->dest);
+  return bpf_map_lookup_elem(&http_ports, &sport) != NULL || bpf_map_lookup_elem(&http_ports, &dport) != NULL;
+}
+
+// is_reported_syn reports whether a SYN segment is copied although it has no payload
+static __inline int is_reported_syn(struct tcphdr *tcph) {
+  __u32 kTwo = 2;
+  __u32 *report_syn = bpf_map_lookup_elem(&capture_settings, &kTwo);
+  return report_syn != NULL && *report_syn != 0 && tcph->syn;
+}
+
+// is_reported_fin reports whether a FIN segment without payload is copied, it closes a
+// connection of -new-connections-only
+static __inline int is_reported_fin(struct tcphdr *tcph, void *data_end) {
+  __u32 kTwo = 2;
+  __u32 *report_syn = bpf_map_lookup_elem(&capture_settings, &kTwo);
+  return report_syn != NULL && *report_syn != 0 && tcph->fin && (void *)tcph + tcph->doff * 4 >= data_end;
+}
+
+// is_quic_initial reports whether a UDP datagram starts with a QUIC v1 Initial packet,
+// which carries the ClientHello of the connection
+static __inline int is_quic_initial(struct udphdr *udph, void *data_end) {
+  __u32 kThree = 3;
+  __u32 *detect_quic = bpf_map_lookup_elem(&capture_settings, &kThree);
+  if (detect_quic == NULL || *detect_quic == 0) {
+    return 0;
+  }
+
+  __u8 *payload = (__u8 *)(udph + 1);
+  if ((void *)(payload + 5) > data_end) {
+    return 0;
+  }
+  // long header and fixed bit set, packet type 0 is Initial
+  if ((payload[0] & 0xf0) != 0xc0) {
+    return 0;
+  }
+  return payload[1] == 0 && payload[2] == 0 && payload[3] == 0 && payload[4] == 1;
+}
+
+// head_limit returns the bytes of the packet to copy with head_bytes set, 0 to skip a
+// payload that does not start a message or a TLS handshake, or len without the limit
+static __inline __u32 head_limit(struct tcphdr *tcph, void *data_start, void *data_end, __u32 len) {
+  __u32 kOne = 1;
+  __u32 *head_bytes = bpf_map_lookup_elem(&capture_settings, &kOne);
+  if (head_bytes == NULL || *head_bytes == 0) {
+    return len;
+  }
+
+  void *payload = (void *)tcph + tcph->doff * 4;
+  if (payload + 1 > data_end) {
+    return 0;
+  }
+  // every method and status line starts with an upper case letter, 0x16 is a handshake record
+  char c = *(char *)payload;
+  if ((c < 'A' || c > 'Z') && c != 0x16) {
+    return 0;
+  }
+
+  __u32 limit = (__u32)(payload - data_start) + *head_bytes;
+  return len < limit ? len : limit;
+}
+
 static __inline struct http_data_event* create_http_data_event() {
   __u32 kZero = 0;
   struct http_data_event* event = bpf_map_lookup_elem(&data_buffer_heap, &kZero);
@@ -59,6 +154,8 @@ static __inline struct http_data_event* create_http_data_event() {
   return event;
 }
 
+// capture_packets only copies packets, it returns TC_ACT_UNSPEC (TCX_NEXT under TCX) so that
+// the programs attached after it still run and decide what happens to the packet
 static __inline int capture_packets(struct __sk_buff *skb,enum tc_type type) {
     bpf_skb_pull_data(skb, skb->len);
     // Packet data
@@ -67,34 +164,71 @@ static __inline int capture_packets(struct __sk_buff *skb,enum tc_type type) {
 
     // Bounds Check: Check if the packet is larger than the full Ethernet + IP header
     if (data_start + ETH_HLEN + IP_HLEN + TCP_HLEN > data_end) {
-        return TC_ACT_OK;
+        return TC_ACT_UNSPEC;
     }
 
     // Ethernet headers
     struct ethhdr *eth = (struct ethhdr *)data_start;
-    if (eth->h_proto != bpf_htons(ETH_P_IP)) {
-        return TC_ACT_OK;
-    }
-
-    // IP headers
-    struct iphdr *iph = (struct iphdr *)(data_start + ETH_HLEN);
-    if (iph->protocol != IPPROTO_TCP) {
-        return TC_ACT_OK;
+    void *l4;
+    __u8 protocol;
+    if (eth->h_proto == bpf_htons(ETH_P_IP)) {
+        // IP headers
+        struct iphdr *iph = (struct iphdr *)(data_start + ETH_HLEN);
+        protocol = iph->protocol;
+        l4 = data_start + ETH_HLEN + iph->ihl * 4;
+    } else if (eth->h_proto == bpf_htons(ETH_P_IPV6)) {
+        // IPv6 headers, extension headers are not followed
+        if (data_start + ETH_HLEN + IPV6_HLEN + TCP_HLEN > data_end) {
+            return TC_ACT_UNSPEC;
+        }
+        struct ipv6hdr *ip6h = (struct ipv6hdr *)(data_start + ETH_HLEN);
+        protocol = ip6h->nexthdr;
+        l4 = data_start + ETH_HLEN + IPV6_HLEN;
+    } else {
+        return TC_ACT_UNSPEC;
     }
 
     __u32 len = (__u32)(data_end-data_start);
     if (len < 0) {
-        return TC_ACT_OK;
+        return TC_ACT_UNSPEC;
     }
 
-    // In theory this is the minimum packet size of an http packet
-    if (len <= HTTP_DATA_MIN_SIZE){
-        return TC_ACT_OK;
+    if (protocol == IPPROTO_UDP) {
+        // HTTP/3 is encrypted, only its handshake is copied
+        struct udphdr *udph = (struct udphdr *)l4;
+        if ((void *)(udph + 1) > data_end || !is_quic_initial(udph, data_end)) {
+            return TC_ACT_UNSPEC;
+        }
+    } else if (protocol == IPPROTO_TCP) {
+        struct tcphdr *tcph = (struct tcphdr *)l4;
+        if ((void *)(tcph + 1) > data_end || !is_http_port(tcph)) {
+            return TC_ACT_UNSPEC;
+        }
+
+        if (is_reported_syn(tcph) || is_reported_fin(tcph, data_end)) {
+            // the SYN or FIN and its options only, the connection is new or closed
+            len = (__u32)((void *)tcph + tcph->doff * 4 - data_start);
+        } else if (tcph->rst) {
+            // a reset is shorter than any http packet, its headers mark the connection reset
+            len = (__u32)((void *)tcph + tcph->doff * 4 - data_start);
+        } else {
+            // In theory this is the minimum packet size of an http packet
+            if (len <= HTTP_DATA_MIN_SIZE){
+                return TC_ACT_UNSPEC;
+            }
+
+            len = head_limit(tcph, data_start, data_end, len);
+            if (len == 0) {
+                return TC_ACT_UNSPEC;
+            }
+        }
+    } else {
+        return TC_ACT_UNSPEC;
     }
 
     struct http_data_event* event = create_http_data_event();
     if (event == NULL) {
-      return TC_ACT_OK;
+      return TC_ACT_UNSPEC;
     }
 
     event = bpf_ringbuf_reserve(&http_events, sizeof(struct http_data_event), 0);
@@ -102,10 +236,12 @@ static __inline int capture_packets(struct __sk_buff *skb,enum tc_type type) {
     #ifdef DEBUG
         bpf_printk("---------no memory---------\n");
     #endif
-        return 0;
+        return TC_ACT_UNSPEC;
     }
 
     event->type = type;
+
+    event->ifindex = skb->ifindex;
     event->max_len = len;
     // This is a max function, but it is written in such a way to keep older BPF verifiers happy.
     event->data_len = (len < MAX_DATA_SIZE ? len  : MAX_DATA_SIZE);
@@ -138,9 +274,10 @@ static __inline int capture_packets(struct __sk_buff *skb,enum tc_type type) {
             #ifdef DEBUG
                 bpf_printk("---------no memory---------");
             #endif
-                return 0;
+                return TC_ACT_UNSPEC;
             }
             event->type = type;
+            event->ifindex = skb->ifindex;
             event->data_len = 0;
             event->max_len = len;
             event->truncation = 1;
@@ -154,7 +291,7 @@ static __inline int capture_packets(struct __sk_buff *skb,enum tc_type type) {
     name_pos = 0;
     for (int i = 0; i < MAX_DATA_SIZE; i++) {
        // boundary judgment
-       if (cursor + 1 > data_end) {
+       if (cursor + 1 > data_end || offset + name_pos >= len) {
          break;
        }
 
@@ -169,7 +306,7 @@ static __inline int capture_packets(struct __sk_buff *skb,enum tc_type type) {
     #endif
 
     bpf_ringbuf_submit(event, 0);
-    return TC_ACT_OK;
+    return TC_ACT_UNSPEC;
 }
 
 // egress_cls_func is called for packets that are going out of the network
@@ -0,0 +1,129 @@
+// go:build ignore
+#include "vmlinux.h"
+
+#include "bpf_helpers.h"
+#include "bpf_tracing.h"
+
+#define MAX_DATA_SIZE 1024*4
+#define MAX_CHUNKS 16
+enum ssl_op { SSLWrite, SSLRead };
+
+// a buffer written or read by SSL_write or SSL_read, cut in chunks of MAX_DATA_SIZE. Only
+// the first MAX_CHUNKS chunks of a buffer of max_len bytes are sent, offset is the one of
+// the chunk in the buffer.
+struct ssl_data_event {
+  __u64 ssl;
+  __u32 pid;
+  __u32 op;
+  __u32 data_len;
+  __u32 max_len;
+  __u32 offset;
+  __u8 data[MAX_DATA_SIZE];
+};
+
+// BPF ringbuf map
+struct {
+  __uint(type, BPF_MAP_TYPE_RINGBUF);
+  __uint(max_entries, 256 * 1024 /* 256 KB */);
+} ssl_events SEC(".maps");
+
+struct ssl_args {
+  __u64 ssl;
+  __u64 buf;
+};
+
+// the arguments of the SSL_read and SSL_write calls in progress, keyed by pid_tgid, read
+// back when they return
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u64);
+  __type(value, struct ssl_args);
+  __uint(max_entries, 10240);
+} active_reads SEC(".maps");
+
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u64);
+  __type(value, struct ssl_args);
+  __uint(max_entries, 10240);
+} active_writes SEC(".maps");
+
+static __inline int output_ssl_data(__u64 ssl, const void *buf, __u32 len, enum ssl_op op) {
+  __u32 pid = bpf_get_current_pid_tgid() >> 32;
+  for (int i = 0; i < MAX_CHUNKS; i++) {
+    __u32 offset = i * MAX_DATA_SIZE;
+    if (offset >= len) {
+      break;
+    }
+    struct ssl_data_event *event = bpf_ringbuf_reserve(&ssl_events, sizeof(struct ssl_data_event), 0);
+    if (!event) {
+      return 0;
+    }
+    __u32 size = len - offset;
+    if (size > MAX_DATA_SIZE) {
+      size = MAX_DATA_SIZE;
+    }
+    event->ssl = ssl;
+    event->pid = pid;
+    event->op = op;
+    event->data_len = size;
+    event->max_len = len;
+    event->offset = offset;
+    bpf_probe_read_user(&event->data, size, buf + offset);
+    bpf_ringbuf_submit(event, 0);
+  }
+  return 0;
+}
+
+static __inline int save_ssl_args(struct pt_regs *ctx, void *calls) {
+  __u64 id = bpf_get_current_pid_tgid();
+  struct ssl_args args = {
+    .ssl = (__u64)PT_REGS_PARM1(ctx),
+    .buf = (__u64)PT_REGS_PARM2(ctx),
+  };
+  bpf_map_update_elem(calls, &id, &args, BPF_ANY);
+  return 0;
+}
+
+// output_ssl_return sends the bytes the call returns it wrote or read, the buffer of
+// SSL_write may not be sent in whole and the one of SSL_read only holds the plaintext then
+static __inline int output_ssl_return(struct pt_regs *ctx, void *calls, enum ssl_op op) {
+  __u64 id = bpf_get_current_pid_tgid();
+  struct ssl_args *args = bpf_map_lookup_elem(calls, &id);
+  if (args == NULL) {
+    return 0;
+  }
+  __u64 ssl = args->ssl;
+  const void *buf = (const void *)args->buf;
+  bpf_map_delete_elem(calls, &id);
+
+  int ret = (int)PT_REGS_RC(ctx);
+  if (ret <= 0) {
+    return 0;
+  }
+  return output_ssl_data(ssl, buf, ret, op);
+}
+
+// int SSL_write(SSL *ssl, const void *buf, int num)
+SEC("uprobe/SSL_write")
+int probe_ssl_write_entry(struct pt_regs *ctx) {
+  return save_ssl_args(ctx, &active_writes);
+}
+
+SEC("uretprobe/SSL_write")
+int probe_ssl_write_return(struct pt_regs *ctx) {
+  return output_ssl_return(ctx, &active_writes, SSLWrite);
+}
+
+// int SSL_read(SSL *ssl, void *buf, int num)
+SEC("uprobe/SSL_read")
+int probe_ssl_read_entry(struct pt_regs *ctx) {
+  return save_ssl_args(ctx, &active_reads);
+}
+
+SEC("uretprobe/SSL_read")
+int probe_ssl_read_return(struct pt_regs *ctx) {
+  return output_ssl_return(ctx, &active_reads, SSLRead);
+}
+
+char _license[] SEC("license") = "GPL";
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+)
+
+// the event buffers are reported at startup when they take more than 1/bufferMemoryShare
+// of the available memory
+const bufferMemoryShare = 10
+
+var bpfObjects = BPFObjectTable{mp: map[string][]BPFObject{}}
+
+// TCObjectsName is the Iface of the maps and programs the tc programs of every interface
+// share, loaded once
+const TCObjectsName = "tc"
+
+// BPFObject is a map or a program loaded for the interfaces or for -tls, Memlock is the kernel memory
+// it is charged for as reported in /proc/self/fdinfo
+type BPFObject struct {
+	Iface      string `json:"iface"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	ID         uint32 `json:"id"`
+	MaxEntries uint32 `json:"max_entries,omitempty"`
+	Memlock    int64  `json:"memlock_bytes"`
+}
+
+// BPFObjectTable save the maps and programs loaded, keyed by TCObjectsName or by
+// SSLCaptureName
+type BPFObjectTable struct {
+	mp   map[string][]BPFObject
+	lock sync.RWMutex
+}
+
+// Add records the maps and programs loaded under iface, keyed by their name in the eBPF
+// sources
+func (b *BPFObjectTable) Add(iface string, maps map[string]*ebpf.Map, progs map[string]*ebpf.Program) {
+	var objs []BPFObject
+	for name, m := range maps {
+		obj := BPFObject{Iface: iface, Kind: "map", Name: name, Memlock: fdMemlock(m.FD())}
+		if info, err := m.Info(); err == nil {
+			id, _ := info.ID()
+			obj.ID, obj.Type, obj.MaxEntries = uint32(id), info.Type.String(), info.MaxEntries
+		}
+		objs = append(objs, obj)
+	}
+	for name, p := range progs {
+		obj := BPFObject{Iface: iface, Kind: "program", Name: name, Memlock: fdMemlock(p.FD())}
+		if info, err := p.Info(); err == nil {
+			id, _ := info.ID()
+			obj.ID, obj.Type = uint32(id), info.Type.String()
+		}
+		objs = append(objs, obj)
+	}
+	sort.Slice(objs, func(i, j int) bool {
+		if objs[i].Kind != objs[j].Kind {
+			return objs[i].Kind < objs[j].Kind
+		}
+		return objs[i].Name < objs[j].Name
+	})
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.mp[iface] = objs
+}
+
+func (b *BPFObjectTable) List() []BPFObject {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	var ret []BPFObject
+	for _, v := range b.mp {
+		ret = append(ret, v...)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Iface < ret[j].Iface
+	})
+	return ret
+}
+
+// WriteTo writes the kernel memory of the maps and programs as prism_ebpf_memlock_bytes
+func (b *BPFObjectTable) WriteTo(w io.Writer) (int64, error) {
+	var sb strings.Builder
+	sb.WriteString("# HELP prism_ebpf_memlock_bytes Kernel memory charged for the eBPF maps and programs.\n")
+	sb.WriteString("# TYPE prism_ebpf_memlock_bytes gauge\n")
+	for _, v := range b.List() {
+		fmt.Fprintf(&sb, "prism_ebpf_memlock_bytes{iface=%q,kind=%q,name=%q} %d\n", v.Iface, v.Kind, v.Name, v.Memlock)
+	}
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+// fdMemlock returns the memlock of a map or program fd, 0 if the kernel does not report it
+func fdMemlock(fd int) int64 {
+	f, err := os.Open(fmt.Sprintf("/proc/self/fdinfo/%d", fd))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if name, v, ok := strings.Cut(scanner.Text(), ":"); ok && name == "memlock" {
+			n, _ := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// memAvailable returns MemAvailable of /proc/meminfo in bytes
+func memAvailable() (int64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemAvailable:    8069612 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			return kb << 10, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no MemAvailable in /proc/meminfo")
+}
+
+// warnBufferMemory warns when the event buffers of the interfaces take more than
+// 1/bufferMemoryShare of the available memory, the perf buffers being allocated per cpu
+func warnBufferMemory(mode CaptureMode) {
+	size := int64(mode.BufferSize)
+	if mode.Mode == ModePerf {
+		size *= int64(runtime.NumCPU())
+	}
+	available, err := memAvailable()
+	if err != nil {
+		log.Printf("[ERROR] read available memory (%s)", err.Error())
+		return
+	}
+	if size*bufferMemoryShare > available {
+		log.Printf("[WARN] the event buffer takes %d MiB of kernel memory, %d MiB are available",
+			size>>20, available>>20)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var captures = CaptureTable{mp: map[string]*Capture{}, index: map[int]string{}}
+
+// Capture is an interface prism is attached to. A disabled capture stays attached but
+// its events are dropped as soon as they are read. LastEvent, Stalled and Stalls are
+// filled from state when listed.
+type Capture struct {
+	Name      string    `json:"name"`
+	Index     int       `json:"index"`
+	Enabled   bool      `json:"enabled"`
+	Families  []string  `json:"families"`
+	LastEvent time.Time `json:"last_event"`
+	Stalled   bool      `json:"stalled"`
+	Stalls    int64     `json:"stalls"`
+	// Attach is how the programs are attached, tcx or netlink
+	Attach string `json:"attach"`
+
+	state       *captureState
+	attachments []*TCAttachment
+}
+
+// captureState is what every event of a capture updates, atomically so that reading an
+// event takes no exclusive lock
+type captureState struct {
+	// lastEvent is the unix nanoseconds of the last event read
+	lastEvent atomic.Int64
+	stalled   atomic.Bool
+	stalls    atomic.Int64
+}
+
+// CaptureTable save the attached interfaces, keyed by interface name
+type CaptureTable struct {
+	mp map[string]*Capture
+	// index names the interfaces by index, for the events of the buffer they share
+	index map[int]string
+	lock  sync.RWMutex
+}
+
+func (c *CaptureTable) Add(name string, index int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	families := []string{FamilyIPv4, FamilyIPv6}
+	if IPFamily != FamilyAll {
+		families = []string{IPFamily}
+	}
+	state := &captureState{}
+	state.lastEvent.Store(time.Now().UnixNano())
+	c.mp[name] = &Capture{Name: name, Index: index, Enabled: true, Families: families, state: state}
+	if index > 0 {
+		c.index[index] = name
+	}
+	log.Printf("[PRISM] capturing %s on %s", strings.Join(families, " and "), name)
+}
+
+// SetIndex records the index of an interface attached again, which may have been created
+// again with another index
+func (c *CaptureTable) SetIndex(name string, index int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	v, ok := c.mp[name]
+	if !ok || v.Index == index {
+		return
+	}
+	delete(c.index, v.Index)
+	v.Index, c.index[index] = index, name
+}
+
+// NameOf returns the name of the interface of an index, false if it is not attached to
+func (c *CaptureTable) NameOf(index int) (string, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	name, ok := c.index[index]
+	return name, ok
+}
+
+// SetAttach records how the ingress and egress programs were attached to the interface
+func (c *CaptureTable) SetAttach(name, ingress, egress string) {
+	attach := ingress
+	if ingress != egress {
+		attach = fmt.Sprintf("%s ingress, %s egress", ingress, egress)
+	}
+	c.lock.Lock()
+	if v, ok := c.mp[name]; ok {
+		v.Attach = attach
+	}
+	c.lock.Unlock()
+	log.Printf("[PRISM] attached to %s with %s", name, attach)
+}
+
+// SetAttachments records the programs attached to the interface, attached again by
+// -stall-reattach when its capture stalls
+func (c *CaptureTable) SetAttachments(name string, attachments ...*TCAttachment) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if v, ok := c.mp[name]; ok {
+		v.attachments = attachments
+	}
+}
+
+// Touch records that an event was read from the interface
+func (c *CaptureTable) Touch(name string) {
+	c.lock.RLock()
+	v, ok := c.mp[name]
+	c.lock.RUnlock()
+	if !ok {
+		return
+	}
+	v.state.lastEvent.Store(time.Now().UnixNano())
+	if v.state.stalled.Load() && v.state.stalled.CompareAndSwap(true, false) {
+		log.Printf("[PRISM] capture on %s resumed", name)
+	}
+}
+
+// WatchStalls reports the enabled captures that read no event for longer than timeout,
+// and with -stall-reattach attaches their programs again
+func (c *CaptureTable) WatchStalls(ctx context.Context, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var reattach []*TCAttachment
+		c.lock.RLock()
+		for _, v := range c.mp {
+			since := time.Since(time.Unix(0, v.state.lastEvent.Load()))
+			if v.Enabled && since > timeout && v.state.stalled.CompareAndSwap(false, true) {
+				v.state.stalls.Add(1)
+				log.Printf("[ERROR] capture on %s stalled, no events for %s", v.Name, since.Round(time.Second))
+				reattach = append(reattach, v.attachments...)
+			}
+		}
+		c.lock.RUnlock()
+
+		if !StallReattach {
+			continue
+		}
+		for _, v := range reattach {
+			if err := v.Reattach(); err != nil {
+				log.Printf("[ERROR] reattach %s (%s)", v.progName, err.Error())
+			}
+		}
+	}
+}
+
+// Ready returns an error naming the first stalled capture, or if none is attached yet
+func (c *CaptureTable) Ready() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if len(c.mp) == 0 {
+		return errors.New("no capture attached yet")
+	}
+	for _, v := range c.mp {
+		if v.Enabled && v.state.stalled.Load() {
+			return fmt.Errorf("capture on %s stalled", v.Name)
+		}
+	}
+	return nil
+}
+
+// WriteTo writes the seconds since the last event and the stalls of every capture as
+// prism_capture_seconds_since_last_event and prism_capture_stalls_total
+func (c *CaptureTable) WriteTo(w io.Writer) (int64, error) {
+	list := c.List()
+	var b strings.Builder
+	b.WriteString("# HELP prism_capture_seconds_since_last_event Seconds since the capture read an event.\n")
+	b.WriteString("# TYPE prism_capture_seconds_since_last_event gauge\n")
+	for _, v := range list {
+		fmt.Fprintf(&b, "prism_capture_seconds_since_last_event{interface=\"%s\"} %g\n", labelValue(v.Name), time.Since(v.LastEvent).Seconds())
+	}
+	b.WriteString("# HELP prism_capture_stalls_total Times the capture read no event for -stall-timeout.\n")
+	b.WriteString("# TYPE prism_capture_stalls_total counter\n")
+	for _, v := range list {
+		fmt.Fprintf(&b, "prism_capture_stalls_total{interface=\"%s\"} %d\n", labelValue(v.Name), v.Stalls)
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (c *CaptureTable) Enabled(name string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	v, ok := c.mp[name]
+	return ok && v.Enabled
+}
+
+// SetEnabled toggles a capture, returning false if prism is not attached to the interface
+func (c *CaptureTable) SetEnabled(name string, enabled bool) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	v, ok := c.mp[name]
+	if !ok {
+		return false
+	}
+	v.Enabled = enabled
+	v.state.stalled.Store(false)
+	v.state.lastEvent.Store(time.Now().UnixNano())
+	return true
+}
+
+func (c *CaptureTable) List() []Capture {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	ret := make([]Capture, 0, len(c.mp))
+	for _, v := range c.mp {
+		capture := *v
+		capture.LastEvent = time.Unix(0, v.state.lastEvent.Load())
+		capture.Stalled = v.state.stalled.Load()
+		capture.Stalls = v.state.stalls.Load()
+		ret = append(ret, capture)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Index < ret[j].Index
+	})
+	return ret
+}
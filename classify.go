@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+var httpFlows = FlowTable{mp: map[uint32]time.Time{}}
+
+// FlowTable save when a flow last carried HTTP, keyed by flowHash. The segments that
+// continue a body do not start like HTTP but must not be rejected.
+type FlowTable struct {
+	mp     map[uint32]time.Time
+	pruned time.Time
+	lock   sync.Mutex
+}
+
+// Accept is the fast-path classifier of the reader, it rejects the events that are not
+// part of an HTTP flow without allocating. An event is accepted if its payload holds the
+// start of a message, or if its flow did recently.
+func (f *FlowTable) Accept(data []byte) bool {
+	h := flowHash(data)
+	payload := tcpPayload(data)
+	now := time.Now()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if now.Sub(f.pruned) > ConnIdleTimeout {
+		for k, v := range f.mp {
+			if now.Sub(v) > ConnIdleTimeout {
+				delete(f.mp, k)
+			}
+		}
+		f.pruned = now
+	}
+
+	// the ClientHello of a TLS connection is parsed for its SNI, what follows is encrypted
+	if isClientHello(payload) {
+		return true
+	}
+	if hasMessageStart(payload) {
+		f.mp[h] = now
+		return true
+	}
+	if last, ok := f.mp[h]; ok && now.Sub(last) <= ConnIdleTimeout {
+		f.mp[h] = now
+		return true
+	}
+	return false
+}
+
+// tcpPayload returns the tcp payload of an ethernet/ip/tcp packet, or nil
+func tcpPayload(data []byte) []byte {
+	_, _, tcpOff, ok := packetOffsets(data)
+	if !ok {
+		return nil
+	}
+	start := tcpOff + int(data[tcpOff+12]>>4)*4
+	if start > len(data) {
+		return nil
+	}
+	return data[start:]
+}
+
+// hasMessageStart reports whether payload starts with a request or status line, or has
+// one at the start of a later line (see messageStart)
+func hasMessageStart(payload []byte) bool {
+	for len(payload) > 0 {
+		if bytes.HasPrefix(payload, []byte(HTTP+"/1.")) {
+			return true
+		}
+		if sp := bytes.IndexByte(payload, ' '); sp > 0 && sp <= len("OPTIONS") && isKnownMethod(string(payload[:sp])) {
+			return true
+		}
+		next := bytes.Index(payload, []byte("\r\n"))
+		if next < 0 {
+			return false
+		}
+		payload = payload[next+2:]
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+const (
+	EncodingJSON   = "json"
+	EncodingBinary = "binary"
+
+	// recordBinaryMagic starts every binary record; JSON records always start with '{'
+	recordBinaryMagic = 0xb1
+)
+
+// binaryFields maps the bin tag of every model field to its index. The binary encoding
+// stores each non-zero field as uvarint(tag) uvarint(len) value, so tags must never be
+// reused once released; unknown tags are skipped when decoding.
+var binaryFields = mustBinaryFields()
+
+func mustBinaryFields() map[uint64]int {
+	ret := map[uint64]int{}
+	typ := reflect.TypeOf(model{})
+	for i := 0; i < typ.NumField(); i++ {
+		tag, err := strconv.ParseUint(typ.Field(i).Tag.Get("bin"), 10, 64)
+		if err != nil || tag == 0 {
+			panic(fmt.Errorf("model field %s has no valid bin tag", typ.Field(i).Name))
+		}
+		if _, ok := ret[tag]; ok {
+			panic(fmt.Errorf("model field %s reuses bin tag %d", typ.Field(i).Name, tag))
+		}
+		ret[tag] = i
+	}
+	return ret
+}
+
+var bytesType = reflect.TypeOf([]byte(nil))
+
+// encodeRecord serializes a record with the -record-codec format, its bodies compressed
+// with -compress-bodies
+func encodeRecord(md model) ([]byte, error) {
+	stats.Add(StatCompressedBytes, int64(compressBodies(&md)))
+
+	if RecordCodec != EncodingBinary {
+		return json.Marshal(md)
+	}
+
+	buf := []byte{recordBinaryMagic}
+	v := reflect.ValueOf(md)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.IsZero() {
+			continue
+		}
+
+		var value []byte
+		switch {
+		case field.Type() == bytesType:
+			value = field.Bytes()
+		case field.Kind() == reflect.String:
+			value = []byte(field.String())
+		case field.Kind() == reflect.Int:
+			value = appendVarint(nil, field.Int())
+		case field.Kind() == reflect.Bool:
+			value = []byte{1}
+		default:
+			// maps, slices and nested structs keep their JSON form
+			byt, err := json.Marshal(field.Interface())
+			if err != nil {
+				return nil, err
+			}
+			value = byt
+		}
+
+		tag, _ := strconv.ParseUint(v.Type().Field(i).Tag.Get("bin"), 10, 64)
+		buf = appendUvarint(buf, tag)
+		buf = appendUvarint(buf, uint64(len(value)))
+		buf = append(buf, value...)
+	}
+	return buf, nil
+}
+
+// decodeRecord reads a record in either format, restoring its compressed bodies
+func decodeRecord(data []byte, md *model) error {
+	if len(data) == 0 || data[0] != recordBinaryMagic {
+		if err := json.Unmarshal(data, md); err != nil {
+			return err
+		}
+		return decompressBodies(md)
+	}
+
+	v := reflect.ValueOf(md).Elem()
+	data = data[1:]
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("binary record: bad field tag")
+		}
+		data = data[n:]
+
+		size, n := binary.Uvarint(data)
+		if n <= 0 || size > uint64(len(data[n:])) {
+			return errors.New("binary record: bad field length")
+		}
+		value := data[n : n+int(size)]
+		data = data[n+int(size):]
+
+		i, ok := binaryFields[tag]
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		switch {
+		case field.Type() == bytesType:
+			field.SetBytes(append([]byte(nil), value...))
+		case field.Kind() == reflect.String:
+			field.SetString(string(value))
+		case field.Kind() == reflect.Int:
+			x, n := binary.Varint(value)
+			if n <= 0 {
+				return fmt.Errorf("binary record: bad int field %d", tag)
+			}
+			field.SetInt(x)
+		case field.Kind() == reflect.Bool:
+			field.SetBool(len(value) > 0 && value[0] != 0)
+		default:
+			if err := json.Unmarshal(value, field.Addr().Interface()); err != nil {
+				return err
+			}
+		}
+	}
+	return decompressBodies(md)
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], x)]...)
+}
+
+func appendVarint(buf []byte, x int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], x)]...)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CodecNone   = "none"
+	CodecSnappy = "snappy"
+	CodecZstd   = "zstd"
+)
+
+// minCompressSize is the smallest body worth compressing
+const minCompressSize = 256
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedBody))
+)
+
+// compressedTypes are content types whose bodies are already compressed
+var compressedTypes = []string{"image/", "video/", "audio/", "zip", "gzip", "zstd", "x-7z", "x-rar", "x-xz", "x-bzip"}
+
+func isCompressedType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, v := range compressedTypes {
+		if strings.Contains(contentType, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func compressBody(codec string, body []byte) []byte {
+	switch codec {
+	case CodecSnappy:
+		return snappy.Encode(nil, body)
+	case CodecZstd:
+		return zstdEncoder.EncodeAll(body, nil)
+	}
+	return nil
+}
+
+func decompressBody(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecSnappy:
+		return snappy.Decode(nil, data)
+	case CodecZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unknown body codec %q", codec)
+}
+
+// compressBodies moves the bodies of a record to their compressed fields with the
+// -compress-bodies codec, unless compressing would not save anything. It returns the
+// bytes saved.
+func compressBodies(md *model) int {
+	if CompressBodies == CodecNone || len(md.BodyCodec) > 0 {
+		return 0
+	}
+
+	var saved int
+	if len(md.RequestBody) >= minCompressSize && !isCompressedType(md.RequestContentType) {
+		if data := compressBody(CompressBodies, []byte(md.RequestBody)); len(data) < len(md.RequestBody) {
+			saved += len(md.RequestBody) - len(data)
+			md.RequestBodyCompressed, md.RequestBody = data, ""
+		}
+	}
+	if body, ok := md.ResponseBody.(string); ok && len(body) >= minCompressSize && !isCompressedType(md.ResponseContextType) {
+		if data := compressBody(CompressBodies, []byte(body)); len(data) < len(body) {
+			saved += len(body) - len(data)
+			md.ResponseBodyCompressed, md.ResponseBody = data, nil
+		}
+	}
+	if len(md.RequestBodyCompressed) > 0 || len(md.ResponseBodyCompressed) > 0 {
+		md.BodyCodec = CompressBodies
+	}
+	return saved
+}
+
+// decompressBodies restores the bodies compressed by compressBodies
+func decompressBodies(md *model) error {
+	if len(md.BodyCodec) == 0 {
+		return nil
+	}
+
+	if len(md.RequestBodyCompressed) > 0 {
+		body, err := decompressBody(md.BodyCodec, md.RequestBodyCompressed)
+		if err != nil {
+			return fmt.Errorf("decompress request body: %w", err)
+		}
+		md.RequestBody, md.RequestBodyCompressed = string(body), nil
+	}
+	if len(md.ResponseBodyCompressed) > 0 {
+		body, err := decompressBody(md.BodyCodec, md.ResponseBodyCompressed)
+		if err != nil {
+			return fmt.Errorf("decompress response body: %w", err)
+		}
+		md.ResponseBody, md.ResponseBodyCompressed = string(body), nil
+	}
+	md.BodyCodec = ""
+	return nil
+}
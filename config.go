@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// reloadableFlags are applied to the running pipeline on SIGHUP, a change to any other
+// flag is only reported as needing a restart
+var reloadableFlags = map[string]bool{
+	"ip-family":         true,
+	"http-ports":        true,
+	"ua-deny":           true,
+	"redact-headers":    true,
+	"redact-body":       true,
+	"body-sample-rate":  true,
+	"request-body":      true,
+	"response-body":     true,
+	"request-body-max":  true,
+	"response-body-max": true,
+}
+
+const (
+	// secretValue flags are replaced as a whole
+	secretValue = "value"
+	// secretUserinfo flags are urls whose user and password are removed
+	secretUserinfo = "userinfo"
+)
+
+// secretFlags are never shown in full by /config or written to the db meta
+var secretFlags = map[string]string{
+	"snapshot-token": secretValue,
+	"webhook":        secretValue,
+	"es-endpoint":    secretUserinfo,
+}
+
+// flagString returns the value of a flag as shown to users, secrets redacted
+func flagString(f *flag.Flag) string {
+	v := f.Value.String()
+	if len(v) == 0 {
+		return v
+	}
+	switch secretFlags[f.Name] {
+	case secretValue:
+		return redacted
+	case secretUserinfo:
+		return stripUserinfo(v)
+	}
+	return v
+}
+
+// effectiveConfig returns the value of every flag as shown to users, secrets redacted
+func effectiveConfig() map[string]string {
+	ret := map[string]string{}
+	configLock.RLock()
+	defer configLock.RUnlock()
+	flag.VisitAll(func(f *flag.Flag) {
+		ret[f.Name] = flagString(f)
+	})
+	return ret
+}
+
+// logConfig logs the effective value of every flag, one sorted name=value per line
+func logConfig() {
+	config := effectiveConfig()
+	names := make([]string, 0, len(config))
+	for k := range config {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		log.Printf("[PRISM] config %s=%s", k, config[k])
+	}
+}
+
+// stripUserinfo removes the user and password of a url, the whole value is redacted if
+// it is not a url
+func stripUserinfo(v string) string {
+	u, err := url.Parse(v)
+	if err != nil {
+		return redacted
+	}
+	u.User = nil
+	return u.String()
+}
+
+// configLock is held while a reload changes the flags, the pipeline reads the reloadable
+// flags under its read lock so that it never sees half of a reload
+var configLock sync.RWMutex
+
+// commandLine save the flags set on the command line, they take precedence over the config file
+var commandLine = map[string]bool{}
+
+// readConfig reads a config file of name=value lines, one flag per line without its dash.
+// Repeatable flags may appear on several lines, blank lines and # comments are ignored.
+func readConfig(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret := map[string][]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(text, "=")
+		name = strings.TrimPrefix(strings.TrimSpace(name), "-")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected name=value", path, line)
+		}
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("%s:%d: unknown flag %q", path, line, name)
+		}
+		ret[name] = append(ret[name], strings.TrimSpace(value))
+	}
+	return ret, scanner.Err()
+}
+
+// flagValues returns the current values of a flag, each value of a repeatable flag
+func flagValues(f *flag.Flag) []string {
+	if list, ok := f.Value.(*stringList); ok {
+		return append([]string(nil), *list...)
+	}
+	return []string{f.Value.String()}
+}
+
+// setFlag sets a flag, replacing every previous value of a repeatable flag
+func setFlag(f *flag.Flag, values []string) error {
+	if list, ok := f.Value.(*stringList); ok {
+		*list = nil
+	}
+	for _, v := range values {
+		if err := f.Value.Set(v); err != nil {
+			return fmt.Errorf("flag %s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// configValues is the value a flag takes from the config file, its default when the file
+// does not set it
+func configValues(f *flag.Flag, config map[string][]string) []string {
+	if values, ok := config[f.Name]; ok {
+		return values
+	}
+	if _, ok := f.Value.(*stringList); ok {
+		return nil
+	}
+	return []string{f.DefValue}
+}
+
+// loadConfig applies the config file to the flags not set on the command line
+func loadConfig(path string) error {
+	flag.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = true
+	})
+
+	config, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	for name, values := range config {
+		if commandLine[name] {
+			continue
+		}
+		if err := setFlag(flag.Lookup(name), values); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// applyReloadable checks the reloadable flags and rebuilds what is derived from them
+func applyReloadable() error {
+	if IPFamily != FamilyAll && IPFamily != FamilyIPv4 && IPFamily != FamilyIPv6 {
+		return fmt.Errorf("ip-family must be ipv4, ipv6 or all")
+	}
+	if BodySampleRate < 0 || BodySampleRate > 1 {
+		return fmt.Errorf("body sample rate %v must be between 0 and 1", BodySampleRate)
+	}
+
+	var ports []uint16
+	if len(HttpPorts) > 0 {
+		var err error
+		if ports, err = parsePortList(HttpPorts); err != nil {
+			return err
+		}
+	}
+	if err := compileBodyRedactions(RedactBody); err != nil {
+		return err
+	}
+	return portFilters.Update(ports)
+}
+
+// reloadConfig re-reads the config file and applies the reloadable flags that changed all
+// at once, or none of them if one is invalid
+func reloadConfig(path string) error {
+	config, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	previous := map[*flag.Flag][]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if commandLine[f.Name] || f.Name == "config" || err != nil {
+			return
+		}
+
+		values := configValues(f, config)
+		if strings.Join(values, ",") == f.Value.String() {
+			return
+		}
+
+		// compare the values as formatted by the flag, so that 1 and 1.0 are the same rate
+		old := flagValues(f)
+		if err = setFlag(f, values); err != nil {
+			setFlag(f, old)
+			return
+		}
+		current := flagValues(f)
+		if strings.Join(old, ",") == strings.Join(current, ",") {
+			return
+		}
+
+		if !reloadableFlags[f.Name] {
+			log.Printf("[WARN] config: %s changed to %q, restart prism to apply it", f.Name, strings.Join(current, ","))
+			err = setFlag(f, old)
+			return
+		}
+		previous[f] = old
+	})
+	if err == nil {
+		err = applyReloadable()
+	}
+	if err != nil {
+		for f, old := range previous {
+			setFlag(f, old)
+		}
+		applyReloadable()
+		return err
+	}
+
+	for f, old := range previous {
+		log.Printf("[PRISM] config: %s changed from %q to %q", f.Name, strings.Join(old, ","), f.Value.String())
+	}
+	if len(previous) == 0 {
+		log.Printf("[PRISM] config: nothing to apply")
+	}
+	return nil
+}
+
+// WatchReload reloads the config file on every SIGHUP
+func WatchReload(ctx context.Context, path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if accessLog != nil {
+				if err := accessLog.Reopen(); err != nil {
+					log.Printf("[ERROR] %s", err.Error())
+				}
+			}
+			if len(path) == 0 {
+				log.Printf("[WARN] SIGHUP ignored, run prism with -config to reload a config file")
+				continue
+			}
+			log.Printf("[PRISM] SIGHUP, reloading %s", path)
+			if err := reloadConfig(path); err != nil {
+				log.Printf("[ERROR] reload config (%s)", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// connRetention is how long the aggregates of a finished connection are kept
+const connRetention = 10 * time.Minute
+
+// StatIdleConnections counts the connections finalized after -connection-idle-timeout
+// without traffic, their FIN may have been missed
+const StatIdleConnections = "connections_closed_idle"
+
+var connStats = ConnStatsTable{mp: map[string]*ConnStats{}, lru: list.New()}
+
+// ConnStats is the aggregate of a single TCP connection. BytesIn is the payload sent by
+// the client to the server and BytesOut the payload sent back.
+type ConnStats struct {
+	Client    string    `json:"client"`
+	Server    string    `json:"server"`
+	Requests  int       `json:"requests"`
+	BytesIn   int       `json:"bytes_in"`
+	BytesOut  int       `json:"bytes_out"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Duration  float64   `json:"duration"`
+	Closed    bool      `json:"closed"`
+	key       string
+	elem      *list.Element
+}
+
+// ConnStatsTable save the aggregates of every connection seen, keyed by the client to server
+// tuple. lru holds them the most recently active first, so that the least recently active
+// one is evicted above -max-connections without a scan.
+type ConnStatsTable struct {
+	mp   map[string]*ConnStats
+	lru  *list.List
+	lock sync.RWMutex
+}
+
+// Observe accounts a captured segment to its connection
+func (c *ConnStatsTable) Observe(http FlyHttp) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	forward := connKey(http.SrcIP, http.SrcPort, http.DstIP, http.DstPort)
+	backward := connKey(http.DstIP, http.DstPort, http.SrcIP, http.SrcPort)
+
+	// truncated segments carry no request or status line, so their direction
+	// follows whichever side of the connection was seen first
+	isRequest := http.Data.Type == IsRequest || http.Data.Type == IsClientHello
+	if http.Data.IsTruncation {
+		_, isRequest = c.mp[forward]
+	}
+
+	key := backward
+	if isRequest {
+		key = forward
+	}
+
+	stats, ok := c.mp[key]
+	if ok {
+		c.lru.MoveToFront(stats.elem)
+	} else {
+		if MaxConnections > 0 && len(c.mp) >= MaxConnections {
+			c.remove(c.lru.Back().Value.(*ConnStats))
+		}
+		stats = &ConnStats{FirstSeen: http.CreateTime, key: key}
+		stats.elem = c.lru.PushFront(stats)
+		if isRequest {
+			stats.Client = net.JoinHostPort(http.SrcIP, portNumber(http.SrcPort))
+			stats.Server = net.JoinHostPort(http.DstIP, portNumber(http.DstPort))
+		} else {
+			stats.Client = net.JoinHostPort(http.DstIP, portNumber(http.DstPort))
+			stats.Server = net.JoinHostPort(http.SrcIP, portNumber(http.SrcPort))
+		}
+		c.mp[key] = stats
+	}
+
+	if isRequest {
+		stats.BytesIn += http.Size
+		if !http.Data.IsTruncation {
+			stats.Requests++
+		}
+	} else {
+		stats.BytesOut += http.Size
+	}
+
+	stats.LastSeen = http.CreateTime
+	stats.Duration = stats.LastSeen.Sub(stats.FirstSeen).Seconds()
+	if http.FIN || http.RST {
+		stats.Closed = true
+	}
+}
+
+func (c *ConnStatsTable) remove(stats *ConnStats) {
+	c.lru.Remove(stats.elem)
+	delete(c.mp, stats.key)
+}
+
+// List returns a copy of the aggregates sorted by "bytes", "requests" or, by default, last seen
+func (c *ConnStatsTable) List(sortBy string) []ConnStats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	ret := make([]ConnStats, 0, len(c.mp))
+	for _, v := range c.mp {
+		ret = append(ret, *v)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		switch sortBy {
+		case "bytes":
+			return ret[i].BytesIn+ret[i].BytesOut > ret[j].BytesIn+ret[j].BytesOut
+		case "requests":
+			return ret[i].Requests > ret[j].Requests
+		default:
+			return ret[i].LastSeen.After(ret[j].LastSeen)
+		}
+	})
+	return ret
+}
+
+// Sweep finalizes the aggregates of the connections idle for longer than timeout, as if
+// they had been seen closing; they are forgotten with the other finished ones by Prune
+func (c *ConnStatsTable) Sweep(timeout time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, v := range c.mp {
+		if v.Closed || time.Since(v.LastSeen) <= timeout {
+			continue
+		}
+		v.Closed = true
+		stats.Add(StatIdleConnections, 1)
+		if Verbose {
+			log.Printf("[PRISM] connection %s -> %s idle, closed after %d requests, %d bytes in, %d bytes out",
+				v.Client, v.Server, v.Requests, v.BytesIn, v.BytesOut)
+		}
+	}
+}
+
+// Prune forgets the connections that have been idle for longer than the retention
+func (c *ConnStatsTable) Prune() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, v := range c.mp {
+		if time.Since(v.LastSeen) > connRetention {
+			c.remove(v)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nlHandle runs the netlink requests, in the network namespace of -container if set
+var nlHandle = &netlink.Handle{}
+
+const dockerSocket = "/var/run/docker.sock"
+
+// enterContainer points nlHandle at the network namespace of a container named by
+// docker://<id or name>, containerd://<id> or pid://<pid>
+func enterContainer(ref string) error {
+	pid, err := containerPid(ref)
+	if err != nil {
+		return fmt.Errorf("resolve container %s: %w", ref, err)
+	}
+
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		return fmt.Errorf("open netns of pid %d: %w", pid, err)
+	}
+	defer ns.Close()
+	if nlHandle, err = netlink.NewHandleAt(ns); err != nil {
+		return fmt.Errorf("open netlink in netns of pid %d: %w", pid, err)
+	}
+
+	name, _ := os.Readlink(fmt.Sprintf("/proc/%d/ns/net", pid))
+	log.Printf("[PRISM] container %s resolved to pid %d, netns %s", ref, pid, name)
+	return nil
+}
+
+func containerPid(ref string) (int, error) {
+	runtime, id, ok := strings.Cut(ref, "://")
+	if !ok || len(id) == 0 {
+		return 0, fmt.Errorf("must be docker://<id>, containerd://<id> or pid://<pid>")
+	}
+	switch runtime {
+	case "pid":
+		return strconv.Atoi(id)
+	case "docker":
+		pid, err := dockerPid(id)
+		if err == nil {
+			return pid, nil
+		}
+		log.Printf("[WARN] docker api (%s), scanning /proc for container %s", err.Error(), id)
+		return cgroupPid(id)
+	case "containerd":
+		return cgroupPid(id)
+	default:
+		return 0, fmt.Errorf("unknown container runtime %q, must be docker, containerd or pid", runtime)
+	}
+}
+
+// dockerPid asks the docker engine for the pid of a container, which may also be named
+func dockerPid(id string) (int, error) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", dockerSocket)
+			},
+		},
+	}
+	resp, err := client.Get("http://docker/containers/" + id + "/json")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("inspect container: %s", resp.Status)
+	}
+
+	var inspect struct {
+		State struct {
+			Pid int `json:"Pid"`
+		} `json:"State"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return 0, err
+	}
+	if inspect.State.Pid == 0 {
+		return 0, fmt.Errorf("container %s is not running", id)
+	}
+	return inspect.State.Pid, nil
+}
+
+// cgroupPid returns the lowest pid whose cgroup path has the container id, both docker
+// and containerd name the cgroup of a container after its id
+func cgroupPid(id string) (int, error) {
+	files, err := filepath.Glob("/proc/[0-9]*/cgroup")
+	if err != nil {
+		return 0, err
+	}
+	found := 0
+	for _, file := range files {
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(file)))
+		if err != nil || (found > 0 && pid >= found) {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err == nil && strings.Contains(string(data), id) {
+			found = pid
+		}
+	}
+	if found == 0 {
+		return 0, fmt.Errorf("no process in the cgroup of container %s", id)
+	}
+	return found, nil
+}
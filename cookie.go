@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Cookie is a cookie set by a response
+type Cookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	MaxAge   int    `json:"max_age,omitempty"`
+	Secure   bool   `json:"secure"`
+	HttpOnly bool   `json:"http_only"`
+	SameSite string `json:"same_site,omitempty"`
+}
+
+var sameSite = map[http.SameSite]string{
+	http.SameSiteLaxMode:    "Lax",
+	http.SameSiteStrictMode: "Strict",
+	http.SameSiteNoneMode:   "None",
+}
+
+// requestCookies decodes the Cookie header of a request
+func requestCookies(headers map[string]string) map[string]string {
+	value := headerValue(headers, "Cookie")
+	if len(value) == 0 {
+		return nil
+	}
+
+	req := http.Request{Header: http.Header{"Cookie": {value}}}
+	ret := map[string]string{}
+	for _, v := range req.Cookies() {
+		ret[v.Name] = v.Value
+	}
+	return ret
+}
+
+// responseCookies decodes the Set-Cookie header of a response. Headers are stored one value
+// per name, so only the last Set-Cookie of a response is seen.
+func responseCookies(headers map[string]string) []Cookie {
+	value := headerValue(headers, "Set-Cookie")
+	if len(value) == 0 {
+		return nil
+	}
+
+	resp := http.Response{Header: http.Header{"Set-Cookie": {value}}}
+	var ret []Cookie
+	for _, v := range resp.Cookies() {
+		cookie := Cookie{
+			Name:     v.Name,
+			Value:    v.Value,
+			Path:     v.Path,
+			Domain:   v.Domain,
+			MaxAge:   v.MaxAge,
+			Secure:   v.Secure,
+			HttpOnly: v.HttpOnly,
+			SameSite: sameSite[v.SameSite],
+		}
+		if !v.Expires.IsZero() {
+			cookie.Expires = v.RawExpires
+		}
+		ret = append(ret, cookie)
+	}
+	return ret
+}
+
+// hasCookie reports whether the request sent or the response set a cookie named name
+func hasCookie(md *model, name string) bool {
+	if _, ok := md.RequestCookies[name]; ok {
+		return true
+	}
+	for _, v := range md.ResponseCookies {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// redactCookies replaces the values of the request cookies when Cookie is in
+// -redact-headers, and of the response cookies when Set-Cookie is, like the headers
+// they are decoded from
+func redactCookies(md *model) {
+	if isRedactedHeader("Cookie") {
+		for k := range md.RequestCookies {
+			md.RequestCookies[k] = redacted
+		}
+	}
+	if isRedactedHeader("Set-Cookie") {
+		for i := range md.ResponseCookies {
+			md.ResponseCookies[i].Value = redacted
+		}
+	}
+}
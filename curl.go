@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// curlCommand renders a stored request as a replayable curl command line
+func curlCommand(md model) string {
+	var b strings.Builder
+
+	binary := isBinary(md.RequestBody)
+	if binary {
+		b.WriteString("# request body is binary, pipe it on stdin to replay it\n")
+	}
+	if len(md.RequestBodyBlob) > 0 {
+		binary = true
+		b.WriteString(fmt.Sprintf("# request body is stored in a blob, pipe /blobs/%s on stdin to replay it\n", md.RequestBodyBlob))
+	}
+
+	b.WriteString("curl -X ")
+	b.WriteString(shellQuote(md.RequestMethod))
+	b.WriteString(" ")
+	b.WriteString(shellQuote(requestURL(md)))
+
+	headers := redactHeaders(md.RequestHeaders)
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		// curl computes these itself
+		if strings.EqualFold(k, ContentLength) || strings.EqualFold(k, TransferEncoding) {
+			continue
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		b.WriteString(" \\\n  -H ")
+		b.WriteString(shellQuote(fmt.Sprintf("%s: %s", k, headers[k])))
+	}
+
+	if len(md.RequestBody) > 0 || len(md.RequestBodyBlob) > 0 {
+		if binary {
+			b.WriteString(" \\\n  --data-binary @-")
+		} else {
+			b.WriteString(" \\\n  --data ")
+			b.WriteString(shellQuote(md.RequestBody))
+		}
+	}
+	b.WriteString("\n")
+
+	return b.String()
+}
+
+// requestURL reconstructs the absolute URL of a request from its Host header and path
+func requestURL(md model) string {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     md.host(),
+		Path:     md.RequestURL,
+		RawQuery: url.Values(md.RequestParma).Encode(),
+	}
+	return u.String()
+}
+
+// portNumber strips the service name gopacket appends to well-known ports, e.g. "80(http)"
+func portNumber(port string) string {
+	if i := strings.Index(port, "("); i >= 0 {
+		return port[:i]
+	}
+	return port
+}
+
+// shellQuote wraps s in single quotes so that no shell-special character is interpreted
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func isBinary(s string) bool {
+	if !utf8.ValidString(s) {
+		return true
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return true
+		}
+	}
+	return false
+}
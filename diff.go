@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxDiffLines bounds the lines of a body compared line by line, the comparison being
+// quadratic; longer bodies are only compared by size and hash
+const maxDiffLines = 2000
+
+// textTypes are the content types whose bodies are compared line by line
+var textTypes = []string{"text/", "json", "xml", "javascript", "x-www-form-urlencoded", "yaml"}
+
+// RecordDiff is how record b differs from record a
+type RecordDiff struct {
+	A        string      `json:"a"`
+	B        string      `json:"b"`
+	Fields   []FieldDiff `json:"fields"`
+	Request  MessageDiff `json:"request"`
+	Response MessageDiff `json:"response"`
+}
+
+// FieldDiff is a field of the records that differs
+type FieldDiff struct {
+	Name string      `json:"name"`
+	A    interface{} `json:"a"`
+	B    interface{} `json:"b"`
+}
+
+type MessageDiff struct {
+	Headers HeaderDiff `json:"headers"`
+	Body    BodyDiff   `json:"body"`
+}
+
+// HeaderDiff lists the headers only in a, only in b, and in both with another value
+type HeaderDiff struct {
+	Added   map[string]string    `json:"added"`
+	Removed map[string]string    `json:"removed"`
+	Changed map[string]FieldDiff `json:"changed"`
+}
+
+// BodyDiff compares two bodies: text bodies line by line, with the lines of a prefixed
+// with "- ", those of b with "+ " and the common ones with "  "; other bodies by hash
+type BodyDiff struct {
+	Equal bool   `json:"equal"`
+	Text  bool   `json:"text"`
+	SizeA int    `json:"size_a"`
+	SizeB int    `json:"size_b"`
+	HashA string `json:"hash_a,omitempty"`
+	HashB string `json:"hash_b,omitempty"`
+	Diff  string `json:"diff,omitempty"`
+}
+
+// diff compares the records ?a= and ?b=, e.g. a request that works and one that fails
+func (h Handler) diff(ctx *gin.Context) {
+	if len(ctx.Query("a")) == 0 || len(ctx.Query("b")) == 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg": "a and b must be record ids",
+		})
+		return
+	}
+
+	var records [2]model
+	for i, id := range []string{ctx.Query("a"), ctx.Query("b")} {
+		md, ok := h.loadRecord(ctx, id)
+		if !ok {
+			return
+		}
+		if err := resolveBodies(&md); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"msg": err.Error(),
+			})
+			return
+		}
+		records[i] = md
+	}
+	a, b := records[0], records[1]
+
+	ret := RecordDiff{A: ctx.Query("a"), B: ctx.Query("b")}
+	fields := []FieldDiff{
+		{"request_method", a.RequestMethod, b.RequestMethod},
+		{"request_host", a.RequestHost, b.RequestHost},
+		{"request_url", a.RequestURL, b.RequestURL},
+		{"request_dst_ip", a.RequestDstIP, b.RequestDstIP},
+		{"request_dst_port", a.RequestDstPort, b.RequestDstPort},
+		{"response_status", a.ResponseStatus, b.ResponseStatus},
+		{"latency_us", a.Latency, b.Latency},
+	}
+	for _, v := range fields {
+		if v.A != v.B {
+			ret.Fields = append(ret.Fields, v)
+		}
+	}
+
+	var bodies [4][]byte
+	for i, md := range records {
+		var err error
+		if bodies[i], err = bodyBytes(md.RequestBody, md.RequestBodyBlob); err == nil {
+			bodies[2+i], err = bodyBytes(md.ResponseBody, md.ResponseBodyBlob)
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"msg": err.Error(),
+			})
+			return
+		}
+	}
+	ret.Request = MessageDiff{
+		Headers: diffHeaders(a.RequestHeaders, b.RequestHeaders),
+		Body:    diffBodies(bodies[0], bodies[1], a.RequestContentType, b.RequestContentType),
+	}
+	ret.Response = MessageDiff{
+		Headers: diffHeaders(responseHeaders(a), responseHeaders(b)),
+		Body:    diffBodies(bodies[2], bodies[3], a.ResponseContextType, b.ResponseContextType),
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"data": ret,
+	})
+}
+
+// bodyBytes returns a stored body, read from its blob file if it was moved out of the record
+func bodyBytes(body interface{}, blob string) ([]byte, error) {
+	if len(blob) > 0 {
+		return readBlob(blob)
+	}
+	switch v := body.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return json.Marshal(v)
+	}
+}
+
+// responseHeaders returns the response headers a record keeps
+func responseHeaders(md model) map[string]string {
+	ret := map[string]string{}
+	if len(md.ResponseContextType) > 0 {
+		ret[ContentType] = md.ResponseContextType
+	}
+	if len(md.ResponseContentEncoding) > 0 {
+		ret["Content-Encoding"] = md.ResponseContentEncoding
+	}
+	for _, v := range md.ResponseCookies {
+		ret["Set-Cookie: "+v.Name] = v.Value
+	}
+	return ret
+}
+
+func diffHeaders(a, b map[string]string) HeaderDiff {
+	ret := HeaderDiff{Added: map[string]string{}, Removed: map[string]string{}, Changed: map[string]FieldDiff{}}
+	for k, v := range a {
+		other, ok := b[k]
+		if !ok {
+			ret.Removed[k] = v
+			continue
+		}
+		if other != v {
+			ret.Changed[k] = FieldDiff{Name: k, A: v, B: other}
+		}
+	}
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			ret.Added[k] = v
+		}
+	}
+	return ret
+}
+
+func diffBodies(a, b []byte, typeA, typeB string) BodyDiff {
+	ret := BodyDiff{
+		Equal: string(a) == string(b),
+		SizeA: len(a),
+		SizeB: len(b),
+		Text:  isTextBody(a, typeA) && isTextBody(b, typeB),
+	}
+	if ret.Equal {
+		return ret
+	}
+
+	linesA, linesB := strings.Split(string(a), "\n"), strings.Split(string(b), "\n")
+	if !ret.Text || len(linesA) > maxDiffLines || len(linesB) > maxDiffLines {
+		ret.Text = false
+		hashA, hashB := sha256.Sum256(a), sha256.Sum256(b)
+		ret.HashA, ret.HashB = hex.EncodeToString(hashA[:]), hex.EncodeToString(hashB[:])
+		return ret
+	}
+	ret.Diff = diffLines(linesA, linesB)
+	return ret
+}
+
+// isTextBody reports whether a body of contentType can be diffed as text
+func isTextBody(body []byte, contentType string) bool {
+	if !utf8.Valid(body) {
+		return false
+	}
+	if len(contentType) == 0 {
+		return true
+	}
+	contentType = strings.ToLower(contentType)
+	for _, v := range textTypes {
+		if strings.Contains(contentType, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// diffLines returns the lines of a and b along their longest common subsequence
+func diffLines(a, b []string) string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ret strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(&ret, "  %s\n", a[i])
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&ret, "- %s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&ret, "+ %s\n", b[j])
+			j++
+		}
+	}
+	return ret.String()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"golang.org/x/sys/unix"
+	"log"
+	"sync"
+	"time"
+)
+
+var diskGuard DiskGuard
+
+// DiskGuard suspends storage while the free space of the data path filesystem is below
+// the -min-free-disk threshold, capture and parsing keep running meanwhile
+type DiskGuard struct {
+	low  bool
+	lock sync.RWMutex
+}
+
+// Low reports whether records must not be stored
+func (d *DiskGuard) Low() bool {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.low
+}
+
+// Watch checks the free space of path every interval until ctx is done
+func (d *DiskGuard) Watch(ctx context.Context, path string, min uint64, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		d.check(path, min)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *DiskGuard) check(path string, min uint64) {
+	free, err := freeDisk(path)
+	if err != nil {
+		log.Printf("[ERROR] check free disk of %s (%s)", path, err.Error())
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	low := free < min
+	if low == d.low {
+		return
+	}
+	d.low = low
+	if low {
+		stats.Set(StatDiskLow, 1)
+		log.Printf("[ERROR] only %d MiB free under %s, storage suspended", free>>20, path)
+	} else {
+		stats.Set(StatDiskLow, 0)
+		log.Printf("[PRISM] %d MiB free under %s, storage resumed", free>>20, path)
+	}
+}
+
+// freeDisk returns the bytes available to unprivileged users on the filesystem of path
+func freeDisk(path string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+// the reasons an event or a record is dropped, each counted as dropped_<reason> in /stats
+const (
+	DropCaptureDisabled = "capture_disabled"
+	DropLostSamples     = "lost_samples"
+	DropDecodeError     = "decode_error"
+	DropNonHTTP         = "non_http"
+	DropParseError      = "parse_error"
+	DropParseTimeout    = "parse_timeout"
+	DropIPFamily        = "ip_family"
+	DropListeningPort   = "listening_port"
+	DropDeniedUserAgent = "denied_user_agent"
+	DropContentType     = "content_type"
+	DropDiskLow         = "disk_low"
+	DropBodySampled     = "body_sampled"
+	DropQueueFull       = "queue_full"
+	DropIndexError      = "index_error"
+	DropSinkError       = "sink_error"
+	DropBodyOnly        = "body_only"
+	DropBodySize        = "body_size"
+	DropPreexisting     = "preexisting_connection"
+)
+
+const dropStatPrefix = "dropped_"
+
+// drop accounts n events or records dropped for reason. With -trace-drops every drop is
+// logged as reason=<reason> followed by the details, which are only formatted then.
+func drop(reason string, n int64, format string, v ...interface{}) {
+	stats.Add(dropStatPrefix+reason, n)
+	if TraceDrops {
+		log.Printf("[PRISM] drop reason=%s count=%d %s", reason, n, fmt.Sprintf(format, v...))
+	}
+}
+
+// flowFields formats the addresses of a segment for the drop logs
+func flowFields(http FlyHttp) string {
+	return fmt.Sprintf("src=%s dst=%s", net.JoinHostPort(http.SrcIP, portNumber(http.SrcPort)),
+		net.JoinHostPort(http.DstIP, portNumber(http.DstPort)))
+}
+
+// writeDropMetrics writes the drop counters as prism_dropped_total{reason=...}
+func writeDropMetrics(w io.Writer) error {
+	all := stats.List()
+	var reasons []string
+	for k := range all {
+		if strings.HasPrefix(k, dropStatPrefix) {
+			reasons = append(reasons, k)
+		}
+	}
+	sort.Strings(reasons)
+
+	var b strings.Builder
+	b.WriteString("# HELP prism_dropped_total Events and records dropped, by reason.\n")
+	b.WriteString("# TYPE prism_dropped_total counter\n")
+	for _, k := range reasons {
+		fmt.Fprintf(&b, "prism_dropped_total{reason=%q} %d\n", strings.TrimPrefix(k, dropStatPrefix), all[k])
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+var endpoints = EndpointTable{mp: map[Endpoint]*EndpointStats{}, lru: list.New()}
+
+// Endpoint groups the records of repeated calls, e.g. a health check polled every second
+type Endpoint struct {
+	Method string `json:"method"`
+	Host   string `json:"host"`
+	Path   string `json:"path"`
+}
+
+func endpointOf(md *model) Endpoint {
+	return Endpoint{Method: md.RequestMethod, Host: md.host(), Path: md.RequestURL}
+}
+
+// EndpointStats counts the calls captured to an endpoint since prism started
+type EndpointStats struct {
+	Endpoint
+	Count    int       `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+	elem     *list.Element
+}
+
+// EndpointTable save the captured calls, keyed by endpoint. With -max-endpoints the least
+// recently called endpoints are forgotten, lru holding the most recent first.
+type EndpointTable struct {
+	mp   map[Endpoint]*EndpointStats
+	lru  *list.List
+	lock sync.RWMutex
+}
+
+func (e *EndpointTable) Observe(md *model) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	key := endpointOf(md)
+	v, ok := e.mp[key]
+	if ok {
+		e.lru.MoveToFront(v.elem)
+	} else {
+		if MaxEndpoints > 0 && len(e.mp) >= MaxEndpoints {
+			oldest := e.lru.Remove(e.lru.Back()).(*EndpointStats)
+			delete(e.mp, oldest.Endpoint)
+			stats.Add(StatEvictedEndpoints, 1)
+		}
+		v = &EndpointStats{Endpoint: key}
+		v.elem = e.lru.PushFront(v)
+		e.mp[key] = v
+	}
+	v.Count++
+	v.LastSeen = time.Now()
+}
+
+func (e *EndpointTable) Count(key Endpoint) int {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if v, ok := e.mp[key]; ok {
+		return v.Count
+	}
+	return 0
+}
+
+// List returns the endpoints, the most called first
+func (e *EndpointTable) List() []EndpointStats {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	ret := make([]EndpointStats, 0, len(e.mp))
+	for _, v := range e.mp {
+		ret = append(ret, *v)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Count > ret[j].Count
+	})
+	return ret
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// esFlushInterval is how often a batch smaller than -es-batch is sent
+	esFlushInterval = 5 * time.Second
+	// esTemplate is the index template installed for the prism indices
+	esTemplate = "prism"
+	// esMaxAttempts is how many times a batch is sent before the records Elasticsearch
+	// did not index are dropped
+	esMaxAttempts = 5
+)
+
+// esIndexTokens translate the Logstash date pattern of an index name to a Go layout
+var esIndexTokens = strings.NewReplacer("yyyy", "2006", "MM", "01", "dd", "02", "HH", "15")
+
+// esMappings are the types of the document fields, the headers are flattened so that
+// their names do not each add a field to the mapping
+var esMappings = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"@timestamp":         map[string]string{"type": "date"},
+		"id":                 map[string]string{"type": "keyword"},
+		"method":             map[string]string{"type": "keyword"},
+		"host":               map[string]string{"type": "keyword"},
+		"path":               map[string]string{"type": "keyword"},
+		"status":             map[string]string{"type": "short"},
+		"latency_us":         map[string]string{"type": "long"},
+		"src_ip":             map[string]string{"type": "ip"},
+		"dst_ip":             map[string]string{"type": "ip"},
+		"src_port":           map[string]string{"type": "integer"},
+		"dst_port":           map[string]string{"type": "integer"},
+		"request_headers":    map[string]string{"type": "flattened"},
+		"request_body":       map[string]string{"type": "text"},
+		"request_body_size":  map[string]string{"type": "long"},
+		"response_type":      map[string]string{"type": "keyword"},
+		"response_body":      map[string]string{"type": "text"},
+		"response_body_size": map[string]string{"type": "long"},
+		"unpaired":           map[string]string{"type": "keyword"},
+		"sni":                map[string]string{"type": "keyword"},
+		"interface":          map[string]string{"type": "keyword"},
+		"session":            map[string]string{"type": "keyword"},
+		"tags":               map[string]string{"type": "keyword"},
+	},
+}
+
+// esDocument is a record as indexed, its body kept as text whatever its content type
+type esDocument struct {
+	Timestamp        time.Time         `json:"@timestamp"`
+	ID               string            `json:"id"`
+	Method           string            `json:"method"`
+	Host             string            `json:"host"`
+	Path             string            `json:"path"`
+	Status           int               `json:"status,omitempty"`
+	Latency          int               `json:"latency_us,omitempty"`
+	SrcIP            string            `json:"src_ip,omitempty"`
+	DstIP            string            `json:"dst_ip,omitempty"`
+	SrcPort          int               `json:"src_port"`
+	DstPort          int               `json:"dst_port"`
+	RequestHeaders   map[string]string `json:"request_headers,omitempty"`
+	RequestBody      string            `json:"request_body,omitempty"`
+	RequestBodySize  int               `json:"request_body_size"`
+	ResponseType     string            `json:"response_type,omitempty"`
+	ResponseBody     string            `json:"response_body,omitempty"`
+	ResponseBodySize int               `json:"response_body_size"`
+	Unpaired         string            `json:"unpaired,omitempty"`
+	SNI              string            `json:"sni,omitempty"`
+	Interface        string            `json:"interface,omitempty"`
+	Session          string            `json:"session,omitempty"`
+	Tags             []string          `json:"tags,omitempty"`
+}
+
+func newESDocument(md model, now time.Time) esDocument {
+	doc := esDocument{
+		Timestamp:        now,
+		ID:               md.Id,
+		Method:           md.RequestMethod,
+		Host:             md.host(),
+		Path:             md.RequestURL,
+		Status:           md.ResponseStatus,
+		Latency:          md.Latency,
+		SrcIP:            md.RequestSrcIP,
+		DstIP:            md.RequestDstIP,
+		RequestHeaders:   md.RequestHeaders,
+		RequestBody:      md.RequestBody,
+		RequestBodySize:  md.RequestBodySize,
+		ResponseType:     md.ResponseContextType,
+		ResponseBodySize: md.ResponseBodySize,
+		Unpaired:         md.Unpaired,
+		Interface:        md.Interface,
+		Session:          md.Session,
+		Tags:             md.Tag,
+	}
+	doc.SrcPort, _ = strconv.Atoi(portNumber(md.RequestSrcPort))
+	doc.DstPort, _ = strconv.Atoi(portNumber(md.RequestDstPort))
+	if md.RequestHeaders == nil && len(md.RequestHeadersRaw) > 0 {
+		doc.RequestHeaders = parseHeaders(md.RequestHeadersRaw)
+	}
+	switch v := md.ResponseBody.(type) {
+	case nil:
+	case string:
+		doc.ResponseBody = v
+	default:
+		byt, _ := json.Marshal(v)
+		doc.ResponseBody = string(byt)
+	}
+	if md.TLS != nil {
+		doc.SNI = md.TLS.SNI
+	}
+	return doc
+}
+
+// ESSink indexes every record in Elasticsearch with the _bulk API, in batches retried
+// with jittered backoff until they are accepted
+type ESSink struct {
+	endpoint string
+	index    string
+	batch    int
+	queue    chan model
+	client   *http.Client
+	rand     *rand.Rand
+}
+
+// NewESSink ships the records to the Elasticsearch at endpoint, credentials may be given
+// in the url. index may hold a date pattern such as prism-%{+yyyy.MM.dd}.
+func NewESSink(endpoint, index string, batch int) (*ESSink, error) {
+	if batch < 1 {
+		return nil, fmt.Errorf("-es-batch must be at least 1")
+	}
+	if len(index) == 0 {
+		return nil, fmt.Errorf("-es-index cannot be empty")
+	}
+	return &ESSink{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		index:    index,
+		batch:    batch,
+		queue:    make(chan model, sinkQueueSize),
+		client:   &http.Client{Timeout: 30 * time.Second},
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// indexName returns the index of a record indexed at now, with the date pattern of the
+// index, e.g. %{+yyyy.MM.dd}, replaced by the UTC date
+func (s *ESSink) indexName(now time.Time) string {
+	start := strings.Index(s.index, "%{+")
+	if start < 0 {
+		return s.index
+	}
+	end := strings.Index(s.index[start:], "}")
+	if end < 0 {
+		return s.index
+	}
+	layout := esIndexTokens.Replace(s.index[start+3 : start+end])
+	return s.index[:start] + now.UTC().Format(layout) + s.index[start+end+1:]
+}
+
+// Publish queues a record, dropping it when Elasticsearch cannot keep up
+func (s *ESSink) Publish(md model) {
+	select {
+	case s.queue <- md:
+	default:
+		rateLog.Printf("[ERROR] elasticsearch queue full, drop record %s", md.Id)
+		drop(DropQueueFull, 1, "sink=elasticsearch id=%s", md.Id)
+	}
+}
+
+// Run installs the index template, then sends the queued records every -es-batch records
+// or every esFlushInterval until ctx is done
+func (s *ESSink) Run(ctx context.Context) {
+	if err := s.putTemplate(ctx); err != nil {
+		log.Printf("[ERROR] install elasticsearch template (%s), the fields get dynamic types", err.Error())
+	}
+
+	ticker := time.NewTicker(esFlushInterval)
+	defer ticker.Stop()
+	var items [][]byte
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case md := <-s.queue:
+			if item := s.encodeRecord(md, time.Now()); item != nil {
+				items = append(items, item)
+			}
+			if len(items) < s.batch {
+				continue
+			}
+		case <-ticker.C:
+			if len(items) == 0 {
+				continue
+			}
+		}
+
+		if !s.send(ctx, items) {
+			return
+		}
+		items = nil
+	}
+}
+
+// encodeRecord returns the action and the document of a record in a _bulk body, nil if it
+// cannot be encoded. Only the keys of -key-layout content name an exchange, the others
+// an endpoint, so documents get an _id of their own unless the key is the content one.
+func (s *ESSink) encodeRecord(md model, now time.Time) []byte {
+	action := map[string]string{"_index": s.indexName(now)}
+	if KeyLayout == KeyContent && len(md.Id) > 0 {
+		action["_id"] = md.Id
+	}
+	var item bytes.Buffer
+	enc := json.NewEncoder(&item)
+	if err := enc.Encode(map[string]interface{}{"index": action}); err != nil {
+		log.Printf("[ERROR] marshal elasticsearch action (%s)", err.Error())
+		return nil
+	}
+	if err := enc.Encode(newESDocument(md, now)); err != nil {
+		log.Printf("[ERROR] marshal elasticsearch document (%s)", err.Error())
+		return nil
+	}
+	return item.Bytes()
+}
+
+// send posts a batch, retrying with jittered backoff the whole batch when the request
+// fails and the records Elasticsearch rejected as overloaded, false if ctx is done first.
+// The records still not indexed after esMaxAttempts are dropped, so that a lasting outage
+// does not stop the queue.
+func (s *ESSink) send(ctx context.Context, items [][]byte) bool {
+	for attempt := 1; ; attempt++ {
+		retry, err := s.bulk(ctx, items)
+		if err == nil && len(retry) == 0 {
+			return true
+		}
+		if err == nil {
+			items = retry
+		}
+		if attempt == esMaxAttempts {
+			log.Printf("[ERROR] elasticsearch did not index %d records after %d attempts, dropped", len(items), attempt)
+			drop(DropSinkError, int64(len(items)), "sink=elasticsearch attempts=%d", attempt)
+			return true
+		}
+
+		delay := jitteredBackoff(s.rand, attempt-1)
+		if err != nil {
+			log.Printf("[ERROR] elasticsearch bulk of %d records (%s), retry in %s", len(items), err.Error(), delay)
+		} else {
+			rateLog.Printf("[ERROR] elasticsearch overloaded, rejected %d records, retry in %s", len(items), delay)
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+// bulk posts a _bulk body and returns the items Elasticsearch rejected with 429, which are
+// retried. The others it rejected, e.g. for a mapping conflict, would be rejected again and
+// are dropped.
+func (s *ESSink) bulk(ctx context.Context, items [][]byte) ([][]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+"/_bulk", bytes.NewReader(bytes.Join(items, nil)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(ContentType, "application/x-ndjson")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode bulk response: %w", err)
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+	// the items of the response are in the order of the request
+	var retry [][]byte
+	for i, item := range result.Items {
+		for _, v := range item {
+			switch {
+			case v.Status == http.StatusTooManyRequests && i < len(items):
+				retry = append(retry, items[i])
+			case v.Status >= 300:
+				drop(DropIndexError, 1, "sink=elasticsearch status=%d error=%s", v.Status, v.Error)
+				rateLog.Printf("[ERROR] elasticsearch rejected a record (%d %s)", v.Status, v.Error)
+			}
+		}
+	}
+	return retry, nil
+}
+
+// putTemplate installs the mappings of the indices matching the -es-index prefix
+func (s *ESSink) putTemplate(ctx context.Context) error {
+	pattern := s.index
+	if i := strings.Index(pattern, "%{"); i >= 0 {
+		pattern = pattern[:i]
+	}
+	byt, err := json.Marshal(map[string]interface{}{
+		"index_patterns": []string{pattern + "*"},
+		"template":       map[string]interface{}{"mappings": esMappings},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.endpoint+"/_index_template/"+esTemplate, bytes.NewReader(byt))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(ContentType, ContentTypeJSON)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, msg)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultEventData is MAX_DATA_SIZE of the bundled eBPF programs
+const defaultEventData = 1024 * 4
+
+// EventLayout describes the http_data_event struct the eBPF programs were built with:
+//
+//	struct http_data_event {
+//	  enum tc_type type;
+//	  __u8 data[data];
+//	  __u32 data_len;
+//	  __u32 max_len;
+//	  __u32 truncation;
+//	  __u32 ifindex;
+//	  /* extra bytes of fields appended by a custom build */
+//	};
+type EventLayout struct {
+	Data  int
+	Extra int
+}
+
+// eventLayout is set from -event-layout
+var eventLayout = EventLayout{Data: defaultEventData}
+
+// parseEventLayout parses "default", or a descriptor such as "data=8192,extra=8" for
+// programs rebuilt with another MAX_DATA_SIZE or with fields appended to the event
+func parseEventLayout(s string) (EventLayout, error) {
+	layout := EventLayout{Data: defaultEventData}
+	if s == "default" {
+		return layout, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return layout, fmt.Errorf("bad event layout %q: %q is not a size", s, part)
+		}
+		switch k {
+		case "data":
+			layout.Data = n
+		case "extra":
+			layout.Extra = n
+		default:
+			return layout, fmt.Errorf("bad event layout %q: unknown field %q, must be data or extra", s, k)
+		}
+	}
+	if layout.Data == 0 {
+		return layout, fmt.Errorf("bad event layout %q: data must not be empty", s)
+	}
+	return layout, nil
+}
+
+// fieldsOffset is where the u32 fields start, after the 4 bytes enum and data, aligned
+// on 4 bytes
+func (l EventLayout) fieldsOffset() int {
+	return 4 + (l.Data+3)/4*4
+}
+
+// Size is sizeof(struct http_data_event), padded to the 4 bytes alignment of the struct
+func (l EventLayout) Size() int {
+	return (l.fieldsOffset() + 16 + l.Extra + 3) / 4 * 4
+}
+
+// HttpDataEvent is a decoded http_data_event, Data refers to the raw record
+type HttpDataEvent struct {
+	Type       uint32
+	Data       []byte
+	DataLen    uint32
+	MaxLen     uint32
+	Truncation uint32
+	// Ifindex is the index of the interface the packet was captured on
+	Ifindex uint32
+}
+
+// decodeEvent decodes a ringbuf or perf record with the configured layout. Perf records
+// may be padded to 8 bytes, a record of any other size means the programs were built
+// with another layout.
+func decodeEvent(raw []byte) (HttpDataEvent, error) {
+	size := eventLayout.Size()
+	if len(raw) < size || len(raw) >= size+8 {
+		return HttpDataEvent{}, fmt.Errorf("event record is %d bytes but the event layout is %d bytes, "+
+			"set -event-layout to the http_data_event the eBPF programs were built with", len(raw), size)
+	}
+
+	off := eventLayout.fieldsOffset()
+	event := HttpDataEvent{
+		Type:       binary.LittleEndian.Uint32(raw),
+		Data:       raw[4 : 4+eventLayout.Data],
+		DataLen:    binary.LittleEndian.Uint32(raw[off:]),
+		MaxLen:     binary.LittleEndian.Uint32(raw[off+4:]),
+		Truncation: binary.LittleEndian.Uint32(raw[off+8:]),
+		Ifindex:    binary.LittleEndian.Uint32(raw[off+12:]),
+	}
+	if int(event.DataLen) > eventLayout.Data {
+		return HttpDataEvent{}, fmt.Errorf("event data_len %d exceeds the %d bytes data of the event layout",
+			event.DataLen, eventLayout.Data)
+	}
+	return event, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+)
+
+// deniedUserAgent reports whether the request comes from a user-agent on the denylist
+func deniedUserAgent(headers map[string]string) bool {
+	if len(UADeny) == 0 {
+		return false
+	}
+
+	agent := strings.ToLower(headerValue(headers, "User-Agent"))
+	if len(agent) == 0 {
+		return false
+	}
+	for _, list := range UADeny {
+		for _, v := range strings.Split(list, ",") {
+			v = strings.TrimSpace(v)
+			if len(v) > 0 && strings.Contains(agent, strings.ToLower(v)) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"strings"
+)
+
+// FormPart is a part of a multipart/form-data body
+type FormPart struct {
+	Name        string `json:"name"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int    `json:"size"`
+	Value       string `json:"value,omitempty"`
+	Truncated   bool   `json:"truncated,omitempty"`
+}
+
+// parseMultipartForm splits a multipart/form-data body into its parts. Captured bodies may
+// be cut short, so the parts read before an error are still returned.
+func parseMultipartForm(contentType string, body []byte) []FormPart {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != ContentTypeMultipartPOSTForm || len(params["boundary"]) == 0 {
+		return nil
+	}
+
+	var parts []FormPart
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := reader.NextPart()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && Verbose {
+				log.Printf("[WARN] multipart form (%s)", err.Error())
+			}
+			break
+		}
+
+		data, err := io.ReadAll(p)
+		part := FormPart{
+			Name:        p.FormName(),
+			Filename:    p.FileName(),
+			ContentType: p.Header.Get(ContentType),
+			Size:        len(data),
+			Truncated:   err != nil,
+		}
+		if len(part.Filename) == 0 {
+			// files only keep their size, text values at most -form-value-max bytes
+			if FormValueMax > 0 && len(data) > FormValueMax {
+				data, part.Truncated = data[:FormValueMax], true
+			}
+			part.Value = string(data)
+		}
+		parts = append(parts, part)
+
+		if err != nil {
+			break
+		}
+	}
+	return parts
+}
+
+func isMultipartForm(contentType string) bool {
+	return strings.HasPrefix(contentType, ContentTypeMultipartPOSTForm)
+}
+
+// parseURLEncodedForm decodes an application/x-www-form-urlencoded body, keeping the
+// well-formed pairs of a malformed or truncated body
+func parseURLEncodedForm(body []byte) map[string][]string {
+	values, err := url.ParseQuery(string(body))
+	if err != nil && Verbose {
+		log.Printf("[WARN] urlencoded form (%s)", err.Error())
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+func isURLEncodedForm(contentType string) bool {
+	return strings.HasPrefix(contentType, ContentTypeForm)
+}
+
+// hasFormField reports whether the request form has the field of a filter, "name" or
+// "name=value". A multipart file part only matches by name.
+func hasFormField(md *model, filter string) bool {
+	if matchParam(md.RequestFormValues, filter) {
+		return true
+	}
+	name, value, hasValue := strings.Cut(filter, "=")
+	for _, part := range md.RequestForm {
+		if part.Name == name && (!hasValue || (len(part.Filename) == 0 && part.Value == value)) {
+			return true
+		}
+	}
+	return false
+}
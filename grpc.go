@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+const (
+	ContentTypeGRPC = "application/grpc"
+	GrpcStatus      = "grpc-status"
+	GrpcMessage     = "grpc-message"
+	TagGrpc         = "grpc"
+
+	// grpcTrailerFlag marks a gRPC-Web frame that carries the trailers instead of a message
+	grpcTrailerFlag = 0x80
+)
+
+// GrpcInfo is the gRPC metadata of a record. Message payloads are not decoded since
+// protobuf cannot be read without its descriptor.
+type GrpcInfo struct {
+	Service              string `json:"service"`
+	Method               string `json:"method"`
+	Status               string `json:"status"`
+	Message              string `json:"message"`
+	RequestMessageSizes  []int  `json:"request_message_sizes"`
+	ResponseMessageSizes []int  `json:"response_message_sizes"`
+}
+
+func isGrpc(contentType string) bool {
+	return strings.HasPrefix(contentType, ContentTypeGRPC)
+}
+
+// parseGrpc extracts the gRPC metadata from the path, the length-prefixed frames of both
+// bodies and the grpc-status/grpc-message trailers.
+func parseGrpc(path string, requestBody []byte, responseHeaders map[string]string, responseBody []byte) *GrpcInfo {
+	info := &GrpcInfo{}
+
+	// path is /package.Service/Method
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	info.Service = parts[0]
+	if len(parts) == 2 {
+		info.Method = parts[1]
+	}
+
+	info.RequestMessageSizes, _ = grpcFrames(requestBody)
+
+	var trailers map[string]string
+	info.ResponseMessageSizes, trailers = grpcFrames(responseBody)
+
+	// trailers-only responses carry the status in the headers
+	for _, headers := range []map[string]string{responseHeaders, trailers} {
+		for k, v := range headers {
+			switch strings.ToLower(k) {
+			case GrpcStatus:
+				info.Status = v
+			case GrpcMessage:
+				info.Message = v
+			}
+		}
+	}
+
+	return info
+}
+
+// grpcFrames walks the length-prefixed messages of a gRPC body, returning the size of every
+// message and the trailers if the body ends with a gRPC-Web trailer frame.
+func grpcFrames(body []byte) ([]int, map[string]string) {
+	var sizes []int
+	var trailers map[string]string
+	for len(body) >= 5 {
+		flag := body[0]
+		size := int(binary.BigEndian.Uint32(body[1:5]))
+		body = body[5:]
+		if size > len(body) {
+			// the message was truncated by the capture
+			sizes = append(sizes, size)
+			break
+		}
+
+		if flag&grpcTrailerFlag != 0 {
+			trailers = map[string]string{}
+			for _, line := range strings.Split(string(body[:size]), "\r\n") {
+				kv := strings.SplitN(line, ":", 2)
+				if len(kv) == 2 {
+					trailers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+				}
+			}
+		} else {
+			sizes = append(sizes, size)
+		}
+		body = body[size:]
+	}
+	return sizes, trailers
+}
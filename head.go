@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+)
+
+// minHeadBytes is the smallest -head-bytes, below it few request lines and headers fit
+const minHeadBytes = 128
+
+// configureHeadBytes sets head_bytes in the capture settings of the eBPF programs, so that
+// the bodies are not even copied to userspace
+func configureHeadBytes(settings *ebpf.Map) error {
+	if HeadBytes == 0 {
+		return nil
+	}
+	if err := settings.Put(uint32(1), uint32(HeadBytes)); err != nil {
+		return fmt.Errorf("set head bytes: %w", err)
+	}
+	return nil
+}
+
+// headOnly cuts the payload of a packet to its first -head-bytes bytes, false if the
+// payload does not start a message and is only a body. The eBPF programs do the same
+// already, this applies the limit to the programs built without head_bytes.
+func headOnly(data []byte) ([]byte, bool) {
+	if HeadBytes == 0 {
+		return data, true
+	}
+	// the segments without a payload, e.g. a reset, have no body to cut
+	payload := tcpPayload(data)
+	if len(payload) == 0 {
+		return data, true
+	}
+	if !startsMessage(payload) {
+		return nil, false
+	}
+	if len(payload) > HeadBytes {
+		data = data[:len(data)-len(payload)+HeadBytes]
+	}
+	return data, true
+}
+
+// startsMessage reports whether payload starts with a request or status line, or with a
+// TLS handshake record
+func startsMessage(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	if payload[0] == tlsRecordHandshake || bytes.HasPrefix(payload, []byte(HTTP+"/1.")) {
+		return true
+	}
+	sp := bytes.IndexByte(payload, ' ')
+	return sp > 0 && sp <= len("OPTIONS") && isKnownMethod(string(payload[:sp]))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// StatEvictedHostCap counts the records deleted to keep a host under -per-host-cap
+const StatEvictedHostCap = "records_evicted_host_cap"
+
+var hostRecords = HostTable{mp: map[string]*list.List{}, owner: map[string]*list.Element{}}
+
+// HostRecords is the number of records stored for a host
+type HostRecords struct {
+	Host    string `json:"host"`
+	Records int    `json:"records"`
+}
+
+type hostKey struct {
+	host string
+	key  string
+}
+
+// HostTable save the keys of the stored records of every host, the oldest first, so that
+// -per-host-cap can evict the oldest records of a host. A key overwritten by a record of
+// another host moves to that host.
+type HostTable struct {
+	mp    map[string]*list.List
+	owner map[string]*list.Element
+	lock  sync.Mutex
+}
+
+// Load rebuilds the table from the stored records, in key order since records carry no time
+func (h *HostTable) Load(db *leveldb.DB) error {
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		md := model{}
+		if err := decodeRecord(iter.Value(), &md); err != nil {
+			continue
+		}
+		h.Add(md.host(), string(iter.Key()), 0)
+	}
+	return iter.Error()
+}
+
+// Add records that the record stored under key belongs to host and returns the keys of
+// the oldest records of the host above max, which the caller deletes. max 0 is unlimited.
+func (h *HostTable) Add(host, key string, max int) []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if elem, ok := h.owner[key]; ok {
+		h.remove(elem)
+	}
+
+	keys, ok := h.mp[host]
+	if !ok {
+		keys = list.New()
+		h.mp[host] = keys
+	}
+	h.owner[key] = keys.PushBack(hostKey{host: host, key: key})
+
+	var evicted []string
+	for max > 0 && keys.Len() > max {
+		elem := keys.Front()
+		evicted = append(evicted, elem.Value.(hostKey).key)
+		h.remove(elem)
+	}
+	return evicted
+}
+
+func (h *HostTable) remove(elem *list.Element) {
+	v := elem.Value.(hostKey)
+	keys := h.mp[v.host]
+	keys.Remove(elem)
+	delete(h.owner, v.key)
+	if keys.Len() == 0 {
+		delete(h.mp, v.host)
+	}
+}
+
+// countHosts counts the records of every host stored in db, the largest first, for when
+// no HostTable is kept without -per-host-cap
+func countHosts(db *leveldb.DB) ([]HostRecords, error) {
+	counts := map[string]int{}
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		md := model{}
+		if err := decodeRecord(iter.Value(), &md); err != nil {
+			continue
+		}
+		counts[md.host()]++
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	ret := make([]HostRecords, 0, len(counts))
+	for host, n := range counts {
+		ret = append(ret, HostRecords{Host: host, Records: n})
+	}
+	sortHostRecords(ret)
+	return ret, nil
+}
+
+func sortHostRecords(list []HostRecords) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Records != list[j].Records {
+			return list[i].Records > list[j].Records
+		}
+		return list[i].Host < list[j].Host
+	})
+}
+
+// List returns the record count of every host, the largest first
+func (h *HostTable) List() []HostRecords {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	ret := make([]HostRecords, 0, len(h.mp))
+	for host, keys := range h.mp {
+		ret = append(ret, HostRecords{Host: host, Records: keys.Len()})
+	}
+	sortHostRecords(ret)
+	return ret
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// InterfaceAll is the -n value attaching to every interface that is up, but the loopback
+const InterfaceAll = "all"
+
+// InterfaceEnv names the interfaces to capture when -n is not given, e.g. in a Helm chart
+const InterfaceEnv = "PRISM_INTERFACE"
+
+// interfaceFromEnv sets -n from $PRISM_INTERFACE unless -n was given on the command line
+// or in the config file
+func interfaceFromEnv() {
+	v := os.Getenv(InterfaceEnv)
+	if len(v) == 0 {
+		return
+	}
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == "n"
+	})
+	if f := flag.Lookup("n"); set || f.Value.String() != f.DefValue {
+		return
+	}
+	InterfaceName = v
+	log.Printf("[PRISM] interface %s from $%s", v, InterfaceEnv)
+}
+
+// isInterfaceGlob reports whether an interface name is a pattern such as veth*
+func isInterfaceGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// lookupLinks returns the interfaces of a comma-separated list of names and patterns. An
+// entry matching no interface is skipped with a warning, it is an error only if none does.
+func lookupLinks(names string) ([]netlink.Link, error) {
+	var ret []netlink.Link
+	seen := map[int]bool{}
+	var errs []string
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		links, err := lookupLink(name)
+		if err != nil {
+			log.Printf("[ERROR] %s, skipped", err.Error())
+			errs = append(errs, err.Error())
+			continue
+		}
+		for _, v := range links {
+			if !seen[v.Attrs().Index] {
+				seen[v.Attrs().Index] = true
+				ret = append(ret, v)
+			}
+		}
+	}
+	if len(ret) == 0 {
+		if len(errs) == 0 {
+			return nil, fmt.Errorf("no network iface in %q", names)
+		}
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return ret, nil
+}
+
+// lookupLink returns the interface of a name, or every interface matching a pattern
+func lookupLink(name string) ([]netlink.Link, error) {
+	if name == InterfaceAll {
+		return allLinks()
+	}
+	if !isInterfaceGlob(name) {
+		link, err := nlHandle.LinkByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("lookup network iface %s: %w", name, err)
+		}
+		return []netlink.Link{link}, nil
+	}
+
+	if _, err := path.Match(name, ""); err != nil {
+		return nil, fmt.Errorf("bad interface pattern %q: %w", name, err)
+	}
+	all, err := nlHandle.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("list links: %w", err)
+	}
+	var ret []netlink.Link
+	for _, v := range all {
+		if ok, _ := path.Match(name, v.Attrs().Name); ok {
+			ret = append(ret, v)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no network iface matches %s", name)
+	}
+	logLinks("matching "+name, ret)
+	return ret, nil
+}
+
+// allLinks returns every interface that is up, but the loopback, for -n all
+func allLinks() ([]netlink.Link, error) {
+	all, err := nlHandle.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("list links: %w", err)
+	}
+	var ret []netlink.Link
+	for _, v := range all {
+		flags := v.Attrs().Flags
+		if flags&net.FlagUp != 0 && flags&net.FlagLoopback == 0 {
+			ret = append(ret, v)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no network iface is up")
+	}
+	logLinks("up", ret)
+	return ret, nil
+}
+
+// logLinks sorts links by index and logs their names
+func logLinks(what string, links []netlink.Link) {
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Attrs().Index < links[j].Attrs().Index
+	})
+	var names []string
+	for _, v := range links {
+		names = append(names, v.Attrs().Name)
+	}
+	log.Printf("[PRISM] interfaces %s: %s", what, strings.Join(names, ", "))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// importDrainTimeout bounds the wait for the imported messages to be paired, requests
+// without a response are never paired
+const importDrainTimeout = 15 * time.Second
+
+// packetSource is implemented by both the pcap and the pcapng readers
+type packetSource interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// runImport implements "prism import capture.pcap [flags]": the packets of a pcap or
+// pcapng file go through the same parse, pairing and storage pipeline as live captures.
+func runImport(args []string) {
+	var file string
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		file, args = args[0], args[1:]
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		os.Exit(2)
+	}
+	if len(file) == 0 {
+		file = flag.Arg(0)
+	}
+	if len(file) == 0 {
+		log.Fatalf("usage: prism import capture.pcap [-p ./db]")
+	}
+	if Quiet {
+		log.SetOutput(quietWriter{os.Stderr})
+	}
+	if err := compileBodyRedactions(RedactBody); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	options, err := dbOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := leveldb.OpenFile(DataPath, options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := migrate(db); err != nil {
+		log.Fatalf("migrate db: %s", err)
+	}
+	if DedupeThreshold > 0 {
+		if bodies, err = OpenBodyStore(options); err != nil {
+			log.Fatalf("open body store: %s", err)
+		}
+	}
+	if BlobThreshold > 0 {
+		loadBlobRefs(db)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	saveChan := make(chan model, 100)
+	paired := make(chan struct{})
+	go func() {
+		MageHttp(ctx, saveChan)
+		close(paired)
+	}()
+	saved := make(chan struct{})
+	go func() {
+		SaveHttpData(db, &hostRecords, saveChan, nil)
+		close(saved)
+	}()
+
+	packets, err := importPcap(file)
+	if err != nil {
+		log.Fatalf("import %s: %s", file, err)
+	}
+
+	deadline := time.Now().Add(importDrainTimeout)
+	for connections.Pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(reorderWindow)
+	}
+	cancel()
+	<-paired
+	close(saveChan)
+	<-saved
+
+	log.Printf("[PRISM] imported %d packets from %s, %d connections left unpaired", packets, file, connections.Pending())
+}
+
+// importPcap parses every packet of the file and returns how many were read
+func importPcap(file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// pcapng files start with a section header block, pcap files with their magic number
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(4)
+	if err != nil {
+		return 0, err
+	}
+	var source packetSource
+	if string(magic) == "\x0a\x0d\x0d\x0a" {
+		ng, err := pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return 0, err
+		}
+		source = ng
+	} else {
+		pcap, err := pcapgo.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		source = pcap
+	}
+
+	var worker ParseWorker
+	defer worker.Close()
+	// the segments are parsed in sequence order, once classified as the live path does
+	streams := NewStreamTable(func(frame []byte) {
+		if !httpFlows.Accept(frame) {
+			drop(DropNonHTTP, 1, "len=%d", len(frame))
+			return
+		}
+		worker.Parse(frame)
+	})
+	n := 0
+	for {
+		data, _, err := source.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			streams.Flush()
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+		stats.Add(StatEvents, 1)
+
+		frame, err := ethernetFrame(source.LinkType(), data)
+		if err != nil {
+			return n, err
+		}
+		if isUDPEvent(frame) {
+			if DetectQUIC && isQUICInitial(frame) {
+				worker.Parse(frame)
+			}
+			continue
+		}
+		if !newConnections.Accept("import", frame) {
+			continue
+		}
+		streams.Add(frame)
+	}
+}
+
+// ethernetFrame turns a packet of the capture link type into the ethernet frame the
+// parser expects
+func ethernetFrame(linkType layers.LinkType, data []byte) ([]byte, error) {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		return data, nil
+	case layers.LinkTypeLinuxSLL:
+		// the protocol is the last field of the 16 bytes cooked header
+		if len(data) < 16 {
+			return nil, errors.New("short linux cooked packet")
+		}
+		frame := make([]byte, 14, 14+len(data)-16)
+		copy(frame[12:], data[14:16])
+		return append(frame, data[16:]...), nil
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		if len(data) == 0 {
+			return nil, errors.New("empty raw ip packet")
+		}
+		etherType := layers.EthernetTypeIPv4
+		if data[0]>>4 == 6 {
+			etherType = layers.EthernetTypeIPv6
+		}
+		frame := make([]byte, 14, 14+len(data))
+		frame[12], frame[13] = byte(etherType>>8), byte(etherType)
+		return append(frame, data...), nil
+	default:
+		return nil, fmt.Errorf("unsupported link type %s", linkType)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Inventory is a distinct host or path of the stored records, with the number of records
+type Inventory struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// InventoryRange is the time range of /hosts and /paths, each bound a duration before now
+// such as 1h, or an RFC 3339 time
+type InventoryRange struct {
+	Since string `form:"since"`
+	Until string `form:"until"`
+}
+
+// parseTimeBound returns the unix time of a bound, 0 if it is empty
+func parseTimeBound(v string, now time.Time) (int, error) {
+	if len(v) == 0 {
+		return 0, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return int(now.Add(-d).Unix()), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0, fmt.Errorf("%q is neither a duration nor an RFC 3339 time", v)
+	}
+	return int(t.Unix()), nil
+}
+
+// listHosts returns the distinct hosts of the stored records, the most recorded first
+func (h Handler) listHosts(ctx *gin.Context) {
+	h.inventory(ctx, func(md *model) string {
+		return md.host()
+	})
+}
+
+// listPaths returns the distinct paths of the stored records, of the host ?host= if given
+func (h Handler) listPaths(ctx *gin.Context) {
+	host := ctx.Query("host")
+	h.inventory(ctx, func(md *model) string {
+		if len(host) > 0 && !matchHost(md.host(), host) {
+			return ""
+		}
+		return md.RequestURL
+	})
+}
+
+// inventory scans the records saved between ?since= and ?until= and counts the distinct
+// non empty values of field. The records saved before their time was recorded only count
+// without a range.
+func (h Handler) inventory(ctx *gin.Context, field func(md *model) string) {
+	var rng InventoryRange
+	if err := ctx.ShouldBindQuery(&rng); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	now := time.Now()
+	since, err := parseTimeBound(rng.Since, now)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg": "since: " + err.Error(),
+		})
+		return
+	}
+	until, err := parseTimeBound(rng.Until, now)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg": "until: " + err.Error(),
+		})
+		return
+	}
+	ranged := since > 0 || until > 0
+
+	counts := map[string]int{}
+	iter := h.db.NewIterator(nil, nil)
+	for iter.Next() {
+		md := model{}
+		if err := decodeRecord(iter.Value(), &md); err != nil {
+			log.Printf("[ERROR] decode record error (%s)", err.Error())
+			continue
+		}
+		if ranged && (md.SavedAt == 0 || md.SavedAt < since || (until > 0 && md.SavedAt > until)) {
+			continue
+		}
+		if v := field(&md); len(v) > 0 {
+			counts[v]++
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+
+	ret := make([]Inventory, 0, len(counts))
+	for k, v := range counts {
+		ret = append(ret, Inventory{Value: k, Count: v})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Value < ret[j].Value
+	})
+	ctx.JSON(http.StatusOK, gin.H{
+		"data":  ret,
+		"total": len(ret),
+	})
+}
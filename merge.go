@@ -3,103 +3,537 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
 	"io"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-var ackToRequest = AckToRequest{mp: map[uint32]FlyHttp{}}
-var ackToResponse = AckToResponse{mp: map[uint32][]FlyHttp{}}
-var seqToAck = SeqToAck{seqToAck: map[uint32]uint32{}}
+var connections = ConnTable{mp: map[string]*Conn{}, lru: list.New(), resident: list.New(), tunnels: map[string]time.Time{}}
 
-// AckToRequest save the ACK and corresponding request in the HTTP request message
-type AckToRequest struct {
-	mp   map[uint32]FlyHttp
-	lock sync.RWMutex
+// reorderWindow is how long a response head is buffered before it is paired, so that
+// heads of pipelined responses arriving slightly out of order can still be sorted.
+const reorderWindow = 500 * time.Millisecond
+
+// unpairedTimeout is how long a message waits for its counterpart before it is stored unpaired
+const unpairedTimeout = time.Minute
+
+// Conn save the in-flight HTTP messages of a single TCP connection. Requests are kept in
+// client sequence order and responses in server sequence order, so that on a keep-alive
+// connection the Nth response is paired with the Nth request.
+type Conn struct {
+	key  string
+	elem *list.Element
+	// resident is the element of the connection in the list of the ones holding bodies
+	// in memory, nil once spilled
+	resident  *list.Element
+	last      time.Time
+	requests  []FlyHttp
+	responses []FlyHttp
+}
+
+// ConnTable save the in-flight connections, keyed by the client to server tuple. Connections
+// turned into tunnels by CONNECT carry opaque data and are only remembered to skip it.
+// With -max-connections the least recently active connections are evicted, their pairs
+// are returned by the next Pairs call. With -spill-dir the bodies of the connections that
+// least recently buffered one are moved to disk while more than -spill-high-water is
+// buffered, resident lists the connections that may hold bodies in memory, the most
+// recent first.
+type ConnTable struct {
+	mp       map[string]*Conn
+	lru      *list.List
+	resident *list.List
+	evicted  []Pair
+	tunnels  map[string]time.Time
+	hellos   []FlyHttp
+	buffered int
+	lock     sync.RWMutex
+}
+
+// Pair is a request with all the response segments that answer it
+type Pair struct {
+	Request   FlyHttp
+	Responses []FlyHttp
+}
+
+func connKey(clientIP, clientPort, serverIP, serverPort string) string {
+	return fmt.Sprintf("%s:%s->%s:%s", clientIP, clientPort, serverIP, serverPort)
+}
+
+func (c *ConnTable) conn(key string) *Conn {
+	conn, ok := c.mp[key]
+	if ok {
+		conn.last = time.Now()
+		c.lru.MoveToFront(conn.elem)
+		return conn
+	}
+
+	if MaxConnections > 0 && len(c.mp) >= MaxConnections {
+		c.evict()
+	}
+	conn = &Conn{key: key, last: time.Now()}
+	conn.elem = c.lru.PushFront(conn)
+	c.mp[key] = conn
+	stats.Set(StatTrackedConnections, int64(len(c.mp)))
+	return conn
 }
 
-func (a *AckToRequest) Get(key uint32) (FlyHttp, bool) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-	v, ok := a.mp[key]
-	return v, ok
+// evict flushes and forgets the least recently active connection
+func (c *ConnTable) evict() {
+	conn := c.lru.Back().Value.(*Conn)
+	c.evicted = append(c.evicted, conn.flush()...)
+	c.remove(conn.key)
+	stats.Add(StatEvictedConnections, 1)
+}
+
+// SweepIdle flushes and forgets the connections without traffic for longer than timeout,
+// e.g. a keep-alive connection whose FIN was missed. Their pairs, and the messages left
+// without a counterpart, are returned unpaired by the next Pairs call.
+func (c *ConnTable) SweepIdle(timeout time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for e := c.lru.Back(); e != nil; {
+		conn := e.Value.(*Conn)
+		e = e.Prev()
+		if time.Since(conn.last) <= timeout {
+			break
+		}
+
+		pairs := conn.flush()
+		c.evicted = append(c.evicted, pairs...)
+		for _, v := range conn.requests[len(pairs):] {
+			c.evicted = append(c.evicted, Pair{Request: v})
+			stats.Add(StatRequestOnly, 1)
+		}
+		c.remove(conn.key)
+	}
+	stats.Set(StatTrackedConnections, int64(len(c.mp)))
+}
+
+func (c *ConnTable) remove(key string) {
+	if conn, ok := c.mp[key]; ok {
+		c.lru.Remove(conn.elem)
+		if conn.resident != nil {
+			c.resident.Remove(conn.resident)
+		}
+		delete(c.mp, key)
+	}
+}
+
+// buffer adds the body of a message appended to conn to the bytes buffered in memory
+// and spills if it goes above the high-water mark
+func (c *ConnTable) buffer(conn *Conn, http FlyHttp) {
+	if len(http.Data.Body) == 0 {
+		return
+	}
+	c.buffered += len(http.Data.Body)
+	if conn.resident == nil {
+		conn.resident = c.resident.PushFront(conn)
+	} else {
+		c.resident.MoveToFront(conn.resident)
+	}
+	c.spill()
 }
 
-func (a *AckToRequest) List() map[uint32]FlyHttp {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-	tmp, _ := json.Marshal(a.mp)
-	ret := map[uint32]FlyHttp{}
-	json.Unmarshal(tmp, &ret)
+// flush pairs the messages of a connection in FIFO order without waiting for them to
+// be complete, requests left without a response are dropped
+func (conn *Conn) flush() []Pair {
+	sort.SliceStable(conn.requests, func(i, j int) bool {
+		return seqBefore(conn.requests[i].Seq, conn.requests[j].Seq)
+	})
+	sort.SliceStable(conn.responses, func(i, j int) bool {
+		return seqBefore(conn.responses[i].Seq, conn.responses[j].Seq)
+	})
+
+	var messages [][]FlyHttp
+	for _, v := range conn.responses {
+		if !v.Data.IsTruncation {
+			messages = append(messages, []FlyHttp{v})
+		} else if len(messages) > 0 {
+			messages[len(messages)-1] = append(messages[len(messages)-1], v)
+		}
+	}
+
+	var ret []Pair
+	for i := 0; i < len(conn.requests) && i < len(messages); i++ {
+		ret = append(ret, Pair{Request: conn.requests[i], Responses: messages[i]})
+		stats.Add(StatPaired, 1)
+	}
 	return ret
 }
 
-func (a *AckToRequest) Save(http FlyHttp) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-	a.mp[http.Ack] = http
+// spill hands buffered bodies to the spill writer, starting from the connection that
+// least recently buffered one, until the table is back under the high-water mark. A
+// connection whose bodies all left memory leaves the resident list, so that it is not
+// walked again.
+func (c *ConnTable) spill() {
+	highWater := SpillHighWater << 20
+	if spills == nil || c.buffered <= highWater {
+		return
+	}
+	for e := c.resident.Back(); e != nil && c.buffered > highWater; {
+		conn := e.Value.(*Conn)
+		e = e.Prev()
+		full := false
+		for _, messages := range [][]FlyHttp{conn.requests, conn.responses} {
+			for i := range messages {
+				c.buffered -= messages[i].spill()
+				full = full || len(messages[i].Data.Body) > 0
+			}
+		}
+		// the spill area is full, the bodies left stay in memory
+		if full {
+			break
+		}
+		c.resident.Remove(conn.resident)
+		conn.resident = nil
+	}
+	stats.Set(StatBufferedBytes, int64(c.buffered))
 }
 
-func (a *AckToRequest) Delete(key uint32) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-	delete(a.mp, key)
+func (c *ConnTable) SaveRequest(http FlyHttp) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := connKey(http.SrcIP, http.SrcPort, http.DstIP, http.DstPort)
+	if c.tunneled(key) {
+		return
+	}
+	conn := c.conn(key)
+	// a request head seen twice is a retransmission, not a pipelined request
+	for i := range conn.requests {
+		if conn.requests[i].Seq == http.Seq {
+			conn.requests[i].Retransmits++
+			conn.requests[i].RST = conn.requests[i].RST || http.RST
+			return
+		}
+	}
+	conn.requests = append(conn.requests, http)
+	c.buffer(conn, http)
 }
 
-// AckToResponse save the ACK and corresponding response in the HTTP response message
-type AckToResponse struct {
-	mp   map[uint32][]FlyHttp
-	lock sync.RWMutex
+func (c *ConnTable) SaveResponse(http FlyHttp) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := connKey(http.DstIP, http.DstPort, http.SrcIP, http.SrcPort)
+	// tunneled data has no headers, so it may be seen going either way
+	if c.tunneled(key) || c.tunneled(connKey(http.SrcIP, http.SrcPort, http.DstIP, http.DstPort)) {
+		return
+	}
+	conn := c.conn(key)
+	conn.responses = append(conn.responses, http)
+	c.buffer(conn, http)
 }
 
-func (a *AckToResponse) Get(key uint32) []FlyHttp {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-	return a.mp[key]
+// SaveReset flags reset the requests in flight on the connection of a reset segment,
+// which either side may send, so that their records are marked reset
+func (c *ConnTable) SaveReset(http FlyHttp) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, key := range []string{
+		connKey(http.SrcIP, http.SrcPort, http.DstIP, http.DstPort),
+		connKey(http.DstIP, http.DstPort, http.SrcIP, http.SrcPort),
+	} {
+		if conn, ok := c.mp[key]; ok {
+			for i := range conn.requests {
+				conn.requests[i].RST = true
+			}
+			return
+		}
+	}
 }
 
-func (a *AckToResponse) Save(http FlyHttp) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-	a.mp[http.Ack] = append(a.mp[http.Ack], http)
+// SaveClientHello keeps the ClientHello of a TLS connection, it is returned alone by the next Pairs call
+func (c *ConnTable) SaveClientHello(http FlyHttp) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.hellos = append(c.hellos, http)
 }
 
-func (a *AckToResponse) Delete(key uint32) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-	delete(a.mp, key)
+// Pending returns the number of connections holding messages not paired yet
+func (c *ConnTable) Pending() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.mp)
 }
 
-// SeqToAck save the association between HTTP request and HTTP response message, Seq and Ack
-type SeqToAck struct {
-	seqToAck map[uint32]uint32
-	lock     sync.RWMutex
+// ResponseMethods returns the methods of the requests of a connection the next response
+// heads answer, in sequence order: the requests after those of the buffered heads
+func (c *ConnTable) ResponseMethods(key string) []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	conn, ok := c.mp[key]
+	if !ok {
+		return nil
+	}
+
+	type request struct {
+		seq    uint32
+		method string
+	}
+	requests := make([]request, 0, len(conn.requests))
+	for _, v := range conn.requests {
+		requests = append(requests, request{seq: v.Seq, method: v.Data.RequestLine.Method})
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return seqBefore(requests[i].seq, requests[j].seq)
+	})
+	heads := 0
+	for _, v := range conn.responses {
+		if !v.Data.IsTruncation {
+			heads++
+		}
+	}
+
+	var ret []string
+	for i := heads; i < len(requests); i++ {
+		ret = append(ret, requests[i].method)
+	}
+	return ret
 }
 
-func (a *SeqToAck) Get(key uint32) (uint32, bool) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-	v, ok := a.seqToAck[key]
-	return v, ok
+// tunneled reports whether the connection is a CONNECT tunnel, keeping it alive if so
+func (c *ConnTable) tunneled(key string) bool {
+	if _, ok := c.tunnels[key]; !ok {
+		return false
+	}
+	c.tunnels[key] = time.Now()
+	return true
 }
 
-func (a *SeqToAck) Save(http FlyHttp) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-	a.seqToAck[http.Seq] = http.Ack
+// Pairs removes and returns every request whose response is complete. Responses are
+// split into messages at each response head and matched to requests by the correlation
+// header when one is configured, then in FIFO order.
+func (c *ConnTable) Pairs() []Pair {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ret := c.evicted
+	c.evicted = nil
+	for _, v := range c.hellos {
+		ret = append(ret, Pair{Request: v})
+	}
+	c.hellos = nil
+	for key, conn := range c.mp {
+		sort.SliceStable(conn.requests, func(i, j int) bool {
+			return seqBefore(conn.requests[i].Seq, conn.requests[j].Seq)
+		})
+		sort.SliceStable(conn.responses, func(i, j int) bool {
+			return seqBefore(conn.responses[i].Seq, conn.responses[j].Seq)
+		})
+
+		// split responses at every head; segments before the first head wait for it
+		var orphans []FlyHttp
+		var messages [][]FlyHttp
+		for _, v := range conn.responses {
+			if !v.Data.IsTruncation {
+				messages = append(messages, []FlyHttp{v})
+			} else if len(messages) == 0 {
+				orphans = append(orphans, v)
+			} else {
+				messages[len(messages)-1] = append(messages[len(messages)-1], v)
+			}
+		}
+
+		ready := func(request FlyHttp, message []FlyHttp) bool {
+			if time.Since(message[0].CreateTime) < reorderWindow {
+				return false
+			}
+			// with -head-bytes the rest of the body never comes
+			return HeadBytes > 0 || bodyless(request, message[0]) || checkoutBodyLen(message)
+		}
+		requestDone := make([]bool, len(conn.requests))
+		messageDone := make([]bool, len(messages))
+
+		if len(CorrelationHeader) > 0 {
+			for m, message := range messages {
+				id := headerValue(message[0].Data.Headers, CorrelationHeader)
+				if len(id) == 0 {
+					continue
+				}
+				for r, request := range conn.requests {
+					if !requestDone[r] && headerValue(request.Data.Headers, CorrelationHeader) == id {
+						if !ready(request, message) {
+							break
+						}
+						ret = append(ret, Pair{Request: request, Responses: message})
+						requestDone[r], messageDone[m] = true, true
+						stats.Add(StatPaired, 1)
+						break
+					}
+				}
+			}
+		}
+
+		r := 0
+		for m, message := range messages {
+			if messageDone[m] {
+				continue
+			}
+			for r < len(conn.requests) && requestDone[r] {
+				r++
+			}
+			if r >= len(conn.requests) {
+				break
+			}
+
+			// an accepted CONNECT has no body, what follows its head is tunneled data
+			if isTunnel(conn.requests[r], message[0]) {
+				if time.Since(message[0].CreateTime) < reorderWindow {
+					break
+				}
+				ret = append(ret, Pair{Request: conn.requests[r], Responses: message[:1]})
+				requestDone[r], messageDone[m] = true, true
+				stats.Add(StatPaired, 1)
+				c.tunnels[key] = time.Now()
+				break
+			}
+
+			if !ready(conn.requests[r], message) {
+				break
+			}
+			ret = append(ret, Pair{Request: conn.requests[r], Responses: message})
+			requestDone[r], messageDone[m] = true, true
+			stats.Add(StatPaired, 1)
+		}
+
+		// messages left without a counterpart for longer than unpairedTimeout are stored unpaired
+		for i, v := range conn.requests {
+			if !requestDone[i] && time.Since(v.CreateTime) > unpairedTimeout {
+				ret = append(ret, Pair{Request: v})
+				requestDone[i] = true
+				stats.Add(StatRequestOnly, 1)
+			}
+		}
+		for i, message := range messages {
+			if !messageDone[i] && time.Since(message[0].CreateTime) > unpairedTimeout {
+				ret = append(ret, Pair{Request: missingRequest(message[0]), Responses: message})
+				messageDone[i] = true
+				stats.Add(StatResponseOnly, 1)
+			}
+		}
+
+		var requests []FlyHttp
+		for i, v := range conn.requests {
+			if !requestDone[i] {
+				requests = append(requests, v)
+			}
+		}
+		var responses []FlyHttp
+		if len(messages) == 0 || !messageDone[0] {
+			responses = orphans
+		}
+		for i, v := range messages {
+			if !messageDone[i] {
+				responses = append(responses, v...)
+			}
+		}
+		conn.requests, conn.responses = requests, responses
+		if _, ok := c.tunnels[key]; ok {
+			// everything still buffered after the CONNECT belongs to the tunnel
+			conn.requests, conn.responses = nil, nil
+		}
+
+		if len(conn.requests) == 0 && len(conn.responses) == 0 {
+			c.remove(key)
+		}
+	}
+	stats.Set(StatTrackedConnections, int64(len(c.mp)))
+
+	for key, last := range c.tunnels {
+		if time.Since(last) > connRetention {
+			delete(c.tunnels, key)
+		}
+	}
+
+	c.buffered = 0
+	for _, conn := range c.mp {
+		for _, v := range conn.requests {
+			c.buffered += len(v.Data.Body)
+		}
+		for _, v := range conn.responses {
+			c.buffered += len(v.Data.Body)
+		}
+	}
+	stats.Set(StatBufferedBytes, int64(c.buffered))
+
+	if spills != nil {
+		for i := range ret {
+			ret[i].Request.unspill()
+			for j := range ret[i].Responses {
+				ret[i].Responses[j].unspill()
+			}
+		}
+		spills.Prune(connRetention)
+	}
+
+	return ret
+}
+
+// missingRequest stands for the request a response answers when it was not captured,
+// with the addresses of the response reversed
+func missingRequest(response FlyHttp) FlyHttp {
+	return FlyHttp{
+		SrcMAC:     response.DstMAC,
+		DstMAC:     response.SrcMAC,
+		Family:     response.Family,
+		SrcIP:      response.DstIP,
+		DstIP:      response.SrcIP,
+		SrcPort:    response.DstPort,
+		DstPort:    response.SrcPort,
+		CreateTime: response.CreateTime,
+	}
+}
+
+// TunnelInfo is the metadata of a CONNECT request; the tunneled data is not captured
+type TunnelInfo struct {
+	Target      string `json:"target"`
+	Established bool   `json:"established"`
+}
+
+// isTunnel reports whether the response accepted a CONNECT request
+func isTunnel(request FlyHttp, response FlyHttp) bool {
+	status := response.Data.ResponseLine.Status
+	return request.Data.RequestLine.Method == MethodConnect && status >= 200 && status < 300
+}
+
+// bodyless reports whether the response has no body whatever its Content-Length says:
+// the answer to a HEAD request, or a 204 or 304
+func bodyless(request FlyHttp, response FlyHttp) bool {
+	status := response.Data.ResponseLine.Status
+	return request.Data.RequestLine.Method == http.MethodHead || status == http.StatusNoContent ||
+		status == http.StatusNotModified
+}
+
+// headerValue looks a header up case-insensitively
+func headerValue(headers map[string]string, name string) string {
+	if v, ok := headers[name]; ok {
+		return v
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
 }
 
-func (a *SeqToAck) Delete(key uint32) {
-	a.lock.Lock()
-	defer a.lock.Unlock()
-	delete(a.seqToAck, key)
+// seqBefore compares two TCP sequence numbers, taking wraparound into account
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
 }
 
 func MageHttp(ctx context.Context, save chan<- model) {
@@ -107,37 +541,41 @@ func MageHttp(ctx context.Context, save chan<- model) {
 	for {
 		select {
 		case <-ctx.Done():
-			break
+			return
 		case <-ticker:
-			request := ackToRequest.List()
-			for k, v := range request {
-				ack, ok := seqToAck.Get(k)
-				if !ok {
-					continue
+			connections.SweepIdle(ConnIdleTimeout)
+			for _, pair := range connections.Pairs() {
+				if Verbose {
+					log.Printf("[PRISM] request seq:%+v,ack:%+v,url:%+v,value:%+v\n", pair.Request.Seq,
+						pair.Request.Ack, pair.Request.Data.RequestLine, pair.Request.Data.Headers)
+					for _, v := range pair.Responses {
+						log.Printf("[PRISM] \tresponse seq:%+v,ack:%+v,value:%+v\n", v.Seq, v.Ack, v.Data.Headers)
+					}
 				}
 
-				flyResponses := ackToResponse.Get(ack)
-				if flyResponses == nil {
+				if pair.Request.Data.Type == IsClientHello {
+					save <- tlsRecord(pair.Request)
 					continue
 				}
 
-				if Verbose {
-					log.Printf("[PRISM] request ack:%+v\n", k)
-					log.Printf("[PRISM] \tseq:%+v,ack:%+v,url:%+v,value:%+v\n", v.Seq, v.Ack, v.Data.RequestLine, v.Data.Headers)
-					log.Printf("[PRISM] response ack:%+v\n", ack)
-					for _, v := range flyResponses {
-						log.Printf("[PRISM] \tseq:%+v,ack:%+v,value:%+v\n", v.Seq, v.Ack, v.Data.Headers)
-					}
+				// dropped after pairing so that the response does not shift onto the next request
+				configLock.RLock()
+				denied := deniedUserAgent(pair.Request.Data.Headers)
+				var md model
+				if !denied {
+					md = mergeOperation(pair.Request, pair.Responses)
 				}
-
-				if !checkoutBodyLen(flyResponses) {
+				configLock.RUnlock()
+				if denied {
+					drop(DropDeniedUserAgent, 1, "%s user_agent=%q", flowFields(pair.Request),
+						headerValue(pair.Request.Data.Headers, "User-Agent"))
 					continue
 				}
-				save <- mergeOperation(v, flyResponses)
-				ackToRequest.Delete(k)
-				seqToAck.Delete(k)
-				ackToResponse.Delete(ack)
+
+				save <- md
 			}
+			connStats.Sweep(ConnIdleTimeout)
+			connStats.Prune()
 		}
 	}
 }
@@ -146,12 +584,12 @@ func checkoutBodyLen(flyHttps []FlyHttp) bool {
 	var maxBody int = 0
 	var currentBody int = -1
 	var lastTime = flyHttps[len(flyHttps)-1].CreateTime
-	var lastBody = flyHttps[len(flyHttps)-1].Data.Body
+	var lastBody = flyHttps[len(flyHttps)-1].body()
 	for i, _ := range flyHttps {
 		if maxBody == 0 {
 			maxBody, _ = strconv.Atoi(flyHttps[i].Data.Headers[ContentLength])
 		}
-		currentBody += len(flyHttps[i].Data.Body)
+		currentBody += flyHttps[i].bodyLen()
 	}
 
 	if Verbose {
@@ -174,7 +612,7 @@ func checkoutBodyLen(flyHttps []FlyHttp) bool {
 }
 
 func mergeOperation(request FlyHttp, responses []FlyHttp) model {
-	fmt.Println()
+	log.Println()
 
 	log.Printf("[PRISM] HTTP request: %+v", request.Data.RequestLine)
 	if Debug {
@@ -182,32 +620,87 @@ func mergeOperation(request FlyHttp, responses []FlyHttp) model {
 		log.Printf("[PRISM] HTTP request param: %+v", string(request.Data.Body))
 	}
 
-	urls, err := url.Parse(request.Data.RequestLine.URN)
-	if err != nil {
-		log.Printf("[ERROR] url parse (%+v)", err.Error())
-		return model{}
+	// CONNECT targets are in authority form, host:port, which is not a parsable URL
+	urls := &url.URL{Host: request.Data.RequestLine.URN}
+	if request.Data.RequestLine.Method != MethodConnect {
+		var err error
+		urls, err = url.Parse(request.Data.RequestLine.URN)
+		if err != nil {
+			log.Printf("[ERROR] url parse (%+v)", err.Error())
+			return model{}
+		}
+	}
+	// ParseQuery keeps every well-formed pair even when some are malformed
+	Parma, err := url.ParseQuery(urls.RawQuery)
+	if err != nil && Verbose {
+		log.Printf("[WARN] query string %q (%s)", urls.RawQuery, err.Error())
 	}
-	Parma, _ := url.ParseQuery(urls.RawQuery)
 
 	var md = model{
-		RequestSrcMAC:      request.SrcMAC,
-		RequestDstMAC:      request.DstMAC,
-		RequestSrcIP:       request.SrcIP,
-		RequestDstIP:       request.DstIP,
-		RequestSrcPort:     request.SrcPort,
-		RequestDstPort:     request.DstPort,
-		RequestMethod:      request.Data.RequestLine.Method,
-		RequestURL:         urls.Path,
-		RequestParma:       Parma,
-		RequestHeaders:     request.Data.Headers,
-		RequestContentType: request.Data.Headers[ContentType],
-		RequestBody:        string(request.Data.Body),
+		SchemaVersion:        schemaVersion,
+		IPFamily:             request.Family,
+		RequestSrcMAC:        request.SrcMAC,
+		RequestDstMAC:        request.DstMAC,
+		RequestSrcIP:         request.SrcIP,
+		RequestDstIP:         request.DstIP,
+		RequestSrcPort:       request.SrcPort,
+		RequestDstPort:       request.DstPort,
+		RequestMethod:        request.Data.RequestLine.Method,
+		RequestVersion:       request.Data.RequestLine.Version,
+		RequestURL:           urls.Path,
+		RequestHost:          requestHost(request.Data.Headers, urls, request.DstIP, request.DstPort),
+		RequestParma:         Parma,
+		RequestHeaders:       request.Data.Headers,
+		RequestContentType:   request.Data.Headers[ContentType],
+		RequestBody:          string(request.Data.Body),
+		RequestCookies:       requestCookies(request.Data.Headers),
+		Retransmissions:      request.Retransmits,
+		Reset:                request.RST,
+		RequestSize:          request.Size,
+		RequestBodySize:      len(request.Data.Body),
+		RequestBodyTruncated: bodyTruncated(request.Data.Headers, len(request.Data.Body)),
+		RawPackets:           rawPackets(request, responses),
+		Interface:            request.Iface,
+	}
+	if HeaderFormat == HeaderFormatRaw {
+		md.RequestHeadersRaw = request.Data.RawHeaders
 	}
 
 	if _, ok := request.Data.Headers[XForwardedFor]; ok {
 		md.Tag = []string{XForwardedFor}
 	}
 
+	if isMultipartForm(md.RequestContentType) {
+		md.RequestForm = parseMultipartForm(md.RequestContentType, request.Data.Body)
+	}
+	if isURLEncodedForm(md.RequestContentType) {
+		md.RequestFormValues = parseURLEncodedForm(request.Data.Body)
+	}
+
+	// the head of the response, zero for a request whose response was not captured
+	var head FlyHttp
+	md.CapturedAt = int(request.CreateTime.Unix())
+	switch {
+	case len(responses) == 0:
+		md.Unpaired = UnpairedRequest
+	case len(request.Data.RequestLine.Method) == 0:
+		md.Unpaired = UnpairedResponse
+		head = responses[0]
+		md.CapturedAt = int(head.CreateTime.Unix())
+	default:
+		head = responses[0]
+		md.Latency = int(head.CreateTime.Sub(request.CreateTime) / time.Microsecond)
+	}
+	if len(md.Interface) == 0 {
+		md.Interface = head.Iface
+	}
+
+	if !isKnownMethod(md.RequestMethod) && md.Unpaired != UnpairedResponse {
+		rateLog.Printf("[WARN] anomalous HTTP method %q", md.RequestMethod)
+		stats.Add(StatAnomalousMethods, 1)
+		md.Tag = append(md.Tag, TagUnknownMethod)
+	}
+
 	var isExit = map[uint32]struct{}{}
 	var responseLine ResponseLine
 	var responseHeaders map[string]string
@@ -215,10 +708,13 @@ func mergeOperation(request FlyHttp, responses []FlyHttp) model {
 	// Create a buffer to store the merged response body
 	var mergedBody bytes.Buffer
 	for i, v := range responses {
+		md.Reset = md.Reset || v.RST
 		if _, ok := isExit[v.Seq]; ok {
+			md.Retransmissions++
 			continue
 		}
 		isExit[v.Seq] = struct{}{}
+		md.ResponseSize += v.Size
 
 		if len(responses[i].Data.Headers) > 0 {
 			responseLine = responses[i].Data.ResponseLine
@@ -267,7 +763,29 @@ func mergeOperation(request FlyHttp, responses []FlyHttp) model {
 	}
 
 	md.ResponseStatus = responseLine.Status
+	if md.RequestMethod == MethodConnect {
+		md.Tunnel = &TunnelInfo{
+			Target:      request.Data.RequestLine.URN,
+			Established: isTunnel(request, head),
+		}
+		md.Tag = append(md.Tag, TagTunnel)
+	}
+	if md.Retransmissions > 0 {
+		md.Tag = append(md.Tag, TagRetransmission)
+	}
+	if md.Reset {
+		md.Tag = append(md.Tag, TagReset)
+	}
+	md.ResponseBodySize = mergedBody.Len()
+	md.ResponseBodyTruncated = !bodyless(request, head) && bodyTruncated(responseHeaders, mergedBody.Len())
+	md.ResponseCookies = responseCookies(responseHeaders)
 	md.ResponseContextType = responseHeaders[ContentType]
+	md.ResponseContentEncoding = responseHeaders[ContentEncoding]
+
+	if isGrpc(md.RequestContentType) || isGrpc(md.ResponseContextType) {
+		md.Grpc = parseGrpc(urls.Path, request.Data.Body, responseHeaders, mergedBody.Bytes())
+		md.Tag = append(md.Tag, TagGrpc)
+	}
 
 	if Debug {
 		log.Printf("[PRISM] HTTP response: %+v", responseLine.String())
@@ -278,7 +796,7 @@ func mergeOperation(request FlyHttp, responses []FlyHttp) model {
 		if encoding, ok := responseHeaders[ContentEncoding]; ok && encoding == "gzip" {
 			ret, err := parseGzip(mergedBody.Bytes())
 			if err != nil && err.Error() != "unexpected EOF" {
-				log.Printf("[PRISM] gzip decode (%s)", err.Error())
+				log.Printf("[WARN] gzip decode (%s)", err.Error())
 			}
 			if contentType, ok := responseHeaders[ContentType]; ok &&
 				(strings.Contains(contentType, ContentTypePlain) || strings.Contains(contentType, ContentTypeJSON)) {
@@ -287,6 +805,22 @@ func mergeOperation(request FlyHttp, responses []FlyHttp) model {
 				md.ResponseBody = string(ret)
 			}
 
+		} else if ok && encoding == "zstd" {
+			ret, err := parseZstd(mergedBody.Bytes())
+			if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Printf("[WARN] zstd decode (%s)", err.Error())
+			}
+			// keep the raw body when nothing could be decoded
+			if len(ret) == 0 {
+				ret = mergedBody.Bytes()
+			}
+			if contentType, ok := responseHeaders[ContentType]; ok &&
+				(strings.Contains(contentType, ContentTypePlain) || strings.Contains(contentType, ContentTypeJSON)) {
+
+				log.Printf("[PRISM] HTTP zstd response body: %+v", string(ret))
+				md.ResponseBody = string(ret)
+			}
+
 		} else {
 			if contentType, ok := responseHeaders[ContentType]; ok &&
 				(strings.Contains(contentType, ContentTypePlain) || strings.Contains(contentType, ContentTypeJSON)) {
@@ -297,9 +831,56 @@ func mergeOperation(request FlyHttp, responses []FlyHttp) model {
 		}
 	}
 
+	limitBodies(&md)
+	if keyPerExchange() {
+		seqs := []uint32{request.Seq}
+		for _, v := range responses {
+			seqs = append(seqs, v.Seq)
+		}
+		md.Id = contentID(&md, seqs)
+	}
 	return md
 }
 
+const (
+	// UnpairedRequest marks a record whose request got no response
+	UnpairedRequest = "request"
+	// UnpairedResponse marks a record whose response answers no captured request
+	UnpairedResponse = "response"
+)
+
+// bodyTruncated reports whether fewer body bytes were captured than the Content-Length announced
+func bodyTruncated(headers map[string]string, size int) bool {
+	length, err := strconv.Atoi(headerValue(headers, ContentLength))
+	return err == nil && size < length
+}
+
+// limitBodies keeps the bodies of each direction as set by -request-body, -response-body
+// and their size caps; the sizes still report the captured bodies
+func limitBodies(md *model) {
+	if !CaptureRequestBody {
+		md.RequestBody = ""
+		md.RequestFormValues = nil
+		for i := range md.RequestForm {
+			md.RequestForm[i].Value = ""
+		}
+	} else if RequestBodyMax > 0 && len(md.RequestBody) > RequestBodyMax {
+		md.RequestBody = md.RequestBody[:RequestBodyMax]
+		md.RequestBodyTruncated = true
+	}
+
+	body, ok := md.ResponseBody.(string)
+	if !ok {
+		return
+	}
+	if !CaptureResponseBody {
+		md.ResponseBody = nil
+	} else if ResponseBodyMax > 0 && len(body) > ResponseBodyMax {
+		md.ResponseBody = body[:ResponseBodyMax]
+		md.ResponseBodyTruncated = true
+	}
+}
+
 func parseGzip(in []byte) ([]byte, error) {
 	// remove messy heads
 	for i := 0; i < len(in) && len(in) > 3; i++ {
@@ -318,6 +899,20 @@ func parseGzip(in []byte) ([]byte, error) {
 	return io.ReadAll(reader)
 }
 
+// maxDecodedBody caps the size of a decompressed body
+const maxDecodedBody = 64 << 20
+
+// parseZstd decodes a zstd body, returning what could be decoded of a truncated capture
+func parseZstd(in []byte) ([]byte, error) {
+	reader, err := zstd.NewReader(bytes.NewReader(in), zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderMaxMemory(maxDecodedBody))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(io.LimitReader(reader, maxDecodedBody))
+}
+
 func printFormatHeader(headers map[string]string) {
 	log.Printf("[PRISM] HTTP headers:\n")
 	for k, v := range headers {
@@ -326,28 +921,197 @@ func printFormatHeader(headers map[string]string) {
 }
 
 type model struct {
-	Id                 string              `json:"id"`
-	RequestSrcMAC      string              `json:"request_src_mac"`
-	RequestDstMAC      string              `json:"request_dst_mac"`
-	RequestSrcIP       string              `json:"request_src_ip"`
-	RequestDstIP       string              `json:"request_dst_ip"`
-	RequestSrcPort     string              `json:"request_src_port"`
-	RequestDstPort     string              `json:"request_dst_port"`
-	RequestMethod      string              `json:"request_method"`
-	RequestURL         string              `json:"request_url"`
-	RequestParma       map[string][]string `json:"request_parma"`
-	RequestHeaders     map[string]string   `json:"request_headers"`
-	RequestBody        string              `json:"request_body"`
-	RequestContentType string              `json:"request_content_type"`
-
-	ResponseStatus      int         `json:"response_status"`
-	ResponseContextType string      `json:"response_context_type"`
-	ResponseBody        interface{} `json:"response_body"`
-
-	Tag []string `json:"tag"`
+	Id                   string              `json:"id" bin:"1"`
+	SchemaVersion        int                 `json:"schema_version" bin:"2"`
+	IPFamily             string              `json:"ip_family" bin:"39"`
+	Unpaired             string              `json:"unpaired,omitempty" bin:"40"`
+	Latency              int                 `json:"latency_us,omitempty" bin:"43"`
+	RequestSrcMAC        string              `json:"request_src_mac" bin:"3"`
+	RequestDstMAC        string              `json:"request_dst_mac" bin:"4"`
+	RequestSrcIP         string              `json:"request_src_ip" bin:"5"`
+	RequestDstIP         string              `json:"request_dst_ip" bin:"6"`
+	RequestSrcPort       string              `json:"request_src_port" bin:"7"`
+	RequestDstPort       string              `json:"request_dst_port" bin:"8"`
+	RequestMethod        string              `json:"request_method" bin:"9"`
+	RequestVersion       string              `json:"request_version,omitempty" bin:"50"`
+	RequestURL           string              `json:"request_url" bin:"10"`
+	RequestHost          string              `json:"request_host" bin:"11"`
+	RequestParma         map[string][]string `json:"request_parma" bin:"12"`
+	RequestHeaders       map[string]string   `json:"request_headers" bin:"13"`
+	RequestHeadersRaw    string              `json:"request_headers_raw,omitempty" bin:"51"`
+	RequestBody          string              `json:"request_body" bin:"14"`
+	RequestContentType   string              `json:"request_content_type" bin:"15"`
+	RequestCookies       map[string]string   `json:"request_cookies,omitempty" bin:"16"`
+	RequestSize          int                 `json:"request_size" bin:"17"`
+	RequestBodySize      int                 `json:"request_body_size" bin:"18"`
+	RequestForm          []FormPart          `json:"request_form,omitempty" bin:"29"`
+	RequestFormValues    map[string][]string `json:"request_form_values,omitempty" bin:"32"`
+	RequestBodyTruncated bool                `json:"request_body_truncated,omitempty" bin:"35"`
+	RequestBodyBlob      string              `json:"request_body_blob,omitempty" bin:"36"`
+	RequestBodyRef       string              `json:"request_body_ref,omitempty" bin:"41"`
+
+	ResponseStatus          int         `json:"response_status" bin:"19"`
+	ResponseContextType     string      `json:"response_context_type" bin:"20"`
+	ResponseContentEncoding string      `json:"response_content_encoding,omitempty" bin:"44"`
+	ResponseBody            interface{} `json:"response_body" bin:"21"`
+	ResponseCookies         []Cookie    `json:"response_cookies,omitempty" bin:"22"`
+	ResponseSize            int         `json:"response_size" bin:"23"`
+	ResponseBodySize        int         `json:"response_body_size" bin:"24"`
+	BodyDropped             bool        `json:"body_dropped,omitempty" bin:"33"`
+	ResponseBodyTruncated   bool        `json:"response_body_truncated,omitempty" bin:"37"`
+	ResponseBodyBlob        string      `json:"response_body_blob,omitempty" bin:"38"`
+	ResponseBodyRef         string      `json:"response_body_ref,omitempty" bin:"42"`
+
+	Grpc *GrpcInfo `json:"grpc,omitempty" bin:"25"`
+
+	Tunnel *TunnelInfo `json:"tunnel,omitempty" bin:"34"`
+
+	TLS *TLSInfo `json:"tls,omitempty" bin:"48"`
+
+	// Interface is the interface the record was captured on, with -n name=path
+	Interface string `json:"interface,omitempty" bin:"49"`
+
+	Session string `json:"session,omitempty" bin:"26"`
+
+	// SavedAt is the unix time the record was saved, 0 for the records saved before
+	SavedAt int `json:"saved_at,omitempty" bin:"52"`
+	// CapturedAt is the unix time the request, or the response without one, was captured,
+	// 0 for the records saved before
+	CapturedAt int `json:"captured_at,omitempty" bin:"53"`
+	// ReplayID names the record of a replay, replay-<unix nanoseconds>, so that it is
+	// stored beside the record it replayed instead of overwriting it
+	ReplayID string `json:"replay_id,omitempty" bin:"54"`
+
+	Retransmissions int  `json:"retransmissions" bin:"30"`
+	Reset           bool `json:"reset" bin:"31"`
+
+	RawPackets []RawPacket `json:"raw_packets,omitempty" bin:"27"`
+
+	Tag []string `json:"tag" bin:"28"`
+
+	// the bodies compressed with -compress-bodies, restored when the record is decoded
+	BodyCodec              string `json:"body_codec,omitempty" bin:"45"`
+	RequestBodyCompressed  []byte `json:"request_body_compressed,omitempty" bin:"46"`
+	ResponseBodyCompressed []byte `json:"response_body_compressed,omitempty" bin:"47"`
 }
 
+// bodySize is the size of the response body, of the request body for a request stored
+// without a response
+func (m *model) bodySize() int {
+	if m.Unpaired == UnpairedRequest {
+		return m.RequestBodySize
+	}
+	return m.ResponseBodySize
+}
+
+// parseRawHeaders fills the headers of a record stored with -header-format raw
+func (m *model) parseRawHeaders() {
+	if m.RequestHeaders == nil && len(m.RequestHeadersRaw) > 0 {
+		m.RequestHeaders = parseHeaders(m.RequestHeadersRaw)
+	}
+}
+
+// contentID derives the key of a record from its addresses, the TCP sequence numbers of
+// its messages and their content, so that importing the same capture again overwrites its
+// records instead of adding them. The sequence numbers stand for the capture time, which
+// changes on every import, and tell apart the identical exchanges of a connection.
+func contentID(m *model, seqs []uint32) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%d\x00%v\x00", m.RequestSrcIP, m.RequestSrcPort,
+		m.RequestDstIP, m.RequestDstPort, m.RequestMethod, m.RequestURL, m.ResponseStatus, seqs)
+	io.WriteString(h, m.RequestBody)
+	h.Write([]byte{0})
+	switch body := m.ResponseBody.(type) {
+	case string:
+		io.WriteString(h, body)
+	case nil:
+	default:
+		json.NewEncoder(h).Encode(body)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// path returns the request path without its query
+func (m *model) path() string {
+	path, _, _ := strings.Cut(m.RequestURL, "?")
+	return path
+}
+
+// host returns the request host, deriving it for records stored before it was recorded
+func (m *model) host() string {
+	if len(m.RequestHost) > 0 {
+		return m.RequestHost
+	}
+	return requestHost(m.RequestHeaders, &url.URL{}, m.RequestDstIP, m.RequestDstPort)
+}
+
+// requestHost is the authority of an absolute request target, which RFC 9112 has win over
+// the Host header, else the Host header, else the destination address for HTTP/1.0
+// requests that carry neither.
+func requestHost(headers map[string]string, target *url.URL, dstIP, dstPort string) string {
+	if len(target.Host) > 0 {
+		return target.Host
+	}
+	if host := headerValue(headers, "Host"); len(host) > 0 {
+		return host
+	}
+	if port := portNumber(dstPort); len(port) > 0 && port != "80" {
+		return net.JoinHostPort(dstIP, port)
+	}
+	return dstIP
+}
+
+const (
+	KeyMethodPath = "method-path"
+	// KeyTime, KeyHostTime and KeyPathTime keep every exchange under its capture time,
+	// alone or after its host or its path, see Search.keyRange
+	KeyTime     = "time"
+	KeyHostTime = "host-time"
+	KeyPathTime = "path-time"
+	// KeyContent keeps every exchange under a key derived from its content, see contentID
+	KeyContent = "content"
+)
+
+// keyPerExchange reports whether -key-layout keeps every exchange rather than the last
+// one of every endpoint, the records then being built with their contentID
+func keyPerExchange() bool {
+	return KeyLayout != KeyMethodPath
+}
+
+// keyTime is the capture time in a key, fixed width so that keys sort by time
+func keyTime(t int) string {
+	return fmt.Sprintf("%010d", t)
+}
+
+// key names the record in the db. With content the key was set from the captured
+// messages when the record was built; the time layouts put the capture time, after the
+// host or the path if any, before it.
 func (m *model) key() string {
-	m.Id = fmt.Sprintf("%s-%s", m.RequestMethod, m.RequestURL)
+	if keyPerExchange() && len(m.Id) == 0 {
+		m.Id = contentID(m, nil)
+	}
+	captured := m.CapturedAt
+	if captured == 0 {
+		captured = int(time.Now().Unix())
+	}
+
+	switch KeyLayout {
+	case KeyContent:
+	case KeyTime:
+		m.Id = fmt.Sprintf("%s %s", keyTime(captured), m.Id)
+	case KeyHostTime:
+		m.Id = fmt.Sprintf("%s %s %s", strings.ToLower(m.host()), keyTime(captured), m.Id)
+	case KeyPathTime:
+		m.Id = fmt.Sprintf("%s %s %s", m.path(), keyTime(captured), m.Id)
+	default:
+		m.Id = fmt.Sprintf("%s-%s", m.RequestMethod, m.RequestURL)
+		// TLS records have no path, keep one per server name
+		if m.TLS != nil {
+			m.Id = fmt.Sprintf("%s-%s", m.RequestMethod, m.host())
+		}
+		if len(m.ReplayID) > 0 {
+			m.Id = fmt.Sprintf("%s %s", m.Id, m.ReplayID)
+		}
+	}
 	return m.Id
 }
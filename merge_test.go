@@ -0,0 +1,230 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testSegment is a segment of the test connection, sent by the client or the server
+type testSegment struct {
+	fromClient bool
+	seq        uint32
+	payload    string
+}
+
+// testMessages parses a segment into its messages, captured long enough ago that they are
+// past reorderWindow and the wait of checkoutBodyLen for the rest of a body
+func testMessages(t *testing.T, s testSegment) []FlyHttp {
+	t.Helper()
+	ret := parseEvent(sslFrame(40000, s.fromClient, s.seq, 0, []byte(s.payload)))
+	if len(ret) == 0 {
+		t.Fatalf("segment %q parsed into no message", s.payload)
+	}
+	for i := range ret {
+		ret[i].CreateTime = time.Now().Add(-11 * time.Second)
+	}
+	return ret
+}
+
+// resetConnections empties the connections the parsed messages are saved to, the
+// responses are split knowing the methods of their requests there
+func resetConnections() {
+	connections.lock.Lock()
+	defer connections.lock.Unlock()
+	connections.mp, connections.lru, connections.resident, connections.tunnels = map[string]*Conn{}, list.New(), list.New(), map[string]time.Time{}
+	connections.evicted, connections.hellos, connections.buffered = nil, nil, 0
+}
+
+// pairSummaries saves the segments to empty connections and returns their pairs as
+// "METHOD url status body", in request sequence order
+func pairSummaries(t *testing.T, segments []testSegment) []string {
+	t.Helper()
+	resetConnections()
+	t.Cleanup(resetConnections)
+	for _, s := range segments {
+		for _, v := range testMessages(t, s) {
+			saveMessage(v)
+		}
+	}
+
+	pairs := connections.Pairs()
+	sort.Slice(pairs, func(i, j int) bool {
+		return seqBefore(pairs[i].Request.Seq, pairs[j].Request.Seq)
+	})
+	var ret []string
+	for _, v := range pairs {
+		summary := fmt.Sprintf("%s %s", v.Request.Data.RequestLine.Method, v.Request.Data.RequestLine.URN)
+		if len(v.Responses) > 0 {
+			var body []byte
+			for _, r := range v.Responses {
+				body = append(body, r.Data.Body...)
+			}
+			summary += fmt.Sprintf(" %d %s", v.Responses[0].Data.ResponseLine.Status, body)
+		}
+		ret = append(ret, summary)
+	}
+	return ret
+}
+
+func TestConnTablePairs(t *testing.T) {
+	const (
+		getA = "GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"
+		getB = "GET /b HTTP/1.1\r\nHost: example.com\r\n\r\n"
+		okA  = "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na"
+		okB  = "HTTP/1.1 404 Not Found\r\nContent-Length: 1\r\n\r\nb"
+	)
+	tests := []struct {
+		name     string
+		segments []testSegment
+		want     []string
+	}{
+		{
+			name: "in order",
+			segments: []testSegment{
+				{true, 1, getA},
+				{false, 1, okA},
+				{true, 1 + uint32(len(getA)), getB},
+				{false, 1 + uint32(len(okA)), okB},
+			},
+			want: []string{"GET /a 200 a", "GET /b 404 b"},
+		},
+		{
+			name: "pipelined",
+			segments: []testSegment{
+				{true, 1, getA + getB},
+				{false, 1, okA + okB},
+			},
+			want: []string{"GET /a 200 a", "GET /b 404 b"},
+		},
+		{
+			name: "reordered",
+			segments: []testSegment{
+				{true, 1 + uint32(len(getA)), getB},
+				{true, 1, getA},
+				{false, 1 + uint32(len(okA)), okB},
+				{false, 1, okA},
+			},
+			want: []string{"GET /a 200 a", "GET /b 404 b"},
+		},
+		{
+			name: "response body in a later segment",
+			segments: []testSegment{
+				{true, 1, getA},
+				{false, 1 + uint32(len(okA)) - 1, "a"},
+				{false, 1, okA[:len(okA)-1]},
+			},
+			want: []string{"GET /a 200 a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pairSummaries(t, tt.segments)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("pairs are %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		host    string
+		dstPort string
+		want    string
+	}{
+		{name: "Host header", target: "/a", host: "example.com", dstPort: "80", want: "example.com"},
+		{name: "Host header with a port", target: "/a", host: "example.com:8080", dstPort: "8080", want: "example.com:8080"},
+		{name: "absolute-form without Host", target: "http://example.com/a", dstPort: "80", want: "example.com"},
+		{name: "absolute-form with a port", target: "http://example.com:8080/a", dstPort: "3128", want: "example.com:8080"},
+		{name: "absolute-form wins over Host", target: "http://example.com/a", host: "proxy.local", dstPort: "3128", want: "example.com"},
+		{name: "neither on port 80", target: "/a", dstPort: "80", want: "10.0.0.1"},
+		{name: "neither on another port", target: "/a", dstPort: "8080", want: "10.0.0.1:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := url.Parse(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			headers := map[string]string{}
+			if len(tt.host) > 0 {
+				headers["Host"] = tt.host
+			}
+			if got := requestHost(headers, target, "10.0.0.1", tt.dstPort); got != tt.want {
+				t.Fatalf("host is %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeadPairedWithoutBody(t *testing.T) {
+	resetConnections()
+	t.Cleanup(resetConnections)
+	for _, s := range []testSegment{
+		{true, 1, "HEAD /a HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+		{false, 1, "HTTP/1.1 200 OK\r\nContent-Length: 1024\r\n\r\n"},
+	} {
+		for _, v := range parseEvent(sslFrame(40000, s.fromClient, s.seq, 0, []byte(s.payload))) {
+			// past reorderWindow, well before the wait for a missing body gives up
+			v.CreateTime = time.Now().Add(-2 * reorderWindow)
+			saveMessage(v)
+		}
+	}
+
+	pairs := connections.Pairs()
+	if len(pairs) != 1 || len(pairs[0].Responses) != 1 {
+		t.Fatalf("got %d pairs, want the HEAD paired with its response", len(pairs))
+	}
+	if method := pairs[0].Request.Data.RequestLine.Method; method != "HEAD" {
+		t.Fatalf("request is a %s, want HEAD", method)
+	}
+	if md := mergeOperation(pairs[0].Request, pairs[0].Responses); md.Unpaired != "" || md.ResponseStatus != 200 {
+		t.Fatalf("record is unpaired %q with status %d, want a paired 200", md.Unpaired, md.ResponseStatus)
+	}
+}
+
+func TestStreamTableReordersSegments(t *testing.T) {
+	const (
+		get = "GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"
+		ok  = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello"
+	)
+	resetConnections()
+	t.Cleanup(resetConnections)
+	var frames [][]byte
+	streams := NewStreamTable(func(frame []byte) {
+		frames = append(frames, frame)
+	})
+	// both messages are split, the second half of each captured first, and the head of
+	// the request retransmitted
+	for _, s := range []testSegment{
+		{true, 11, get[10:]},
+		{true, 1, get[:10]},
+		{true, 1, get[:10]},
+		{false, 31, ok[30:]},
+		{false, 1, ok[:30]},
+	} {
+		streams.Add(sslFrame(40000, s.fromClient, s.seq, 0, []byte(s.payload)))
+	}
+	streams.Flush()
+
+	for _, frame := range frames {
+		for _, v := range parseEvent(frame) {
+			v.CreateTime = time.Now().Add(-11 * time.Second)
+			saveMessage(v)
+		}
+	}
+	pairs := connections.Pairs()
+	if len(pairs) != 1 || len(pairs[0].Responses) != 1 {
+		t.Fatalf("got %d pairs from %d segments, want the GET paired with its response", len(pairs), len(frames))
+	}
+	md := mergeOperation(pairs[0].Request, pairs[0].Responses)
+	if md.RequestURL != "/a" || md.ResponseStatus != 200 || md.ResponseBody != "hello" {
+		t.Fatalf("record is %s %s %d %v, want GET /a 200 hello", md.RequestMethod, md.RequestURL, md.ResponseStatus, md.ResponseBody)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// metaFile is written in the data path next to the records, so that it travels with the db
+const metaFile = "meta.json"
+
+// metaRecorder is a Sink counting the records of this run for the meta file
+var metaRecorder *MetaRecorder
+
+// DBMeta describes every run of prism that wrote to a db, the oldest first
+type DBMeta struct {
+	Runs []RunMeta `json:"runs"`
+}
+
+// RunMeta is what a db needs to be understood once handed off: where and how it was captured
+type RunMeta struct {
+	Version    string            `json:"version"`
+	Host       string            `json:"host"`
+	Kernel     string            `json:"kernel"`
+	Capture    string            `json:"capture"`
+	Interfaces []string          `json:"interfaces"`
+	Flags      map[string]string `json:"flags"`
+	Start      time.Time         `json:"start"`
+	Stop       *time.Time        `json:"stop,omitempty"`
+	Records    int64             `json:"records"`
+}
+
+// MetaRecorder save the meta of the current run, it is written when the run starts and stops
+type MetaRecorder struct {
+	path string
+	meta DBMeta
+	lock sync.Mutex
+}
+
+// readMeta reads the meta file of a data path, a db without one has no runs
+func readMeta(dataPath string) (DBMeta, error) {
+	var meta DBMeta
+	byt, err := os.ReadFile(filepath.Join(dataPath, metaFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	return meta, json.Unmarshal(byt, &meta)
+}
+
+// changedFlags returns the flags that differ from their default, a summary of the config
+func changedFlags() map[string]string {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	ret := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() != f.DefValue {
+			ret[f.Name] = flagString(f)
+		}
+	})
+	return ret
+}
+
+// StartMeta appends run to the meta file of the data path
+func StartMeta(dataPath string, run RunMeta) (*MetaRecorder, error) {
+	if err := os.MkdirAll(dataPath, 0755); err != nil {
+		return nil, err
+	}
+	meta, err := readMeta(dataPath)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", metaFile, err)
+	}
+	meta.Runs = append(meta.Runs, run)
+
+	m := &MetaRecorder{path: filepath.Join(dataPath, metaFile), meta: meta}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m, m.write()
+}
+
+func (m *MetaRecorder) Publish(md model) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.meta.Runs[len(m.meta.Runs)-1].Records++
+}
+
+// Stop records the end of the run
+func (m *MetaRecorder) Stop() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	m.meta.Runs[len(m.meta.Runs)-1].Stop = &now
+	return m.write()
+}
+
+// Get returns a copy of the meta, with the live count of the current run
+func (m *MetaRecorder) Get() DBMeta {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return DBMeta{Runs: append([]RunMeta(nil), m.meta.Runs...)}
+}
+
+// write replaces the meta file, through a temporary file so that it is never half written
+func (m *MetaRecorder) write() error {
+	byt, err := json.MarshalIndent(m.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, byt, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+// runDump implements "prism dump [-p ./db] [-meta]": the records of a db as JSON lines, or
+// with -meta the runs that captured them
+func runDump(args []string) {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	dataPath := fs.String("p", "./db", "the db to dump")
+	metaOnly := fs.Bool("meta", false, "print the meta of the runs that captured the db instead of its records")
+	fs.Parse(args)
+
+	if *metaOnly {
+		meta, err := readMeta(*dataPath)
+		if err != nil {
+			log.Fatalf("read %s: %s", metaFile, err)
+		}
+		byt, _ := json.MarshalIndent(meta, "", "  ")
+		fmt.Println(string(byt))
+		return
+	}
+
+	db, err := leveldb.OpenFile(*dataPath, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		log.Fatalf("open db: %s", err)
+	}
+	defer db.Close()
+
+	encoder := json.NewEncoder(os.Stdout)
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		md := model{}
+		if err := decodeRecord(iter.Value(), &md); err != nil {
+			log.Printf("[ERROR] json unmarshal error (%s)", err.Error())
+			continue
+		}
+		encoder.Encode(md)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		log.Fatalf("iter error: %s", err)
+	}
+}
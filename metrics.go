@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// otherHost is the host label of the hosts above -latency-max-hosts
+	otherHost = "other"
+	// otherPath is the path label of the paths above -metrics-max-paths
+	otherPath = "other"
+	// otherMethod is the method label of the methods no RFC registers, which are mostly
+	// payloads misread as a request line and would each add a series
+	otherMethod = "OTHER"
+	// pathID replaces the segments of a path that look like identifiers
+	pathID = "{id}"
+)
+
+var (
+	// latencyMetrics is an observer of the latency of every captured record for /metrics
+	latencyMetrics *LatencyHistogram
+	// requestMetrics is an observer counting the captured requests for /metrics
+	requestMetrics *RequestCounter
+)
+
+// labelEscaper escapes a label value as the Prometheus text format does: only the
+// backslash, the double quote and the line feed
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue returns the quoted label value of v
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+// idSegment matches the path segments collapsed by -metrics-path-template: numbers,
+// UUIDs and long hexadecimal strings such as hashes or object ids
+var idSegment = regexp.MustCompile(`^([0-9]+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,})$`)
+
+// pathTemplate collapses the identifiers of a path, /users/42/orders becomes /users/{id}/orders
+func pathTemplate(path string) string {
+	segments := strings.Split(path, "/")
+	for i, v := range segments {
+		if idSegment.MatchString(v) {
+			segments[i] = pathID
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// exponentialBuckets returns count upper bounds starting at start, each factor times the previous
+func exponentialBuckets(start, factor float64, count int) []float64 {
+	ret := make([]float64, count)
+	for i := range ret {
+		ret[i] = start
+		start *= factor
+	}
+	return ret
+}
+
+// parseBuckets reads a comma separated list of increasing upper bounds in seconds
+func parseBuckets(s string) ([]float64, error) {
+	var ret []float64
+	for _, v := range strings.Split(s, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || bound <= 0 {
+			return nil, fmt.Errorf("latency bucket %q is not a positive number of seconds", v)
+		}
+		if len(ret) > 0 && bound <= ret[len(ret)-1] {
+			return nil, fmt.Errorf("latency buckets must be increasing, %q is not", v)
+		}
+		ret = append(ret, bound)
+	}
+	return ret, nil
+}
+
+type latencySeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type latencyLabels struct {
+	class string
+	host  string
+}
+
+// LatencyHistogram save the response latency of the paired records as a Prometheus histogram,
+// labeled by status class and, for the first maxHosts hosts, by host
+type LatencyHistogram struct {
+	buckets  []float64
+	maxHosts int
+	hosts    map[string]struct{}
+	series   map[latencyLabels]*latencySeries
+	lock     sync.RWMutex
+}
+
+// NewLatencyHistogram returns a histogram with the given upper bounds. maxHosts caps the
+// number of host labels, the others are reported as "other"; 0 drops the host label.
+func NewLatencyHistogram(buckets []float64, maxHosts int) *LatencyHistogram {
+	return &LatencyHistogram{
+		buckets:  buckets,
+		maxHosts: maxHosts,
+		hosts:    map[string]struct{}{},
+		series:   map[latencyLabels]*latencySeries{},
+	}
+}
+
+func (l *LatencyHistogram) Publish(md model) {
+	if len(md.Unpaired) > 0 || md.ResponseStatus == 0 {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	labels := latencyLabels{class: fmt.Sprintf("%dxx", md.ResponseStatus/100)}
+	if l.maxHosts > 0 {
+		labels.host = md.host()
+		if _, ok := l.hosts[labels.host]; !ok {
+			if len(l.hosts) < l.maxHosts {
+				l.hosts[labels.host] = struct{}{}
+			} else {
+				labels.host = otherHost
+			}
+		}
+	}
+
+	series, ok := l.series[labels]
+	if !ok {
+		series = &latencySeries{counts: make([]uint64, len(l.buckets))}
+		l.series[labels] = series
+	}
+
+	seconds := float64(md.Latency) / 1e6
+	for i, bound := range l.buckets {
+		if seconds <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += seconds
+}
+
+// WriteTo writes the histogram in the Prometheus text exposition format
+func (l *LatencyHistogram) WriteTo(w io.Writer) (int64, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	keys := make([]latencyLabels, 0, len(l.series))
+	for k := range l.series {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].class != keys[j].class {
+			return keys[i].class < keys[j].class
+		}
+		return keys[i].host < keys[j].host
+	})
+
+	var b strings.Builder
+	b.WriteString("# HELP prism_response_latency_seconds Time between a captured request and its response.\n")
+	b.WriteString("# TYPE prism_response_latency_seconds histogram\n")
+	for _, k := range keys {
+		series := l.series[k]
+		labels := "status_class=" + labelValue(k.class)
+		if l.maxHosts > 0 {
+			labels += ",host=" + labelValue(k.host)
+		}
+		for i, bound := range l.buckets {
+			fmt.Fprintf(&b, "prism_response_latency_seconds_bucket{%s,le=\"%s\"} %d\n",
+				labels, strconv.FormatFloat(bound, 'g', -1, 64), series.counts[i])
+		}
+		fmt.Fprintf(&b, "prism_response_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, series.count)
+		fmt.Fprintf(&b, "prism_response_latency_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(series.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "prism_response_latency_seconds_count{%s} %d\n", labels, series.count)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+type requestLabels struct {
+	method string
+	status string
+	path   string
+}
+
+// RequestCounter counts the captured requests as a Prometheus counter labeled by method,
+// status and path. The methods no RFC registers are reported as "OTHER", the paths are
+// templated unless disabled, and the first maxPaths distinct ones are labeled, the others
+// are reported as "other".
+type RequestCounter struct {
+	template bool
+	maxPaths int
+	paths    map[string]struct{}
+	counts   map[requestLabels]uint64
+	lock     sync.RWMutex
+}
+
+func NewRequestCounter(template bool, maxPaths int) *RequestCounter {
+	return &RequestCounter{
+		template: template,
+		maxPaths: maxPaths,
+		paths:    map[string]struct{}{},
+		counts:   map[requestLabels]uint64{},
+	}
+}
+
+func (r *RequestCounter) Publish(md model) {
+	if md.Unpaired == UnpairedResponse || md.RequestMethod == MethodTLS {
+		return
+	}
+
+	method := md.RequestMethod
+	if !isKnownMethod(method) && method != MethodQUIC {
+		method = otherMethod
+	}
+	path := md.RequestURL
+	if r.template {
+		path = pathTemplate(path)
+	}
+	status := "none"
+	if md.ResponseStatus > 0 {
+		status = strconv.Itoa(md.ResponseStatus)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.paths[path]; !ok {
+		if len(r.paths) < r.maxPaths {
+			r.paths[path] = struct{}{}
+		} else {
+			path = otherPath
+		}
+	}
+	r.counts[requestLabels{method: method, status: status, path: path}]++
+}
+
+// WriteTo writes the counter in the Prometheus text exposition format
+func (r *RequestCounter) WriteTo(w io.Writer) (int64, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	keys := make([]requestLabels, 0, len(r.counts))
+	for k := range r.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].path != keys[j].path {
+			return keys[i].path < keys[j].path
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+
+	var b strings.Builder
+	b.WriteString("# HELP prism_requests_total Captured requests, by method, response status and path.\n")
+	b.WriteString("# TYPE prism_requests_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "prism_requests_total{method=%s,status=%s,path=%s} %d\n",
+			labelValue(k.method), labelValue(k.status), labelValue(k.path), r.counts[k])
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
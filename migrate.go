@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// schemaVersion is the version of the model layout written by this build. Bump it and
+// append a migration whenever a stored field changes meaning.
+const schemaVersion = 1
+
+// migrations[i] upgrades a record from schema version i to i+1
+var migrations = []func(md *model){
+	// version 0 records predate versioning and share the version 1 layout
+	func(md *model) {},
+}
+
+// migrate upgrades every stored record older than schemaVersion in place
+func migrate(db *leveldb.DB) error {
+	var migrated, newer int
+	batch := new(leveldb.Batch)
+
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		md := model{}
+		if err := decodeRecord(iter.Value(), &md); err != nil {
+			log.Printf("[ERROR] json unmarshal error (%s)", err.Error())
+			continue
+		}
+
+		if md.SchemaVersion > schemaVersion {
+			newer++
+			continue
+		}
+		if md.SchemaVersion == schemaVersion {
+			continue
+		}
+
+		for md.SchemaVersion < schemaVersion {
+			migrations[md.SchemaVersion](&md)
+			md.SchemaVersion++
+		}
+
+		byt, err := encodeRecord(md)
+		if err != nil {
+			log.Printf("[ERROR] marshal error (%s)", err.Error())
+			continue
+		}
+		// the iterator owns the key slice, copy it before batching
+		batch.Put(append([]byte(nil), iter.Key()...), byt)
+		migrated++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	if newer > 0 {
+		log.Printf("[WARN] %d records were written by a newer prism (schema > %d) and are left untouched",
+			newer, schemaVersion)
+	}
+	if migrated == 0 {
+		return nil
+	}
+
+	if err := db.Write(batch, nil); err != nil {
+		return err
+	}
+	log.Printf("[PRISM] migrated %d records to schema version %d", migrated, schemaVersion)
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	ModeRingBuf = "ringbuf"
+	ModePerf    = "perf"
+)
+
+// ringBufSize is max_entries of the http_events ring buffer in tc_http.c
+const ringBufSize = 256 * 1024
+
+// perfBufferSize is the size of the perf buffer of each cpu
+func perfBufferSize() int {
+	return os.Getpagesize() * 1024 * 4
+}
+
+// captureMode is how the events of the eBPF programs reach prism, chosen from the kernel version
+var captureMode CaptureMode
+
+// CaptureMode describes the event path in use, BufferSize is the size of the ring buffer,
+// or of the perf buffer of each cpu
+type CaptureMode struct {
+	Mode       string `json:"mode"`
+	Kernel     string `json:"kernel"`
+	BufferSize int    `json:"buffer_size"`
+}
+
+func (c CaptureMode) String() string {
+	if c.Mode == ModePerf {
+		return fmt.Sprintf("perf (kernel %s, %d KiB per cpu buffer)", c.Kernel, c.BufferSize>>10)
+	}
+	return fmt.Sprintf("%s (kernel %s, %d KiB buffer)", c.Mode, c.Kernel, c.BufferSize>>10)
+}
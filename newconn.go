@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// the FIN, SYN and RST bits of the flags byte of a tcp header
+const (
+	tcpFlagFin = 0x01
+	tcpFlagSyn = 0x02
+	tcpFlagRst = 0x04
+)
+
+var newConnections = NewConnTable{mp: map[uint32]newConn{}}
+
+// newConn is when a new connection last carried data, and the port of the side that sent
+// the first FIN, 0 until then
+type newConn struct {
+	last    time.Time
+	finPort uint16
+}
+
+// NewConnTable save the connections whose SYN was seen after prism attached, keyed by
+// flowHash. A connection is forgotten once both sides sent a FIN or either sent a RST,
+// and after connRetention without data, an idle keep-alive connection being kept.
+type NewConnTable struct {
+	mp     map[uint32]newConn
+	pruned time.Time
+	lock   sync.Mutex
+}
+
+// configureReportSyn sets report_syn in the capture settings of the eBPF programs, so that
+// the SYN and FIN segments reach userspace with -new-connections-only
+func configureReportSyn(settings *ebpf.Map) error {
+	if !NewConnectionsOnly {
+		return nil
+	}
+	if err := settings.Put(uint32(2), uint32(1)); err != nil {
+		return fmt.Errorf("set report syn: %w", err)
+	}
+	return nil
+}
+
+// Accept records the connection of a SYN and returns false, the SYN carrying no data.
+// Other events are accepted if their connection was opened after prism attached, the
+// others are dropped as preexisting_connection, and a FIN without data is not. Everything
+// is accepted without -new-connections-only.
+func (n *NewConnTable) Accept(name string, data []byte) bool {
+	if !NewConnectionsOnly {
+		return true
+	}
+	_, _, tcpOff, ok := packetOffsets(data)
+	if !ok {
+		return true
+	}
+	h := flowHash(data)
+	now := time.Now()
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if now.Sub(n.pruned) > connRetention {
+		for k, v := range n.mp {
+			if now.Sub(v.last) > connRetention {
+				delete(n.mp, k)
+			}
+		}
+		n.pruned = now
+	}
+
+	flags := data[tcpOff+13]
+	if flags&tcpFlagSyn != 0 {
+		n.mp[h] = newConn{last: now}
+		return false
+	}
+	conn, ok := n.mp[h]
+	if !ok {
+		if flags&tcpFlagFin == 0 {
+			drop(DropPreexisting, 1, "iface=%s len=%d", name, len(data))
+		}
+		return false
+	}
+
+	port := binary.BigEndian.Uint16(data[tcpOff:])
+	switch {
+	case flags&tcpFlagRst != 0, flags&tcpFlagFin != 0 && conn.finPort != 0 && conn.finPort != port:
+		delete(n.mp, h)
+	case flags&tcpFlagFin != 0:
+		conn.finPort = port
+		fallthrough
+	default:
+		conn.last = now
+		n.mp[h] = conn
+	}
+	// a bare FIN only closes the connection
+	return flags&tcpFlagFin == 0 || len(data) > tcpOff+int(data[tcpOff+12]>>4)*4
+}
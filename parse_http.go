@@ -2,19 +2,25 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"io"
 	"log"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	IsRequest                    = 1
 	IsResponse                   = 2
+	IsClientHello                = 3
 	ContentType                  = "Content-Type"
 	ContentLength                = "Content-Length"
 	ContentEncoding              = "Content-Encoding"
@@ -27,26 +33,234 @@ const (
 	XForwardedFor    = "X-Forwarded-For"
 	TransferEncoding = "Transfer-Encoding"
 	HTTP             = "HTTP"
+	TagUnknownMethod = "unknown-method"
+
+	TagRetransmission = "retransmission"
+	TagReset          = "reset"
+	TagTunnel         = "tunnel"
+
+	MethodConnect = "CONNECT"
+
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+	FamilyAll  = "all"
 )
 
-func ParseHttp(data []byte) error {
+// RunParseWorkers parses the captured packets on n workers. Packets are sharded by
+// connection so that both directions of a connection keep their capture order. It returns
+// once queueTask is closed and every packet queued before is parsed.
+func RunParseWorkers(queueTask <-chan []byte, n int) {
+	var wg sync.WaitGroup
+	workers := make([]chan []byte, n)
+	for i := range workers {
+		workers[i] = make(chan []byte, cap(queueTask))
+		wg.Add(1)
+		go func(tasks <-chan []byte) {
+			defer wg.Done()
+			pinThread()
+			var worker ParseWorker
+			defer worker.Close()
+			for task := range tasks {
+				worker.Parse(task)
+			}
+		}(workers[i])
+	}
+
+	for task := range queueTask {
+		workers[flowHash(task)%uint32(n)] <- task
+	}
+	for i := range workers {
+		close(workers[i])
+	}
+	wg.Wait()
+}
+
+// packetOffsets returns the offsets of the source address and of the tcp header of an
+// ethernet/ip/tcp packet, and the address length
+func packetOffsets(data []byte) (addr, addrLen, tcpOff int, ok bool) {
+	const ethLen = 14
+	if len(data) < ethLen+20 {
+		return 0, 0, 0, false
+	}
+
+	switch binary.BigEndian.Uint16(data[12:]) {
+	case uint16(layers.EthernetTypeIPv4):
+		addr, addrLen, tcpOff = ethLen+12, 4, ethLen+int(data[ethLen]&0x0f)*4
+	case uint16(layers.EthernetTypeIPv6):
+		addr, addrLen, tcpOff = ethLen+8, 16, ethLen+40
+	default:
+		return 0, 0, 0, false
+	}
+	return addr, addrLen, tcpOff, len(data) >= tcpOff+20
+}
+
+// flowHash hashes the address and port pairs of an ethernet/ip/tcp packet. It is
+// symmetric, a request and its response hash to the same value.
+func flowHash(data []byte) uint32 {
+	addr, addrLen, tcpOff, ok := packetOffsets(data)
+	if !ok {
+		return 0
+	}
+
+	var h uint32
+	for i := addr; i < addr+2*addrLen; i += 4 {
+		h ^= binary.BigEndian.Uint32(data[i:])
+	}
+	h ^= uint32(binary.BigEndian.Uint16(data[tcpOff:])) ^ uint32(binary.BigEndian.Uint16(data[tcpOff+2:]))
+	// mix the bits so that the modulo spreads connections evenly
+	h ^= h >> 16
+	h *= 0x45d9f3b
+	h ^= h >> 16
+	return h
+}
+
+// maxStuckParsers bounds the parser goroutines given up on by -parse-timeout that are
+// still running, past it the events are dropped until one of them finishes
+const maxStuckParsers = 16
+
+var stuckParsers atomic.Int32
+
+// ParseWorker parses the events of a worker and saves their messages. With -parse-timeout
+// the parses run on a goroutine of its own, the parser, so that a payload driving the
+// parser into a slow path cannot stall the worker: the worker gives up on it after the
+// timeout and the next events go to a new parser, while the stuck one runs to the end of
+// its parse, drops its messages and exits.
+type ParseWorker struct {
+	parser *parser
+}
+
+type parser struct {
+	tasks chan []byte
+	done  chan []FlyHttp
+	stuck atomic.Bool
+}
+
+func (p *parser) run() {
+	for data := range p.tasks {
+		p.done <- parseEvent(data)
+	}
+	if p.stuck.Load() {
+		stuckParsers.Add(-1)
+	}
+}
+
+// Parse parses an event and saves its messages, pipelined messages sent in one segment
+// are saved one by one, in order
+func (w *ParseWorker) Parse(data []byte) {
+	for _, flyHttp := range w.parse(data) {
+		saveMessage(flyHttp)
+	}
+}
+
+func (w *ParseWorker) parse(data []byte) []FlyHttp {
+	if ParseTimeout <= 0 {
+		return parseEvent(data)
+	}
+	if w.parser == nil {
+		if stuckParsers.Load() >= maxStuckParsers {
+			drop(DropParseTimeout, 1, "len=%d stuck_parsers=%d", len(data), maxStuckParsers)
+			return nil
+		}
+		w.parser = &parser{tasks: make(chan []byte), done: make(chan []FlyHttp, 1)}
+		go w.parser.run()
+	}
+
+	w.parser.tasks <- data
+	timer := time.NewTimer(ParseTimeout)
+	defer timer.Stop()
+	select {
+	case ret := <-w.parser.done:
+		return ret
+	case <-timer.C:
+		if Debug {
+			log.Printf("[WARN] parse of a %d bytes event timed out after %s", len(data), ParseTimeout)
+		}
+		drop(DropParseTimeout, 1, "len=%d timeout=%s", len(data), ParseTimeout)
+		stuckParsers.Add(1)
+		w.parser.stuck.Store(true)
+		close(w.parser.tasks)
+		w.parser = nil
+		return nil
+	}
+}
+
+// Close stops the parser of the worker
+func (w *ParseWorker) Close() {
+	if w.parser != nil {
+		close(w.parser.tasks)
+		w.parser = nil
+	}
+}
+
+// parseEvent parses an event into the messages it carries, none if it is dropped
+func parseEvent(data []byte) []FlyHttp {
 	if Debug && Verbose {
 		log.Printf("[PRISM] data:%+v", data)
 	}
 
-	flyHttp, err := extractFlyHttp(data)
+	var flyHttp FlyHttp
+	var err error
+	if isUDPEvent(data) {
+		var ok bool
+		// nothing to save until the ClientHello of the connection is complete
+		if flyHttp, ok, err = extractQUIC(data); err == nil && !ok {
+			return nil
+		}
+	} else {
+		flyHttp, err = extractFlyHttp(data)
+	}
 	if err != nil {
-		log.Printf("[ERROR] extract fly http error (%+v)", err.Error())
-		return err
+		rateLog.Printf("[ERROR] extract fly http error (%+v)", err.Error())
+		drop(DropParseError, 1, "len=%d err=%q", len(data), err)
+		return nil
+	}
+	stats.Add(StatParsed, 1)
+	if len(shards) > 0 {
+		flyHttp.Iface = shardFlows.Get(data)
+	}
+
+	configLock.RLock()
+	family := IPFamily
+	configLock.RUnlock()
+	if family != FamilyAll && flyHttp.Family != family {
+		drop(DropIPFamily, 1, "%s family=%s", flowFields(flyHttp), flyHttp.Family)
+		return nil
+	}
+	stats.Add(familyStat(flyHttp.Family, StatFamilySegments), 1)
+	stats.Add(familyStat(flyHttp.Family, StatFamilyBytes), int64(flyHttp.Size))
+
+	if ListeningOnly && !listeningPorts.Match(flyHttp.SrcPort, flyHttp.DstPort) {
+		drop(DropListeningPort, 1, "%s", flowFields(flyHttp))
+		return nil
+	}
+	// a response head may follow the one of a HEAD without a body in between
+	var methods []string
+	if flyHttp.Data.Type == IsResponse && !flyHttp.Data.IsTruncation {
+		methods = connections.ResponseMethods(connKey(flyHttp.DstIP, flyHttp.DstPort, flyHttp.SrcIP, flyHttp.SrcPort))
+	}
+	return splitPipelined(flyHttp, data, methods)
+}
+
+func saveMessage(flyHttp FlyHttp) {
+	connStats.Observe(flyHttp)
+
+	// a reset without a payload only flags the exchanges in flight
+	if flyHttp.RST && flyHttp.Data.IsTruncation && len(flyHttp.Data.Body) == 0 {
+		connections.SaveReset(flyHttp)
+		return
 	}
 
 	rType := flyHttp.Data.Type
+	if rType == IsClientHello {
+		connections.SaveClientHello(flyHttp)
+	}
+
 	if rType == IsRequest {
 		if Debug && Verbose {
 			log.Printf("[PRISM] HTTP Request Body: %+v", string(flyHttp.Data.Body))
 			log.Println()
 		}
-		ackToRequest.Save(flyHttp)
+		connections.SaveRequest(flyHttp)
 	}
 
 	if rType == IsResponse {
@@ -55,45 +269,54 @@ func ParseHttp(data []byte) error {
 			log.Println()
 		}
 
-		// If the response http data is not truncated, the seq to ack mapping is saved,
-		// through which the request can be associated with multiple responses.
-		if !flyHttp.Data.IsTruncation {
-			seqToAck.Save(flyHttp)
-		}
-
-		ackToResponse.Save(flyHttp)
+		// Truncated segments carry no headers; they are attached to the response head
+		// preceding them in sequence order when the connection is paired.
+		connections.SaveResponse(flyHttp)
 	}
-
-	return nil
 }
 
 func extractFlyHttp(data []byte) (FlyHttp, error) {
-	eth := &layers.Ethernet{}
-	ipv4 := &layers.IPv4{}
-	stack := []gopacket.DecodingLayer{eth, ipv4}
-	nf := gopacket.NilDecodeFeedback
-	for _, d := range stack {
-		_ = d.DecodeFromBytes(data, nf)
-		data = d.LayerPayload()
+	var raw []byte
+	if CaptureRaw {
+		raw = data
 	}
 
-	if ipv4.Protocol != layers.IPProtocolTCP {
-		return FlyHttp{}, errors.New("packet is not tcp")
+	eth := &layers.Ethernet{}
+	nf := gopacket.NilDecodeFeedback
+	_ = eth.DecodeFromBytes(data, nf)
+	data = eth.LayerPayload()
+
+	var srcIP, dstIP net.IP
+	var family string
+	switch eth.EthernetType {
+	case layers.EthernetTypeIPv4:
+		ipv4 := &layers.IPv4{}
+		_ = ipv4.DecodeFromBytes(data, nf)
+		if ipv4.Protocol != layers.IPProtocolTCP {
+			return FlyHttp{}, errors.New("packet is not tcp")
+		}
+		srcIP, dstIP, family = ipv4.SrcIP, ipv4.DstIP, FamilyIPv4
+		data = ipv4.LayerPayload()
+	case layers.EthernetTypeIPv6:
+		ipv6 := &layers.IPv6{}
+		_ = ipv6.DecodeFromBytes(data, nf)
+		if ipv6.NextHeader != layers.IPProtocolTCP {
+			return FlyHttp{}, errors.New("packet is not tcp")
+		}
+		srcIP, dstIP, family = ipv6.SrcIP, ipv6.DstIP, FamilyIPv6
+		data = ipv6.LayerPayload()
+	default:
+		return FlyHttp{}, errors.New("packet is not ip")
 	}
 
 	tcp := &layers.TCP{}
-	stack = []gopacket.DecodingLayer{tcp}
-	for _, d := range stack {
-		_ = d.DecodeFromBytes(data, nf)
-		data = d.LayerPayload()
-	}
+	_ = tcp.DecodeFromBytes(data, nf)
+	data = tcp.LayerPayload()
 
 	if Debug {
 		log.Printf("[PRISM] ETH   SrcMAC: %s,  DstMAC: %s", eth.SrcMAC, eth.DstMAC)
-		log.Printf("[PRISM] IPV4   SrcIP: %s,   DstIP: %s", ipv4.SrcIP, ipv4.DstIP)
+		log.Printf("[PRISM] %s   SrcIP: %s,   DstIP: %s", family, srcIP, dstIP)
 		log.Printf("[PRISM] TCP  SrcPort: %s, DstPort: %s", tcp.SrcPort, tcp.DstPort)
-		log.Printf("[PRISM] IPV4 Version: %d", ipv4.Version)
-		log.Printf("[PRISM] IPV4  Length: %d", ipv4.Length)
 		log.Printf("[PRISM] TCP      Seq: %d", tcp.Seq)
 		log.Printf("[PRISM] TCP      Ack: %d", tcp.Ack)
 		log.Printf("[PRISM] TCP      FIN: %t", tcp.FIN)
@@ -133,35 +356,56 @@ func extractFlyHttp(data []byte) (FlyHttp, error) {
 	return FlyHttp{
 		SrcMAC:     eth.SrcMAC.String(),
 		DstMAC:     eth.DstMAC.String(),
-		SrcIP:      ipv4.SrcIP.String(),
-		DstIP:      ipv4.DstIP.String(),
+		Family:     family,
+		SrcIP:      srcIP.String(),
+		DstIP:      dstIP.String(),
 		SrcPort:    tcp.SrcPort.String(),
 		DstPort:    tcp.DstPort.String(),
-		Seq:        tcp.Seq,
+		Seq:        tcp.Seq + uint32(reqOrResData.Skipped),
 		Ack:        tcp.Ack,
+		FIN:        tcp.FIN,
+		RST:        tcp.RST,
+		Size:       len(data),
+		Raw:        raw,
 		Data:       reqOrResData,
 		CreateTime: time.Now(),
 	}, nil
 }
 
 func parseReqOrResData(data []byte) ReqOrResData {
+	if isClientHello(data) {
+		info, err := parseClientHello(data)
+		if err != nil {
+			if Verbose {
+				log.Printf("[PRISM] %s", err.Error())
+			}
+			return ReqOrResData{}
+		}
+		return ReqOrResData{Type: IsClientHello, TLS: info}
+	}
+
 	rawData := string(data)
 
+	// a payload captured mid-stream, e.g. on a connection established before prism was
+	// attached, may start with the tail of a previous message: resync on the next line
+	// that looks like the start of one.
+	skipped := 0
+	if !hasStartLine(rawData) {
+		if i := messageStart(rawData); i > 0 && hasStartLine(rawData[i:]) {
+			if Debug {
+				log.Printf("[PRISM] HTTP resync, skip %d leading bytes", i)
+			}
+			skipped = i
+			rawData = rawData[i:]
+		}
+	}
+
 	// split request headers and request bodies
 	parts := strings.SplitN(rawData, "\r\n\r\n", 2)
 	headerPart := parts[0]
 
-	IsTruncation := true
 	// check whether response data is truncated
-	if len(parts) > 1 {
-		headerLines := strings.Split(headerPart, "\r\n")
-		if len(headerLines) > 1 {
-			firstLine := strings.Split(strings.TrimSpace(headerLines[0]), " ")
-			if len(firstLine) == 3 && strings.Contains(headerLines[0], HTTP) {
-				IsTruncation = false
-			}
-		}
-	}
+	IsTruncation := !hasStartLine(rawData)
 
 	if IsTruncation {
 		if Debug {
@@ -178,10 +422,33 @@ func parseReqOrResData(data []byte) ReqOrResData {
 	bodyPart := parts[1]
 
 	// parse request lines and headers
-	headerLines := strings.Split(headerPart, "\r\n")
-	firstLine := headerLines[0]
+	firstLine, rawHeaders, _ := strings.Cut(headerPart, "\r\n")
+
+	var ret = ReqOrResData{
+		Type:       requestOrResponse(firstLine),
+		Skipped:    skipped,
+		Headers:    parseHeaders(rawHeaders),
+		RawHeaders: rawHeaders,
+		Body:       bytes.NewBufferString(bodyPart).Bytes(),
+	}
+
+	if ret.Type == IsRequest {
+		ret.RequestLine.parseFirstLine(firstLine)
+	} else {
+		ret.ResponseLine.parseFirstLine(firstLine)
+	}
+
+	return ret
+}
+
+// parseHeaders parses the header lines of a message head, a repeated header keeps its
+// last value
+func parseHeaders(raw string) map[string]string {
 	headers := make(map[string]string)
-	for _, line := range headerLines[1:] {
+	if len(raw) == 0 {
+		return headers
+	}
+	for _, line := range strings.Split(raw, "\r\n") {
 		headerParts := strings.SplitN(line, ":", 2)
 		if len(headerParts) == 2 {
 			headerName := strings.TrimSpace(headerParts[0])
@@ -189,20 +456,62 @@ func parseReqOrResData(data []byte) ReqOrResData {
 			headers[headerName] = headerValue
 		}
 	}
+	return headers
+}
 
-	var ret = ReqOrResData{
-		Type:    requestOrResponse(firstLine),
-		Headers: headers,
-		Body:    bytes.NewBufferString(bodyPart).Bytes(),
+// hasStartLine reports whether data begins with a complete message head: a request or
+// status line followed by the headers.
+func hasStartLine(data string) bool {
+	parts := strings.SplitN(data, "\r\n\r\n", 2)
+	if len(parts) < 2 {
+		return false
 	}
+	line := strings.SplitN(parts[0], "\r\n", 2)[0]
+	firstLine := strings.Split(strings.TrimSpace(line), " ")
+	// the reason phrase of a status line may contain spaces, e.g. "HTTP/1.1 404 Not Found",
+	// and neither a HTTP/1.0 request nor a CONNECT response needs any header
+	return (len(firstLine) == 3 || strings.HasPrefix(firstLine[0], HTTP+"/")) && strings.Contains(line, HTTP)
+}
 
-	if ret.Type == IsRequest {
-		ret.RequestLine.parseFirstLine(firstLine)
-	} else {
-		ret.ResponseLine.parseFirstLine(firstLine)
+// messageStart returns the offset of the first line of data starting with a known method
+// or a HTTP version, or -1 if there is none
+func messageStart(data string) int {
+	for i := 0; i < len(data); {
+		line := data[i:]
+		if strings.HasPrefix(line, HTTP+"/1.") {
+			return i
+		}
+		if sp := strings.IndexByte(line, ' '); sp > 0 && isKnownMethod(line[:sp]) {
+			return i
+		}
+		next := strings.Index(line, "\r\n")
+		if next < 0 {
+			return -1
+		}
+		i += next + 2
 	}
+	return -1
+}
 
-	return ret
+// knownMethods are the methods registered by RFC 9110 and RFC 5789
+var knownMethods = map[string]struct{}{
+	"GET": {}, "HEAD": {}, "POST": {}, "PUT": {}, "DELETE": {},
+	"CONNECT": {}, "OPTIONS": {}, "TRACE": {}, "PATCH": {},
+}
+
+// isKnownMethod reports whether method is a standard HTTP method. Anything else is either
+// an extension method or, more often, a payload misread as a request line.
+func isKnownMethod(method string) bool {
+	_, ok := knownMethods[method]
+	return ok
+}
+
+// writeAnomalyMetrics writes the requests with an anomalous method as
+// prism_anomalous_methods_total
+func writeAnomalyMetrics(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP prism_anomalous_methods_total Requests whose method is not a standard HTTP method.\n"+
+		"# TYPE prism_anomalous_methods_total counter\nprism_anomalous_methods_total %d\n", stats.List()[StatAnomalousMethods])
+	return err
 }
 
 func requestOrResponse(FirstLine string) int {
@@ -220,16 +529,27 @@ func requestOrResponse(FirstLine string) int {
 }
 
 type FlyHttp struct {
-	SrcMAC     string       `json:"request_src_mac"`
-	DstMAC     string       `json:"request_dst_mac"`
-	SrcIP      string       `json:"request_src_ip"`
-	DstIP      string       `json:"request_dst_ip"`
-	SrcPort    string       `json:"request_src_port"`
-	DstPort    string       `json:"request_dst_port"`
-	Seq        uint32       `json:"seq"`
-	Ack        uint32       `json:"ack"`
-	Data       ReqOrResData `json:"data"`
-	CreateTime time.Time    `json:"create_time"`
+	SrcMAC      string       `json:"request_src_mac"`
+	DstMAC      string       `json:"request_dst_mac"`
+	Family      string       `json:"family"`
+	SrcIP       string       `json:"request_src_ip"`
+	DstIP       string       `json:"request_dst_ip"`
+	SrcPort     string       `json:"request_src_port"`
+	DstPort     string       `json:"request_dst_port"`
+	Seq         uint32       `json:"seq"`
+	Ack         uint32       `json:"ack"`
+	FIN         bool         `json:"fin"`
+	RST         bool         `json:"rst"`
+	Size        int          `json:"size"`
+	Raw         []byte       `json:"raw"`
+	Retransmits int          `json:"retransmits"`
+	Data        ReqOrResData `json:"data"`
+	CreateTime  time.Time    `json:"create_time"`
+	// Iface is the interface the segment was read on, only known with -n name=path
+	Iface string `json:"-"`
+	// Spill names the file of the body moved to the spill area, SpillLen is its length
+	Spill    string `json:"-"`
+	SpillLen int    `json:"-"`
 }
 
 type ReqOrResData struct {
@@ -237,8 +557,11 @@ type ReqOrResData struct {
 	RequestLine  RequestLine
 	ResponseLine ResponseLine
 	IsTruncation bool
+	Skipped      int
 	Headers      map[string]string
+	RawHeaders   string
 	Body         []byte
+	TLS          *TLSInfo
 }
 
 type FirstLine interface {
@@ -288,7 +611,7 @@ func (r ResponseLine) String() string {
 
 func (r *ResponseLine) parseFirstLine(data string) {
 	tmp := strings.TrimSpace(data)
-	requestLineInfos := strings.Split(tmp, " ")
+	requestLineInfos := strings.SplitN(tmp, " ", 3)
 	if len(requestLineInfos) < 3 {
 		r.err = errors.New(fmt.Sprintf("requestLine [%s] format err", data))
 		return
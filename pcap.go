@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// RawPacket is a captured ethernet frame kept with a record for pcap export
+type RawPacket struct {
+	Timestamp time.Time `json:"timestamp"`
+	Data      []byte    `json:"data"`
+}
+
+// rawPackets returns the frames of a request and its responses in capture order
+func rawPackets(request FlyHttp, responses []FlyHttp) []RawPacket {
+	if !CaptureRaw {
+		return nil
+	}
+
+	ret := []RawPacket{{Timestamp: request.CreateTime, Data: request.Raw}}
+	for _, v := range responses {
+		ret = append(ret, RawPacket{Timestamp: v.CreateTime, Data: v.Raw})
+	}
+	return ret
+}
+
+// writePcap writes the raw packets of a record as a pcap file
+func writePcap(w io.Writer, packets []RawPacket) error {
+	writer := pcapgo.NewWriter(w)
+	if err := writer.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		return err
+	}
+
+	for _, v := range packets {
+		info := gopacket.CaptureInfo{
+			Timestamp:     v.Timestamp,
+			CaptureLength: len(v.Data),
+			Length:        len(v.Data),
+		}
+		if err := writer.WritePacket(info, v.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// splitPipelined splits a segment holding several messages, e.g. HTTP/1.1 requests
+// pipelined before their responses, into one FlyHttp per message. The end of a message is
+// found from its Content-Length or chunked encoding; a message whose end is unknown or
+// beyond the segment is left whole. data is the packet the segment was extracted from,
+// methods are those of the requests the responses of the segment answer, in order.
+func splitPipelined(first FlyHttp, data []byte, methods []string) []FlyHttp {
+	ret := []FlyHttp{first}
+	if first.Data.IsTruncation || (first.Data.Type != IsRequest && first.Data.Type != IsResponse) {
+		return ret
+	}
+
+	// every body runs to the end of the payload until it is split
+	end := first.Seq - uint32(first.Data.Skipped) + uint32(len(tcpPayload(data)))
+	for {
+		cur := &ret[len(ret)-1]
+		method := ""
+		if len(ret) <= len(methods) {
+			method = methods[len(ret)-1]
+		}
+		n, ok := messageBodyLen(cur.Data, method)
+		if !ok || n >= len(cur.Data.Body) {
+			return ret
+		}
+		rest := cur.Data.Body[n:]
+		if !hasStartLine(string(rest)) {
+			return ret
+		}
+
+		next := *cur
+		next.Data = parseReqOrResData(rest)
+		next.Seq = end - uint32(len(rest))
+		next.Size = len(rest)
+		next.Raw = nil
+		cur.Data.Body = cur.Data.Body[:n]
+		cur.Size -= len(rest)
+		ret = append(ret, next)
+	}
+}
+
+// messageBodyLen returns the length of the body of a message, false if it only ends
+// when the connection is closed. method is the one of the request a response answers,
+// the Content-Length of the response to a HEAD is the one of a GET and it has no body.
+func messageBodyLen(data ReqOrResData, method string) (int, bool) {
+	if data.Type == IsResponse {
+		status := data.ResponseLine.Status
+		if method == http.MethodHead || status/100 == 1 || status == http.StatusNoContent || status == http.StatusNotModified {
+			return 0, true
+		}
+	}
+	if strings.EqualFold(headerValue(data.Headers, TransferEncoding), "chunked") {
+		return chunkedLen(data.Body)
+	}
+	if v := headerValue(data.Headers, ContentLength); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		return n, err == nil && n >= 0
+	}
+	// a request without a body length has no body
+	return 0, data.Type == IsRequest
+}
+
+// chunkedLen returns the length of the chunked body at the start of body, trailers
+// included, false if it does not end within body
+func chunkedLen(body []byte) (int, bool) {
+	off := 0
+	for {
+		line := bytes.Index(body[off:], []byte("\r\n"))
+		if line < 0 {
+			return 0, false
+		}
+		sizeField, _, _ := strings.Cut(string(body[off:off+line]), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 32)
+		if err != nil || size < 0 {
+			return 0, false
+		}
+		off += line + 2
+		if size == 0 {
+			break
+		}
+		off += int(size) + 2
+		if off > len(body) {
+			return 0, false
+		}
+	}
+
+	// the trailer section ends with an empty line
+	for {
+		line := bytes.Index(body[off:], []byte("\r\n"))
+		if line < 0 {
+			return 0, false
+		}
+		off += line + 2
+		if line == 0 {
+			return off, true
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPipelinedPairs(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []testSegment
+		want     []string
+	}{
+		{
+			name: "three GETs in one segment",
+			segments: []testSegment{
+				{true, 1, "GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+					"GET /b HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+					"GET /c HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+				{false, 1, "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na" +
+					"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n1\r\nb\r\n0\r\n\r\n" +
+					"HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nc"},
+			},
+			want: []string{"GET /a 200 a", "GET /b 200 1\r\nb\r\n0\r\n\r\n", "GET /c 200 c"},
+		},
+		{
+			name: "HEAD response with a Content-Length",
+			segments: []testSegment{
+				{true, 1, "HEAD /a HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+					"GET /b HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+				{false, 1, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n" +
+					"HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nb"},
+			},
+			want: []string{"HEAD /a 200 ", "GET /b 200 b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pairSummaries(t, tt.segments)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("pairs are %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageBodyLen(t *testing.T) {
+	response := ReqOrResData{
+		Type:         IsResponse,
+		ResponseLine: ResponseLine{Status: 200},
+		Headers:      map[string]string{ContentLength: "10"},
+	}
+	if n, ok := messageBodyLen(response, "GET"); n != 10 || !ok {
+		t.Fatalf("response to a GET has a %d bytes body (%t), want 10", n, ok)
+	}
+	if n, ok := messageBodyLen(response, "HEAD"); n != 0 || !ok {
+		t.Fatalf("response to a HEAD has a %d bytes body (%t), want none", n, ok)
+	}
+}
+
+// BenchmarkParseWorkers parses the segments of many connections, each a GET and its JSON
+// response, on -workers parse workers
+func BenchmarkParseWorkers(b *testing.B) {
+	const connections = 256
+	get := []byte("GET /api/users?page=2 HTTP/1.1\r\nHost: example.com\r\nAccept: application/json\r\n\r\n")
+	body := `{"users":[` + strings.Repeat(`{"id":1,"name":"example"},`, 160) + `{}]}`
+	ok := []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body))
+	var frames [][]byte
+	for i := 0; i < connections; i++ {
+		port := uint16(20000 + i)
+		frames = append(frames, sslFrame(port, true, 1, 1, get), sslFrame(port, false, 1, 1+uint32(len(get)), ok))
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			resetConnections()
+			b.Cleanup(resetConnections)
+			b.SetBytes(int64(connections * (len(get) + len(ok))))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				queueTask := make(chan []byte, len(frames))
+				for _, frame := range frames {
+					queueTask <- frame
+				}
+				close(queueTask)
+				RunParseWorkers(queueTask, workers)
+
+				b.StopTimer()
+				resetConnections()
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/cilium/ebpf"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tcpListen is the st column value of a listening socket in /proc/net/tcp
+const tcpListen = "0A"
+
+var listeningPorts = PortSet{ports: map[uint16]struct{}{}}
+
+// httpPorts is set from -http-ports, empty to capture any port
+var httpPorts []uint16
+
+// maxHttpPorts is max_entries of the http_ports map of the eBPF programs
+const maxHttpPorts = 64
+
+// parsePortList parses a comma separated list of ports such as "80,8080,3000"
+func parsePortList(s string) ([]uint16, error) {
+	var ret []uint16
+	for _, v := range strings.Split(s, ",") {
+		port, err := strconv.ParseUint(strings.TrimSpace(v), 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("bad port %q in port list %q", v, s)
+		}
+		ret = append(ret, uint16(port))
+	}
+	if len(ret) > maxHttpPorts {
+		return nil, fmt.Errorf("at most %d http ports can be set, got %d", maxHttpPorts, len(ret))
+	}
+	return ret, nil
+}
+
+var portFilters PortFilterTable
+
+// configureHttpPorts fills the port filter of the eBPF programs with httpPorts and the
+// extra ports, with no http port set every port is captured
+func configureHttpPorts(ports *ebpf.Map, settings *ebpf.Map, extra map[uint16]struct{}) error {
+	set := map[uint16]struct{}{}
+	for _, port := range httpPorts {
+		set[port] = struct{}{}
+	}
+	if len(httpPorts) > 0 {
+		for port := range extra {
+			set[port] = struct{}{}
+		}
+	}
+	for port := range set {
+		if err := ports.Put(port, uint8(1)); err != nil {
+			return fmt.Errorf("add http port %d: %w", port, err)
+		}
+	}
+
+	// remove the ports dropped from the list on reload
+	var port uint16
+	var stale []uint16
+	iter := ports.Iterate()
+	for iter.Next(&port, new(uint8)) {
+		if _, ok := set[port]; !ok {
+			stale = append(stale, port)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("list http ports: %w", err)
+	}
+	for _, v := range stale {
+		if err := ports.Delete(v); err != nil {
+			return fmt.Errorf("remove http port %d: %w", v, err)
+		}
+	}
+
+	var portFilter uint32
+	if len(httpPorts) > 0 {
+		portFilter = 1
+	}
+	return settings.Put(uint32(0), portFilter)
+}
+
+// PortFilterTable save the port filter maps of every attached capture, so that -http-ports
+// can be changed by a reload without attaching again. The extra ports are captured besides
+// -http-ports, e.g. the one of the self-test while it runs.
+type PortFilterTable struct {
+	maps  [][2]*ebpf.Map
+	extra map[uint16]struct{}
+	lock  sync.Mutex
+}
+
+// Add configures the port filter maps of a capture and keeps them for the next updates
+func (p *PortFilterTable) Add(ports *ebpf.Map, settings *ebpf.Map) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := configureHttpPorts(ports, settings, p.extra); err != nil {
+		return err
+	}
+	p.maps = append(p.maps, [2]*ebpf.Map{ports, settings})
+	return nil
+}
+
+// Update sets the ports to capture in every attached capture
+func (p *PortFilterTable) Update(ports []uint16) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	httpPorts = ports
+	return p.configure()
+}
+
+// Include captures port besides -http-ports until it is excluded
+func (p *PortFilterTable) Include(port uint16) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.extra == nil {
+		p.extra = map[uint16]struct{}{}
+	}
+	p.extra[port] = struct{}{}
+	return p.configure()
+}
+
+// Exclude stops capturing an included port, unless -http-ports has it
+func (p *PortFilterTable) Exclude(port uint16) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.extra, port)
+	return p.configure()
+}
+
+func (p *PortFilterTable) configure() error {
+	for _, v := range p.maps {
+		if err := configureHttpPorts(v[0], v[1], p.extra); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PortSet save the local tcp ports that have a listening socket, and the pinned ones that
+// match until unpinned whether they were read yet or not
+type PortSet struct {
+	ports  map[uint16]struct{}
+	pinned map[uint16]struct{}
+	lock   sync.RWMutex
+}
+
+func (p *PortSet) Set(ports map[uint16]struct{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.ports = ports
+}
+
+func (p *PortSet) Pin(port uint16) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pinned == nil {
+		p.pinned = map[uint16]struct{}{}
+	}
+	p.pinned[port] = struct{}{}
+}
+
+func (p *PortSet) Unpin(port uint16) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.pinned, port)
+}
+
+// Match reports whether either port of a segment, as formatted by gopacket, is listening
+func (p *PortSet) Match(ports ...string) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for _, v := range ports {
+		port, err := strconv.ParseUint(portNumber(v), 10, 16)
+		if err != nil {
+			continue
+		}
+		if _, ok := p.ports[uint16(port)]; ok {
+			return true
+		}
+		if _, ok := p.pinned[uint16(port)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readListeningPorts collects the local ports of the listening sockets of this network namespace
+func readListeningPorts() (map[uint16]struct{}, error) {
+	ports := map[uint16]struct{}{}
+	for _, name := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			// sl local_address rem_address st ...
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 || fields[3] != tcpListen {
+				continue
+			}
+			i := strings.LastIndex(fields[1], ":")
+			port, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+			if err != nil {
+				continue
+			}
+			ports[uint16(port)] = struct{}{}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ports, nil
+}
+
+// WatchListeningPorts rediscovers the listening ports periodically so that services
+// started after prism are picked up.
+func WatchListeningPorts(ctx context.Context, interval time.Duration) {
+	refresh := func() {
+		ports, err := readListeningPorts()
+		if err != nil {
+			log.Printf("[ERROR] read listening ports (%s)", err.Error())
+			return
+		}
+		listeningPorts.Set(ports)
+		if Verbose {
+			log.Printf("[PRISM] listening ports: %d", len(ports))
+		}
+	}
+
+	refresh()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refresh()
+		}
+	}
+}
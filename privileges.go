@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"strings"
+)
+
+// checkPrivileges fails early, with a hint, when prism cannot load and attach its eBPF
+// programs; netlink only reports a bare EPERM once the attach is attempted
+func checkPrivileges() error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("read capabilities: %w", err)
+	}
+	effective := uint64(data[1].Effective)<<32 | uint64(data[0].Effective)
+	has := func(capability int) bool {
+		return effective&(1<<uint(capability)) != 0
+	}
+
+	var missing []string
+	if !has(unix.CAP_NET_ADMIN) {
+		missing = append(missing, "cap_net_admin")
+	}
+	// kernels before 5.8 have no CAP_BPF and require CAP_SYS_ADMIN instead
+	if !has(unix.CAP_BPF) && !has(unix.CAP_SYS_ADMIN) {
+		missing = append(missing, "cap_bpf")
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	return fmt.Errorf("prism needs root to attach its eBPF programs, %s missing: run it with sudo, "+
+		"or grant the capabilities with sudo setcap cap_net_admin,cap_bpf,cap_perfmon,cap_sys_resource+ep %s",
+		strings.Join(missing, " and "), exe)
+}
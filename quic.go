@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// MethodQUIC stands for the method of the records of HTTP/3 connections, which only
+	// carry the SNI of their QUIC handshake
+	MethodQUIC = "QUIC"
+	TagQUIC    = "quic"
+
+	// StatQUICConnections counts the QUIC connections whose ClientHello was read
+	StatQUICConnections = "quic_connections"
+
+	// quicHandshakeTimeout is how long the CRYPTO frames of a ClientHello spread over
+	// several Initial packets are kept until the hello is complete
+	quicHandshakeTimeout = 10 * time.Second
+	// maxQUICHello bounds the ClientHello reassembled from the Initial packets
+	maxQUICHello = 64 << 10
+
+	ipProtocolUDP = 17
+
+	quicFrameCrypto = 0x06
+)
+
+// quicV1Salt is the salt of the Initial secrets of QUIC v1, see RFC 9001 section 5.2
+var quicV1Salt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+var quicHellos = QUICTable{mp: map[string]*quicHandshake{}}
+
+// configureQUIC sets detect_quic in the capture settings of the eBPF programs, so that
+// the QUIC Initial packets reach userspace
+func configureQUIC(settings *ebpf.Map) error {
+	if !DetectQUIC {
+		return nil
+	}
+	if err := settings.Put(uint32(3), uint32(1)); err != nil {
+		return fmt.Errorf("set detect quic: %w", err)
+	}
+	return nil
+}
+
+// isUDPEvent reports whether an event holds an ethernet/ip/udp packet
+func isUDPEvent(data []byte) bool {
+	const ethLen = 14
+	if len(data) < ethLen+40 {
+		return false
+	}
+	switch binary.BigEndian.Uint16(data[12:]) {
+	case uint16(layers.EthernetTypeIPv4):
+		return data[ethLen+9] == ipProtocolUDP
+	case uint16(layers.EthernetTypeIPv6):
+		return data[ethLen+6] == ipProtocolUDP
+	}
+	return false
+}
+
+// isQUICInitial reports whether an event holds a UDP datagram starting with a QUIC v1
+// Initial packet, as the eBPF programs check before copying it
+func isQUICInitial(data []byte) bool {
+	if !isUDPEvent(data) {
+		return false
+	}
+	const ethLen, udpLen = 14, 8
+	l4 := ethLen + 40
+	if binary.BigEndian.Uint16(data[12:]) == uint16(layers.EthernetTypeIPv4) {
+		l4 = ethLen + int(data[ethLen]&0x0f)*4
+	}
+	if len(data) < l4+udpLen+5 {
+		return false
+	}
+	payload := data[l4+udpLen:]
+	// long header and fixed bit set, packet type 0 is Initial
+	return payload[0]&0xf0 == 0xc0 && binary.BigEndian.Uint32(payload[1:]) == 1
+}
+
+// quicHandshake is the CRYPTO data of the Initial packets of a connection, keyed by offset
+type quicHandshake struct {
+	fragments map[uint64][]byte
+	first     time.Time
+	done      bool
+}
+
+// QUICTable save the ClientHello fragments of the QUIC connections being established,
+// keyed by client address and destination connection id
+type QUICTable struct {
+	mp     map[string]*quicHandshake
+	pruned time.Time
+	lock   sync.Mutex
+}
+
+// Add adds the CRYPTO frames of an Initial packet and returns the ClientHello once it is
+// complete, only once per connection
+func (q *QUICTable) Add(key string, fragments map[uint64][]byte) []byte {
+	now := time.Now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if now.Sub(q.pruned) > quicHandshakeTimeout {
+		for k, v := range q.mp {
+			if now.Sub(v.first) > quicHandshakeTimeout {
+				delete(q.mp, k)
+			}
+		}
+		q.pruned = now
+	}
+
+	hs, ok := q.mp[key]
+	if !ok {
+		hs = &quicHandshake{fragments: map[uint64][]byte{}, first: now}
+		q.mp[key] = hs
+	}
+	if hs.done {
+		return nil
+	}
+	for offset, v := range fragments {
+		if offset+uint64(len(v)) <= maxQUICHello {
+			hs.fragments[offset] = v
+		}
+	}
+
+	hello := hs.contiguous()
+	// handshake type (1), length (3)
+	if len(hello) < 4 {
+		return nil
+	}
+	n := 4 + (int(hello[1])<<16 | int(hello[2])<<8 | int(hello[3]))
+	if len(hello) < n {
+		return nil
+	}
+	hs.done, hs.fragments = true, nil
+	return hello[:n]
+}
+
+// contiguous returns the CRYPTO data received from offset 0 without a gap
+func (h *quicHandshake) contiguous() []byte {
+	offsets := make([]uint64, 0, len(h.fragments))
+	for k := range h.fragments {
+		offsets = append(offsets, k)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	var ret []byte
+	for _, offset := range offsets {
+		if offset > uint64(len(ret)) {
+			break
+		}
+		if end := offset + uint64(len(h.fragments[offset])); end > uint64(len(ret)) {
+			ret = append(ret, h.fragments[offset][uint64(len(ret))-offset:]...)
+		}
+	}
+	return ret
+}
+
+// extractQUIC reads the ClientHello of a QUIC Initial packet, false until the hello is
+// complete. Initial packets are encrypted with keys derived from their destination
+// connection id, so the hello is readable by anyone; the packets of the server fail to
+// decrypt with the client keys and are skipped.
+func extractQUIC(data []byte) (FlyHttp, bool, error) {
+	eth := &layers.Ethernet{}
+	nf := gopacket.NilDecodeFeedback
+	if err := eth.DecodeFromBytes(data, nf); err != nil {
+		return FlyHttp{}, false, err
+	}
+	data = eth.LayerPayload()
+
+	var srcIP, dstIP net.IP
+	var family string
+	switch eth.EthernetType {
+	case layers.EthernetTypeIPv4:
+		ipv4 := &layers.IPv4{}
+		if err := ipv4.DecodeFromBytes(data, nf); err != nil {
+			return FlyHttp{}, false, err
+		}
+		srcIP, dstIP, family = ipv4.SrcIP, ipv4.DstIP, FamilyIPv4
+		data = ipv4.LayerPayload()
+	case layers.EthernetTypeIPv6:
+		ipv6 := &layers.IPv6{}
+		if err := ipv6.DecodeFromBytes(data, nf); err != nil {
+			return FlyHttp{}, false, err
+		}
+		srcIP, dstIP, family = ipv6.SrcIP, ipv6.DstIP, FamilyIPv6
+		data = ipv6.LayerPayload()
+	default:
+		return FlyHttp{}, false, errors.New("packet is not ip")
+	}
+
+	udp := &layers.UDP{}
+	if err := udp.DecodeFromBytes(data, nf); err != nil {
+		return FlyHttp{}, false, err
+	}
+
+	dcid, plaintext, err := decryptQUICInitial(udp.LayerPayload())
+	if err != nil {
+		return FlyHttp{}, false, err
+	}
+	if plaintext == nil {
+		return FlyHttp{}, false, nil
+	}
+	fragments, err := quicCryptoFrames(plaintext)
+	if err != nil {
+		return FlyHttp{}, false, err
+	}
+
+	key := net.JoinHostPort(srcIP.String(), udp.SrcPort.String()) + "/" + string(dcid)
+	hello := quicHellos.Add(key, fragments)
+	if hello == nil {
+		return FlyHttp{}, false, nil
+	}
+	// parseClientHello reads a TLS record, QUIC carries the handshake message alone
+	record := append([]byte{tlsRecordHandshake, 3, 1, byte(len(hello) >> 8), byte(len(hello))}, hello...)
+	info, err := parseClientHello(record)
+	if err != nil {
+		return FlyHttp{}, false, fmt.Errorf("quic %w", err)
+	}
+	// QUIC always runs TLS 1.3, the legacy version of the hello says 1.2
+	info.Version, info.QUIC = tlsVersion(0x0304), true
+	stats.Add(StatQUICConnections, 1)
+
+	return FlyHttp{
+		SrcMAC:     eth.SrcMAC.String(),
+		DstMAC:     eth.DstMAC.String(),
+		Family:     family,
+		SrcIP:      srcIP.String(),
+		DstIP:      dstIP.String(),
+		SrcPort:    udp.SrcPort.String(),
+		DstPort:    udp.DstPort.String(),
+		Size:       len(udp.LayerPayload()),
+		Data:       ReqOrResData{Type: IsClientHello, TLS: info},
+		CreateTime: time.Now(),
+	}, true, nil
+}
+
+// decryptQUICInitial removes the header protection of a client Initial packet and
+// decrypts its payload, see RFC 9001 section 5. The plaintext is nil if the packet does
+// not decrypt with the client keys, e.g. an Initial packet of the server.
+func decryptQUICInitial(pkt []byte) (dcid, plaintext []byte, err error) {
+	truncated := errors.New("quic initial: truncated")
+	// flags (1), version (4), destination connection id length (1)
+	if len(pkt) < 7 {
+		return nil, nil, truncated
+	}
+	pos := 5
+	dcidLen := int(pkt[pos])
+	pos++
+	if dcidLen > 20 || len(pkt) < pos+dcidLen+1 {
+		return nil, nil, truncated
+	}
+	dcid = pkt[pos : pos+dcidLen]
+	pos += dcidLen
+	pos += 1 + int(pkt[pos])
+	if pos > len(pkt) {
+		return nil, nil, truncated
+	}
+	tokenLen, n := quicVarint(pkt[pos:])
+	if n == 0 || tokenLen > uint64(len(pkt)-pos-n) {
+		return nil, nil, truncated
+	}
+	pos += n + int(tokenLen)
+	length, n := quicVarint(pkt[pos:])
+	if n == 0 {
+		return nil, nil, truncated
+	}
+	pnOffset := pos + n
+	// the sample of the header protection starts 4 bytes after the packet number
+	if length < 20 || uint64(len(pkt)-pnOffset) < length {
+		return nil, nil, truncated
+	}
+
+	secret := hkdfExpandLabel(hkdfExtract(quicV1Salt, dcid), "client in", sha256.Size)
+	key := hkdfExpandLabel(secret, "quic key", 16)
+	iv := hkdfExpandLabel(secret, "quic iv", 12)
+	hp := hkdfExpandLabel(secret, "quic hp", 16)
+
+	block, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, nil, err
+	}
+	mask := make([]byte, aes.BlockSize)
+	block.Encrypt(mask, pkt[pnOffset+4:pnOffset+4+aes.BlockSize])
+
+	header := append([]byte(nil), pkt[:pnOffset+4]...)
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	block, err = aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err = aead.Open(nil, nonce, pkt[pnOffset+pnLen:pnOffset+int(length)], header)
+	if err != nil {
+		return dcid, nil, nil
+	}
+	return dcid, plaintext, nil
+}
+
+// quicCryptoFrames returns the CRYPTO frames of the payload of an Initial packet, keyed
+// by offset. An Initial packet only holds PADDING, PING, ACK, CRYPTO and
+// CONNECTION_CLOSE frames.
+func quicCryptoFrames(b []byte) (map[uint64][]byte, error) {
+	truncated := errors.New("quic frame: truncated")
+	ret := map[uint64][]byte{}
+	varints := func(count int) bool {
+		for i := 0; i < count; i++ {
+			_, n := quicVarint(b)
+			if n == 0 {
+				return false
+			}
+			b = b[n:]
+		}
+		return true
+	}
+
+	for len(b) > 0 {
+		typ := b[0]
+		b = b[1:]
+		switch typ {
+		case 0x00, 0x01:
+			// PADDING, PING
+		case 0x02, 0x03:
+			// ACK: largest acknowledged, delay, range count, first range, the ranges and
+			// the ECN counts of 0x03
+			if !varints(2) {
+				return nil, truncated
+			}
+			count, n := quicVarint(b)
+			if n == 0 || count > uint64(len(b)) {
+				return nil, truncated
+			}
+			b = b[n:]
+			extra := 1 + 2*int(count)
+			if typ == 0x03 {
+				extra += 3
+			}
+			if !varints(extra) {
+				return nil, truncated
+			}
+		case quicFrameCrypto:
+			offset, n := quicVarint(b)
+			if n == 0 {
+				return nil, truncated
+			}
+			b = b[n:]
+			size, n := quicVarint(b)
+			if n == 0 || uint64(len(b)-n) < size {
+				return nil, truncated
+			}
+			ret[offset] = b[n : n+int(size)]
+			b = b[n+int(size):]
+		case 0x1c:
+			// CONNECTION_CLOSE, nothing follows that matters
+			return ret, nil
+		default:
+			return nil, fmt.Errorf("quic frame: unexpected type 0x%02x in an initial packet", typ)
+		}
+	}
+	return ret, nil
+}
+
+// quicVarint decodes a variable-length integer, n is 0 if b is too short
+func quicVarint(b []byte) (v uint64, n int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n = 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v = uint64(b[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n
+}
+
+func hkdfExtract(salt, secret []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := append([]byte{byte(length >> 8), byte(length), byte(len(label))}, label...)
+	info = append(info, 0)
+
+	var ret, prev []byte
+	for i := byte(1); len(ret) < length; i++ {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(prev)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		prev = mac.Sum(nil)
+		ret = append(ret, prev...)
+	}
+	return ret[:length]
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// logInterval is how long the messages similar to a logged one are suppressed
+const logInterval = 10 * time.Second
+
+var rateLog = LogLimiter{mp: map[string]*logBucket{}, interval: logInterval}
+
+type logBucket struct {
+	last       time.Time
+	suppressed int
+}
+
+// LogLimiter save when each message of the hot paths was last logged, keyed by its format.
+// Within an interval the similar messages are only counted, and the count is logged with
+// the next message let through.
+type LogLimiter struct {
+	mp       map[string]*logBucket
+	interval time.Duration
+	lock     sync.Mutex
+}
+
+func (l *LogLimiter) Printf(format string, v ...interface{}) {
+	l.lock.Lock()
+	bucket, ok := l.mp[format]
+	if !ok {
+		bucket = &logBucket{}
+		l.mp[format] = bucket
+	}
+	now := time.Now()
+	if now.Sub(bucket.last) < l.interval {
+		bucket.suppressed++
+		l.lock.Unlock()
+		return
+	}
+	suppressed, since := bucket.suppressed, now.Sub(bucket.last)
+	bucket.last, bucket.suppressed = now, 0
+	l.lock.Unlock()
+
+	msg := fmt.Sprintf(format, v...)
+	if suppressed > 0 {
+		log.Printf("%s (suppressed %d similar messages in last %s)", msg, suppressed, since.Round(time.Second))
+		return
+	}
+	log.Print(msg)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/google/gopacket/layers"
+)
+
+// streamChunkMax is the most payload bytes put in a reassembled segment, well below the
+// 64 KiB an IP packet can carry
+const streamChunkMax = 60 * 1024
+
+// streamSegment is a segment waiting for the bytes before it, payload being the tcp
+// payload of frame
+type streamSegment struct {
+	seq     uint32
+	frame   []byte
+	payload []byte
+}
+
+// stream is a direction of a tcp connection, next the sequence number of the first byte
+// not passed on yet. Until its SYN was seen or bytes were passed on, next is the first
+// byte seen so far.
+type stream struct {
+	next    uint32
+	known   bool
+	pending []streamSegment
+}
+
+// StreamTable save the directions of the tcp connections of a pcap, so that their
+// payload is parsed in sequence order whatever the order the segments were captured in,
+// as the live path pairs the messages by sequence number. The payload of a direction is
+// held until the other direction sends data or it closes, then passed on in segments of
+// at most streamChunkMax bytes; a hole that was never filled is skipped over, as a lost
+// segment is by the live path. The segments without payload and the retransmissions of
+// bytes already passed on go through as captured.
+type StreamTable struct {
+	mp map[string]*stream
+	// emit receives the reassembled segments
+	emit func(frame []byte)
+}
+
+func NewStreamTable(emit func(frame []byte)) *StreamTable {
+	return &StreamTable{mp: map[string]*stream{}, emit: emit}
+}
+
+// Add passes on the segment of frame once the bytes before it were, frames that are not
+// tcp go through as they are
+func (t *StreamTable) Add(frame []byte) {
+	addr, addrLen, tcpOff, ok := packetOffsets(frame)
+	payload, ok := segmentPayload(frame, tcpOff, ok)
+	if !ok {
+		t.emit(frame)
+		return
+	}
+	tcp := frame[tcpOff:]
+	seq, flags := binary.BigEndian.Uint32(tcp[4:]), tcp[13]
+
+	key := string(frame[addr:addr+2*addrLen]) + string(tcp[:4])
+	reverse := string(frame[addr+addrLen:addr+2*addrLen]) + string(frame[addr:addr+addrLen]) + string(tcp[2:4]) + string(tcp[:2])
+	s, ok := t.mp[key]
+	if !ok {
+		s = &stream{}
+		t.mp[key] = s
+	}
+
+	if flags&tcpFlagSyn != 0 {
+		s.next, s.known = seq+1, true
+		t.emit(frame)
+		return
+	}
+	// the other direction answers, what it sent before is complete
+	if other, ok := t.mp[reverse]; ok && len(payload) > 0 {
+		t.flush(other)
+	}
+	// the FIN or RST goes through with its payload once what came before it did
+	if flags&(tcpFlagFin|tcpFlagRst) != 0 {
+		t.flush(s)
+		delete(t.mp, key)
+		t.emit(frame)
+		return
+	}
+	if len(payload) > 0 {
+		if !s.known && (len(s.pending) == 0 || seqBefore(seq, s.next)) {
+			s.next = seq
+		}
+		if seqBefore(seq, s.next) && !seqBefore(s.next, seq+uint32(len(payload))) {
+			t.emit(frame)
+			return
+		}
+		s.insert(streamSegment{seq: seq, frame: frame, payload: payload})
+		t.advance(s, false)
+		return
+	}
+	t.emit(frame)
+}
+
+// Flush passes on the payload of every direction, at the end of the capture
+func (t *StreamTable) Flush() {
+	keys := make([]string, 0, len(t.mp))
+	for k := range t.mp {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		t.flush(t.mp[k])
+	}
+}
+
+// insert adds a segment in sequence order, a segment starting at the same byte as a
+// pending one is a retransmission of it
+func (s *stream) insert(segment streamSegment) {
+	i := sort.Search(len(s.pending), func(i int) bool {
+		return !seqBefore(s.pending[i].seq, segment.seq)
+	})
+	if i < len(s.pending) && s.pending[i].seq == segment.seq {
+		return
+	}
+	s.pending = append(s.pending, streamSegment{})
+	copy(s.pending[i+1:], s.pending[i:])
+	s.pending[i] = segment
+}
+
+// flush passes on the pending payload of a direction, skipping over its holes
+func (t *StreamTable) flush(s *stream) {
+	t.advance(s, true)
+}
+
+// advance passes on the contiguous payload at the start of the pending segments, once
+// it reached streamChunkMax bytes or if all is set. With all, a hole before a pending
+// segment is skipped over.
+func (t *StreamTable) advance(s *stream, all bool) {
+	for len(s.pending) > 0 {
+		if all && seqBefore(s.next, s.pending[0].seq) {
+			s.next = s.pending[0].seq
+		}
+
+		// the contiguous payload from next, overlapping bytes taken once
+		var chunk []byte
+		n := 0
+		for ; n < len(s.pending); n++ {
+			v := s.pending[n]
+			if seqBefore(s.next+uint32(len(chunk)), v.seq) {
+				break
+			}
+			if skip := int(s.next + uint32(len(chunk)) - v.seq); skip < len(v.payload) {
+				chunk = append(chunk, v.payload[skip:]...)
+			}
+		}
+		if len(chunk) == 0 && n > 0 {
+			// retransmissions of bytes already passed on
+			s.pending = s.pending[n:]
+			continue
+		}
+		if len(chunk) == 0 || (!all && len(chunk) < streamChunkMax) {
+			return
+		}
+
+		head := s.pending[0].frame
+		for len(chunk) > 0 {
+			size := len(chunk)
+			if size > streamChunkMax {
+				size = streamChunkMax
+			}
+			t.emit(segmentFrame(head, s.next, chunk[:size]))
+			s.next += uint32(size)
+			s.known = true
+			chunk = chunk[size:]
+		}
+		s.pending = s.pending[n:]
+	}
+}
+
+// segmentPayload returns the tcp payload of a frame whose tcp header is at tcpOff,
+// without the padding of the ethernet frame
+func segmentPayload(frame []byte, tcpOff int, ok bool) ([]byte, bool) {
+	if !ok {
+		return nil, false
+	}
+	const ethLen = 14
+	var end int
+	switch binary.BigEndian.Uint16(frame[12:]) {
+	case uint16(layers.EthernetTypeIPv4):
+		if frame[ethLen+9] != byte(layers.IPProtocolTCP) {
+			return nil, false
+		}
+		end = ethLen + int(binary.BigEndian.Uint16(frame[ethLen+2:]))
+	default:
+		if frame[ethLen+6] != byte(layers.IPProtocolTCP) {
+			return nil, false
+		}
+		end = ethLen + 40 + int(binary.BigEndian.Uint16(frame[ethLen+4:]))
+	}
+	start := tcpOff + int(frame[tcpOff+12]>>4)*4
+	if start > end || end > len(frame) {
+		return nil, false
+	}
+	return frame[start:end], true
+}
+
+// segmentFrame builds a segment carrying payload at seq, with the headers of head
+func segmentFrame(head []byte, seq uint32, payload []byte) []byte {
+	const ethLen = 14
+	_, _, tcpOff, _ := packetOffsets(head)
+	start := tcpOff + int(head[tcpOff+12]>>4)*4
+	frame := append(make([]byte, 0, start+len(payload)), head[:start]...)
+	frame = append(frame, payload...)
+
+	if binary.BigEndian.Uint16(frame[12:]) == uint16(layers.EthernetTypeIPv4) {
+		binary.BigEndian.PutUint16(frame[ethLen+2:], uint16(len(frame)-ethLen))
+	} else {
+		binary.BigEndian.PutUint16(frame[ethLen+4:], uint16(len(frame)-ethLen-40))
+	}
+	binary.BigEndian.PutUint32(frame[tcpOff+4:], seq)
+	return frame
+}
@@ -0,0 +1,48 @@
+package main
+
+import "sync"
+
+// recentRecords is a Sink keeping the last stored records for /recent
+var recentRecords *RecentRing
+
+// RecentRing save the last n stored records in a ring, so that they can be listed without
+// reading the db
+type RecentRing struct {
+	records []model
+	next    int
+	full    bool
+	lock    sync.RWMutex
+}
+
+func NewRecentRing(n int) *RecentRing {
+	return &RecentRing{records: make([]model, n)}
+}
+
+func (r *RecentRing) Publish(md model) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.records[r.next] = md
+	r.next = (r.next + 1) % len(r.records)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// List returns up to limit records, the most recent first
+func (r *RecentRing) List(limit int) []model {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.records)
+	}
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	ret := make([]model, 0, n)
+	for i := 1; i <= n; i++ {
+		ret = append(ret, r.records[(r.next-i+len(r.records))%len(r.records)])
+	}
+	return ret
+}
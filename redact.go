@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// isRedactedHeader reports whether the value of the header must not leave prism
+func isRedactedHeader(name string) bool {
+	for _, v := range strings.Split(RedactHeaders, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHeaders returns a copy of headers with the sensitive values replaced
+func redactHeaders(headers map[string]string) map[string]string {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	ret := make(map[string]string, len(headers))
+	for k, v := range headers {
+		if isRedactedHeader(k) {
+			v = redacted
+		}
+		ret[k] = v
+	}
+	return ret
+}
+
+var bodyRedactions []*regexp.Regexp
+
+// compileBodyRedactions compiles the -redact-body patterns, the previous patterns are kept
+// if one does not compile
+func compileBodyRedactions(patterns []string) error {
+	var ret []*regexp.Regexp
+	for _, v := range patterns {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return fmt.Errorf("redact body pattern %q: %w", v, err)
+		}
+		ret = append(ret, re)
+	}
+	bodyRedactions = ret
+	return nil
+}
+
+// redactBody replaces every match of the body patterns. When a pattern has capture
+// groups only the groups are replaced, so `"password":"([^"]*)"` keeps the key.
+func redactBody(body string) string {
+	for _, re := range bodyRedactions {
+		if re.NumSubexp() == 0 {
+			body = re.ReplaceAllLiteralString(body, redacted)
+			continue
+		}
+
+		var b strings.Builder
+		last := 0
+		for _, match := range re.FindAllStringSubmatchIndex(body, -1) {
+			for i := 2; i < len(match); i += 2 {
+				// skip groups that did not participate or overlap a previous one
+				if match[i] < last {
+					continue
+				}
+				b.WriteString(body[last:match[i]])
+				b.WriteString(redacted)
+				last = match[i+1]
+			}
+		}
+		b.WriteString(body[last:])
+		body = b.String()
+	}
+	return body
+}
+
+// urlHeaders are the request headers whose value is a url, redacted as the request url is
+var urlHeaders = []string{"Referer", "Origin"}
+
+// redactURL replaces the user and password of a url and every match of the body patterns
+func redactURL(v string) string {
+	if u, err := url.Parse(v); err == nil && u.User != nil {
+		u.User = nil
+		v = strings.Replace(u.String(), "//", "//"+redacted+"@", 1)
+	}
+	return redactBody(v)
+}
+
+// redactQuery applies the body patterns to the query parameters, a pattern matching the
+// name=value pair, such as `token=\w+`, redacting the whole value
+func redactQuery(query map[string][]string) {
+	for k, values := range query {
+		for i, v := range values {
+			if pair := k + "=" + v; redactBody(pair) != pair {
+				values[i] = redacted
+				continue
+			}
+			values[i] = redactBody(v)
+		}
+	}
+}
+
+// redactRawHeaders applies redactURL to the values of urlHeaders in captured header lines
+func redactRawHeaders(raw string) string {
+	lines := strings.Split(raw, "\r\n")
+	for i, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !isURLHeader(strings.TrimSpace(name)) {
+			continue
+		}
+		lines[i] = name + ": " + redactURL(strings.TrimSpace(value))
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+func isURLHeader(name string) bool {
+	for _, v := range urlHeaders {
+		if strings.EqualFold(v, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactRecord applies the body patterns to the bodies, to the fields decoded from them,
+// to the path and query parameters and to the urls of urlHeaders, whose user and password
+// are always redacted, and -redact-headers to the cookie values
+func redactRecord(md *model) {
+	redactCookies(md)
+	for k, v := range md.RequestHeaders {
+		if isURLHeader(k) {
+			md.RequestHeaders[k] = redactURL(v)
+		}
+	}
+	if len(md.RequestHeadersRaw) > 0 {
+		md.RequestHeadersRaw = redactRawHeaders(md.RequestHeadersRaw)
+	}
+	if len(bodyRedactions) == 0 {
+		return
+	}
+
+	md.RequestURL = redactBody(md.RequestURL)
+	redactQuery(md.RequestParma)
+	md.RequestBody = redactBody(md.RequestBody)
+	if body, ok := md.ResponseBody.(string); ok {
+		md.ResponseBody = redactBody(body)
+	}
+	for i := range md.RequestForm {
+		md.RequestForm[i].Value = redactBody(md.RequestForm[i].Value)
+	}
+	for _, values := range md.RequestFormValues {
+		for i := range values {
+			values[i] = redactBody(values[i])
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxReplayBody is the longest response body returned by a replay
+const maxReplayBody = 64 * 1024
+
+// TagReplay marks the records stored from the response to a replayed request
+const TagReplay = "replay"
+
+// hopHeaders are connection-level headers that must not be copied to a new request
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Upgrade",
+	TransferEncoding, ContentLength,
+}
+
+// ReplayResult is the response to a replayed request
+type ReplayResult struct {
+	Target    string            `json:"target"`
+	Status    int               `json:"status"`
+	Headers   map[string]string `json:"headers"`
+	Body      string            `json:"body"`
+	Truncated bool              `json:"truncated"`
+	Duration  float64           `json:"duration"`
+}
+
+// replayTarget returns the address a record is replayed to: the address it was captured
+// going to, or target if it is the Host of the record or one of -replay-targets, so that
+// the API cannot be used to reach any other host
+func replayTarget(md model, target string) (string, error) {
+	original := net.JoinHostPort(md.RequestDstIP, portNumber(md.RequestDstPort))
+	if len(target) == 0 || target == original {
+		return original, nil
+	}
+	if host := md.host(); len(host) > 0 {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, portNumber(md.RequestDstPort))
+		}
+		if target == host {
+			return target, nil
+		}
+	}
+	for _, v := range strings.Split(ReplayTargets, ",") {
+		if strings.TrimSpace(v) == target {
+			return target, nil
+		}
+	}
+	return "", fmt.Errorf("target %s is not the destination or the Host of the record, add it to -replay-targets", target)
+}
+
+// replayRequest sends a stored request to target. The Host header is kept so that virtual
+// hosts still route it. Bodies redacted by -redact-body are replayed redacted.
+func replayRequest(ctx context.Context, md model, target string) (ReplayResult, error) {
+	payload := md.RequestBody
+	if len(md.RequestBodyBlob) > 0 {
+		blob, err := readBlob(md.RequestBodyBlob)
+		if err != nil {
+			return ReplayResult{}, err
+		}
+		payload = string(blob)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, md.RequestMethod, requestURL(md), strings.NewReader(payload))
+	if err != nil {
+		return ReplayResult{}, err
+	}
+	for k, v := range md.RequestHeaders {
+		req.Header.Set(k, v)
+	}
+	for _, v := range hopHeaders {
+		req.Header.Del(v)
+	}
+	req.Host = md.host()
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, target)
+			},
+		},
+		// return redirects as they are instead of following them elsewhere
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxReplayBody+1))
+	if err != nil {
+		return ReplayResult{}, err
+	}
+
+	result := ReplayResult{
+		Target:   target,
+		Status:   resp.StatusCode,
+		Headers:  map[string]string{},
+		Duration: time.Since(start).Seconds(),
+	}
+	for k := range resp.Header {
+		result.Headers[k] = resp.Header.Get(k)
+	}
+	if len(body) > maxReplayBody {
+		body, result.Truncated = body[:maxReplayBody], true
+	}
+	result.Body = string(body)
+	return result, nil
+}
+
+// replayedRecord is the record of a replayed request and of the response it got, tagged
+// replay and stored under a key of its own beside the replayed record. Only the tags set
+// through the API are kept, the ones prism set described the captured exchange.
+func replayedRecord(md model, result ReplayResult) model {
+	now := time.Now()
+	id := fmt.Sprintf("%s-%d", TagReplay, now.UnixNano())
+	ret := model{
+		Id:                 id,
+		ReplayID:           id,
+		SchemaVersion:      md.SchemaVersion,
+		IPFamily:           md.IPFamily,
+		RequestSrcIP:       md.RequestSrcIP,
+		RequestSrcPort:     md.RequestSrcPort,
+		RequestMethod:      md.RequestMethod,
+		RequestVersion:     md.RequestVersion,
+		RequestURL:         md.RequestURL,
+		RequestHost:        md.RequestHost,
+		RequestParma:       md.RequestParma,
+		RequestHeaders:     md.RequestHeaders,
+		RequestBody:        md.RequestBody,
+		RequestBodyBlob:    md.RequestBodyBlob,
+		RequestContentType: md.RequestContentType,
+		RequestCookies:     md.RequestCookies,
+		RequestSize:        md.RequestSize,
+		RequestBodySize:    md.RequestBodySize,
+		RequestForm:        md.RequestForm,
+		RequestFormValues:  md.RequestFormValues,
+		Interface:          md.Interface,
+		CapturedAt:         int(now.Unix()),
+		Latency:            int(result.Duration * 1e6),
+
+		ResponseStatus:          result.Status,
+		ResponseContextType:     result.Headers[ContentType],
+		ResponseContentEncoding: result.Headers[ContentEncoding],
+		ResponseBody:            result.Body,
+		ResponseSize:            len(result.Body),
+		ResponseBodySize:        len(result.Body),
+		ResponseBodyTruncated:   result.Truncated,
+	}
+	for _, v := range md.Tag {
+		if !hasTags(systemTags, []string{v}) {
+			ret.Tag = append(ret.Tag, v)
+		}
+	}
+	ret.Tag = append(ret.Tag, TagReplay)
+	ret.RequestDstIP, ret.RequestDstPort, _ = net.SplitHostPort(result.Target)
+	return ret
+}
@@ -1,28 +1,259 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 	"log"
+	"math/rand"
 	"strings"
+	"time"
 )
 
-func SaveHttpData(db *leveldb.DB, save <-chan model) {
-	for md := range save {
-		if !strings.Contains(md.ResponseContextType, "text/plain") && !strings.Contains(md.ResponseContextType, "application/json") {
-			log.Printf("[PRISM] package is no text/plain,application/json")
+// dbOptions builds the leveldb options from the -db-* flags, zero keeps the leveldb default
+func dbOptions() (*opt.Options, error) {
+	o := &opt.Options{
+		WriteBuffer:            DBWriteBuffer * opt.MiB,
+		BlockCacheCapacity:     DBBlockCache * opt.MiB,
+		OpenFilesCacheCapacity: DBOpenFiles,
+		CompactionTableSize:    DBCompactionTableSize * opt.MiB,
+	}
+	if DBWriteBuffer < 0 || DBBlockCache < 0 || DBOpenFiles < 0 || DBCompactionTableSize < 0 {
+		return nil, fmt.Errorf("the db write buffer, block cache, open files and compaction table size cannot be negative")
+	}
+
+	switch DBCompression {
+	case "snappy":
+		o.Compression = opt.SnappyCompression
+	case "none":
+		o.Compression = opt.NoCompression
+	default:
+		return nil, fmt.Errorf("unknown db compression %q, must be snappy or none", DBCompression)
+	}
+	if RecordCodec != EncodingJSON && RecordCodec != EncodingBinary {
+		return nil, fmt.Errorf("unknown record codec %q, must be json or binary", RecordCodec)
+	}
+
+	switch CompressBodies {
+	case CodecNone, CodecSnappy, CodecZstd:
+	default:
+		return nil, fmt.Errorf("unknown body codec %q, must be none, snappy or zstd", CompressBodies)
+	}
+
+	switch KeyLayout {
+	case KeyMethodPath, KeyTime, KeyHostTime, KeyPathTime, KeyContent:
+	default:
+		return nil, fmt.Errorf("unknown key layout %q, must be %s, %s, %s, %s or %s", KeyLayout, KeyMethodPath, KeyTime, KeyHostTime, KeyPathTime, KeyContent)
+	}
+
+	if BodySampleRate < 0 || BodySampleRate > 1 {
+		return nil, fmt.Errorf("body sample rate %v must be between 0 and 1", BodySampleRate)
+	}
+
+	switch DBSync {
+	case SyncNone, SyncAlways, SyncBatch:
+	default:
+		return nil, fmt.Errorf("unknown db sync policy %q, must be none, always or batch", DBSync)
+	}
+	return o, nil
+}
+
+// dropBodies removes the bodies of a record that was not sampled, along with everything
+// decoded from them, while its metadata is kept
+func dropBodies(md *model) {
+	md.RequestBody = ""
+	md.ResponseBody = nil
+	md.RequestFormValues = nil
+	for i := range md.RequestForm {
+		md.RequestForm[i].Value = ""
+	}
+	md.RawPackets = nil
+	md.BodyDropped = true
+}
+
+const (
+	HeaderFormatStructured = "structured"
+	HeaderFormatRaw        = "raw"
+)
+
+// storedHeaders returns the record as stored: with -header-format raw only the captured
+// header lines are kept, the sinks still get the parsed headers
+func storedHeaders(md model) model {
+	if len(md.RequestHeadersRaw) > 0 {
+		md.RequestHeaders = nil
+	}
+	return md
+}
+
+const (
+	SyncNone   = "none"
+	SyncAlways = "always"
+	SyncBatch  = "batch"
+
+	// syncBatchInterval is how often batched records are written and fsynced
+	syncBatchInterval = time.Second
+)
+
+// SaveHttpData stores the records of save in db, and applies the tag edits of edits in
+// between so that they see the records written before them
+func SaveHttpData(db *leveldb.DB, hosts *HostTable, save <-chan model, edits <-chan tagEdit) {
+	sampler := rand.New(rand.NewSource(time.Now().UnixNano()))
+	// the hosts of the records are only tracked to evict, the table is left empty without
+	// -per-host-cap
+	if db != nil && PerHostCap > 0 {
+		if err := hosts.Load(db); err != nil {
+			log.Printf("[ERROR] load host records (%s)", err.Error())
+		}
+	}
+	evict := func(md model) []string {
+		if PerHostCap <= 0 {
+			return nil
+		}
+		return hosts.Add(md.host(), md.Id, PerHostCap)
+	}
+
+	// with -db-sync=batch records are grouped and written with a single fsync. batched maps
+	// the keys written in the batch to the index of their pending record, -1 once deleted.
+	var batch leveldb.Batch
+	var pending []model
+	batched := map[string]int{}
+	flush := func() {
+		if batch.Len() == 0 {
+			return
+		}
+		if err := db.Write(&batch, &opt.WriteOptions{Sync: true}); err != nil {
+			log.Printf("[ERROR] write batch error (%s)", err.Error())
+		} else {
+			stats.Add(StatSaved, int64(len(pending)))
+			for _, md := range pending {
+				publish(md)
+			}
+		}
+		batch.Reset()
+		pending = pending[:0]
+		batched = map[string]int{}
+	}
+	// release removes the references of the record a key holds before the batch changes it:
+	// the stored one the first time the key is batched, then the pending one, if any
+	release := func(key string) {
+		if i, ok := batched[key]; !ok {
+			releaseStored(db, key)
+		} else if i >= 0 {
+			releaseBodies(pending[i])
+		}
+	}
+
+	ticker := time.NewTicker(syncBatchInterval)
+	defer ticker.Stop()
+
+	for {
+		var md model
+		var ok bool
+		select {
+		case <-ticker.C:
+			flush()
+			continue
+		case edit := <-edits:
+			flush()
+			tags, err := editTags(db, edit)
+			edit.done <- tagResult{tags: tags, err: err}
 			continue
+		case md, ok = <-save:
+			if !ok {
+				flush()
+				return
+			}
 		}
+
+		// a replay is not captured traffic, the observers and the endpoints do not count it
+		replay := len(md.ReplayID) > 0
+		if len(md.IPFamily) > 0 && !replay {
+			stats.Add(familyStat(md.IPFamily, StatFamilyRecords), 1)
+		}
+		if !replay {
+			observe(md)
+		}
+		if !strings.Contains(md.ResponseContextType, "text/plain") && !strings.Contains(md.ResponseContextType, "application/json") &&
+			md.Grpc == nil && md.Tunnel == nil && md.TLS == nil && md.Unpaired != UnpairedRequest {
+			drop(DropContentType, 1, "host=%s path=%s content_type=%q", md.RequestHost, md.RequestURL, md.ResponseContextType)
+			continue
+		}
+		// the TLS and tunnel records have no body to measure
+		if md.TLS == nil && md.Tunnel == nil && (md.bodySize() < CaptureMinBody || (CaptureMaxBody > 0 && md.bodySize() > CaptureMaxBody)) {
+			drop(DropBodySize, 1, "host=%s path=%s body_size=%d", md.RequestHost, md.RequestURL, md.bodySize())
+			continue
+		}
+		if !replay {
+			endpoints.Observe(&md)
+		}
+
+		if diskGuard.Low() {
+			drop(DropDiskLow, 1, "host=%s path=%s", md.RequestHost, md.RequestURL)
+			continue
+		}
+
+		// redacted before the key is built, so that a secret of the path is not in the key
+		configLock.RLock()
+		if BodySampleRate < 1 && sampler.Float64() >= BodySampleRate {
+			dropBodies(&md)
+			drop(DropBodySampled, 1, "host=%s path=%s", md.RequestHost, md.RequestURL)
+		}
+		redactRecord(&md)
+		configLock.RUnlock()
+
 		md.key()
+		md.SavedAt = int(time.Now().Unix())
+		sessions.Track(&md)
+
+		// with -no-db the records only reach the sinks
+		if db == nil {
+			publish(md)
+			continue
+		}
+		if err := externalizeBodies(&md); err != nil {
+			log.Printf("[ERROR] store blob error (%s)", err.Error())
+			continue
+		}
+		if err := dedupeBodies(&md); err != nil {
+			log.Printf("[ERROR] store body error (%s)", err.Error())
+			continue
+		}
 
-		byt, err := json.Marshal(md)
+		byt, err := encodeRecord(storedHeaders(md))
 		if err != nil {
 			log.Printf("[ERROR] marshal error (%s)", err.Error())
 			continue
 		}
-		if err := db.Put([]byte(md.Id), byt, nil); err != nil {
+
+		if DBSync == SyncBatch {
+			release(md.Id)
+			batch.Put([]byte(md.Id), byt)
+			batched[md.Id] = len(pending)
+			pending = append(pending, md)
+
+			for _, key := range evict(md) {
+				release(key)
+				batched[key] = -1
+				batch.Delete([]byte(key))
+				stats.Add(StatEvictedHostCap, 1)
+			}
+			continue
+		}
+
+		releaseStored(db, md.Id)
+		if err := db.Put([]byte(md.Id), byt, &opt.WriteOptions{Sync: DBSync == SyncAlways}); err != nil {
 			log.Printf("[ERROR] put error (%s)", err.Error())
 			continue
 		}
+		for _, key := range evict(md) {
+			releaseStored(db, key)
+			if err := db.Delete([]byte(key), nil); err != nil {
+				log.Printf("[ERROR] delete error (%s)", err.Error())
+			}
+			stats.Add(StatEvictedHostCap, 1)
+		}
+
+		stats.Add(StatSaved, 1)
+		publish(md)
 	}
 }
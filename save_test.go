@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// openTestStore opens a db and a body store deduplicating the bodies above 4 bytes in a
+// temporary data path, with -db-sync=batch
+func openTestStore(t *testing.T) *leveldb.DB {
+	t.Helper()
+	dataPath, dedupe, sync, hostCap := DataPath, DedupeThreshold, DBSync, PerHostCap
+	t.Cleanup(func() {
+		DataPath, DedupeThreshold, DBSync, PerHostCap = dataPath, dedupe, sync, hostCap
+	})
+	DataPath, DedupeThreshold, DBSync = t.TempDir(), 4, SyncBatch
+
+	var err error
+	if bodies, err = OpenBodyStore(nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		bodies.db.Close()
+		bodies = nil
+	})
+	db, err := leveldb.OpenFile(filepath.Join(DataPath, "db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// saveRecords runs SaveHttpData until every record is saved in a single batch
+func saveRecords(db *leveldb.DB, hosts *HostTable, records ...model) {
+	save := make(chan model, len(records))
+	for _, v := range records {
+		save <- v
+	}
+	close(save)
+	SaveHttpData(db, hosts, save, nil)
+}
+
+func testRecord(path, body string) model {
+	return model{
+		RequestMethod:       "GET",
+		RequestURL:          path,
+		RequestHost:         "example.com",
+		ResponseStatus:      200,
+		ResponseContextType: "application/json",
+		ResponseBody:        body,
+		ResponseBodySize:    len(body),
+	}
+}
+
+func bodyRefs(t *testing.T, body string) uint64 {
+	t.Helper()
+	sum := sha256.Sum256([]byte(body))
+	n, err := bodies.refs(hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSaveBatchReleasesOverwrittenBodiesOnce(t *testing.T) {
+	const body = `{"error":"same large body"}`
+	tests := []struct {
+		name    string
+		stored  []model
+		batch   []model
+		hostCap int
+		refs    uint64
+	}{
+		{
+			name:  "key written three times",
+			batch: []model{testRecord("/a", body), testRecord("/a", body), testRecord("/a", body), testRecord("/b", body)},
+			refs:  2,
+		},
+		{
+			name:   "stored key written twice",
+			stored: []model{testRecord("/a", body), testRecord("/b", body)},
+			batch:  []model{testRecord("/a", body), testRecord("/a", body)},
+			refs:   2,
+		},
+		{
+			name:    "key evicted by the host cap then written again",
+			batch:   []model{testRecord("/a", body), testRecord("/b", body), testRecord("/a", body)},
+			hostCap: 1,
+			refs:    1,
+		},
+		{
+			name:    "stored key evicted by the host cap then written again",
+			stored:  []model{testRecord("/a", body)},
+			batch:   []model{testRecord("/b", body), testRecord("/a", body), testRecord("/b", body)},
+			hostCap: 1,
+			refs:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestStore(t)
+			PerHostCap = tt.hostCap
+			hosts := &HostTable{mp: map[string]*list.List{}, owner: map[string]*list.Element{}}
+			if len(tt.stored) > 0 {
+				saveRecords(db, hosts, tt.stored...)
+			}
+			saveRecords(db, hosts, tt.batch...)
+
+			if n := bodyRefs(t, body); n != tt.refs {
+				t.Fatalf("body has %d references, want %d", n, tt.refs)
+			}
+			iter := db.NewIterator(nil, nil)
+			defer iter.Release()
+			for iter.Next() {
+				md := model{}
+				if err := decodeRecord(iter.Value(), &md); err != nil {
+					t.Fatal(err)
+				}
+				if err := resolveBodies(&md); err != nil {
+					t.Fatalf("record %s: %s", iter.Key(), err)
+				}
+			}
+		})
+	}
+}
+
+func TestTagEditsAfterPendingRecords(t *testing.T) {
+	db := openTestStore(t)
+	hosts := &HostTable{mp: map[string]*list.List{}, owner: map[string]*list.Element{}}
+	md := testRecord("/a", "{}")
+	md.Tag = []string{TagTLS}
+	md.key()
+
+	save, edits := make(chan model), make(chan tagEdit)
+	saved := make(chan struct{})
+	go func() {
+		SaveHttpData(db, hosts, save, edits)
+		close(saved)
+	}()
+	// the record is received, and still batched, when the edit comes
+	save <- md
+	edit := tagEdit{id: md.Id, add: []string{"investigate"}, done: make(chan tagResult, 1)}
+	edits <- edit
+	result := <-edit.done
+	close(save)
+	<-saved
+
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if want := []string{TagTLS, "investigate"}; fmt.Sprint(result.tags) != fmt.Sprint(want) {
+		t.Fatalf("tags are %q, want %q", result.tags, want)
+	}
+	if err := checkTags([]string{TagTLS}); err == nil {
+		t.Fatalf("system tag %q can be changed", TagTLS)
+	}
+}
+
+func TestBlobDeletedWithLastRecord(t *testing.T) {
+	const body = `{"error":"large body in a blob"}`
+	db := openTestStore(t)
+	threshold, hostCap := BlobThreshold, PerHostCap
+	t.Cleanup(func() {
+		BlobThreshold, PerHostCap = threshold, hostCap
+		blobRefs = BlobRefTable{mp: map[string]int{}}
+	})
+	BlobThreshold, PerHostCap = 4, 1
+	hosts := &HostTable{mp: map[string]*list.List{}, owner: map[string]*list.Element{}}
+
+	sum := sha256.Sum256([]byte(body))
+	blob := filepath.Join(blobDir(), hex.EncodeToString(sum[:]))
+	saveRecords(db, hosts, testRecord("/a", body), testRecord("/a", body))
+	if _, err := os.Stat(blob); err != nil {
+		t.Fatalf("blob of the overwritten key is gone: %s", err)
+	}
+	// /b evicts /a by the host cap, then /b is overwritten by a smaller body
+	saveRecords(db, hosts, testRecord("/b", body), testRecord("/b", "{}"))
+	if _, err := os.Stat(blob); !os.IsNotExist(err) {
+		t.Fatalf("blob is kept without a record referencing it (%v)", err)
+	}
+}
+
+func TestSnapshotNDJSONResolvesBlobs(t *testing.T) {
+	const body = `{"error":"large body in a blob"}`
+	db := openTestStore(t)
+	threshold := BlobThreshold
+	t.Cleanup(func() {
+		BlobThreshold = threshold
+		blobRefs = BlobRefTable{mp: map[string]int{}}
+	})
+	BlobThreshold = 4
+	hosts := &HostTable{mp: map[string]*list.List{}, owner: map[string]*list.Element{}}
+	saveRecords(db, hosts, testRecord("/a", body))
+
+	snap, err := db.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+	buf := bytes.Buffer{}
+	if err := writeSnapshotNDJSON(&buf, snap); err != nil {
+		t.Fatal(err)
+	}
+	md := model{}
+	if err := json.Unmarshal(buf.Bytes(), &md); err != nil {
+		t.Fatal(err)
+	}
+	if md.ResponseBody != body || len(md.ResponseBodyBlob) > 0 {
+		t.Fatalf("exported body is %q with blob %q, want %q", md.ResponseBody, md.ResponseBodyBlob, body)
+	}
+}
+
+func TestKeyLayoutRanges(t *testing.T) {
+	records := []model{testRecord("/a?x=1", "{}"), testRecord("/a", "{}"), testRecord("/b", "{}"), testRecord("/a", "{}")}
+	records[1].RequestHost = "example.com:8080"
+	records[2].RequestHost = "other.example"
+	for i := range records {
+		records[i].CapturedAt = 1700000000 + i*60
+		records[i].RequestSrcPort = fmt.Sprint(40000 + i)
+	}
+	searches := []Search{
+		{Host: "example.com"},
+		{Host: "Example.com", since: 1700000060},
+		{Path: "/a", since: 1700000060, until: 1700000120},
+		{since: 1700000060, until: 1700000120},
+		{Path: "/a", until: 1700000000},
+	}
+	for _, layout := range []string{KeyTime, KeyHostTime, KeyPathTime} {
+		t.Run(layout, func(t *testing.T) {
+			keyLayout := KeyLayout
+			t.Cleanup(func() { KeyLayout = keyLayout })
+			KeyLayout = layout
+			db := openTestStore(t)
+			saveRecords(db, &HostTable{mp: map[string]*list.List{}, owner: map[string]*list.Element{}}, records...)
+
+			for _, search := range searches {
+				// the records read from the key range must be the ones of a full scan
+				var ranged, all []string
+				for _, scan := range []struct {
+					rng *util.Range
+					ids *[]string
+				}{{search.keyRange(), &ranged}, {nil, &all}} {
+					iter := db.NewIterator(scan.rng, nil)
+					for iter.Next() {
+						md := model{}
+						if err := decodeRecord(iter.Value(), &md); err != nil {
+							t.Fatal(err)
+						}
+						if search.match(&md) {
+							*scan.ids = append(*scan.ids, md.Id)
+						}
+					}
+					iter.Release()
+				}
+				if len(all) == 0 || fmt.Sprint(ranged) != fmt.Sprint(all) {
+					t.Fatalf("search %+v reads %q from its key range, want %q", search, ranged, all)
+				}
+			}
+		})
+	}
+}
+
+// countingSink counts the records it receives
+type countingSink struct {
+	n int
+}
+
+func (s *countingSink) Publish(md model) {
+	s.n++
+}
+
+func TestReplayStoredBesideRecord(t *testing.T) {
+	const requestBody = `{"query":"large body in a blob"}`
+	db := openTestStore(t)
+	threshold, observing := BlobThreshold, observers
+	t.Cleanup(func() {
+		BlobThreshold, observers = threshold, observing
+		blobRefs = BlobRefTable{mp: map[string]int{}}
+	})
+	BlobThreshold = 4
+	counter := &countingSink{}
+	observers = []Sink{counter}
+	hosts := &HostTable{mp: map[string]*list.List{}, owner: map[string]*list.Element{}}
+
+	md := testRecord("/a", "{}")
+	md.RequestMethod, md.RequestBody, md.Tag = "POST", requestBody, []string{TagReset, "investigate"}
+	saveRecords(db, hosts, md)
+	value, err := db.Get([]byte("POST-/a"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := model{}
+	if err := decodeRecord(value, &stored); err != nil {
+		t.Fatal(err)
+	}
+
+	result := ReplayResult{Target: "10.0.0.1:80", Status: 201, Headers: map[string]string{ContentType: ContentTypeJSON}, Body: "{}"}
+	saveRecords(db, hosts, replayedRecord(stored, result))
+
+	var records []model
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		v := model{}
+		if err := decodeRecord(iter.Value(), &v); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, v)
+	}
+	iter.Release()
+	if len(records) != 2 || records[0].ResponseStatus != 200 || records[1].ResponseStatus != 201 {
+		t.Fatalf("got %d records, want the replay stored beside the record it replayed", len(records))
+	}
+	replay := records[1]
+	if want := []string{"investigate", TagReplay}; fmt.Sprint(replay.Tag) != fmt.Sprint(want) {
+		t.Fatalf("replay tags are %q, want %q", replay.Tag, want)
+	}
+	if len(replay.RequestBodyBlob) == 0 || replay.RequestBodyBlob != stored.RequestBodyBlob || blobRefs.mp[replay.RequestBodyBlob] != 2 {
+		t.Fatalf("replay request body blob is %q with %d references, want the one of the record with 2", replay.RequestBodyBlob, blobRefs.mp[replay.RequestBodyBlob])
+	}
+	if counter.n != 1 {
+		t.Fatalf("observers got %d records, want only the captured one", counter.n)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	selfTestTimeout  = 15 * time.Second
+	selfTestInterval = time.Second
+)
+
+// SelfCheck sends requests to a throwaway loopback listener and waits for one of them to
+// come out of the pipeline as a stored record
+type SelfCheck struct {
+	path string
+	done chan struct{}
+}
+
+func NewSelfCheck() *SelfCheck {
+	return &SelfCheck{
+		path: fmt.Sprintf("/prism-selftest/%d", time.Now().UnixNano()),
+		done: make(chan struct{}),
+	}
+}
+
+// Publish is called for every stored record, the self-test passes on its own request
+func (s *SelfCheck) Publish(md model) {
+	if md.RequestURL != s.path {
+		return
+	}
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+// Run reports whether the self-test request was captured, parsed and stored within
+// selfTestTimeout. The request is repeated until then as the programs may not be
+// attached yet when it starts.
+func (s *SelfCheck) Run(ctx context.Context) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Printf("[ERROR] selftest: FAIL, listen (%s)", err.Error())
+		return
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ContentType, "text/plain")
+		_, _ = io.WriteString(w, "prism selftest")
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// the listener port is captured whatever -http-ports and -listening-only while it runs
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	if err := portFilters.Include(port); err != nil {
+		log.Printf("[ERROR] selftest: capture port %d (%s)", port, err.Error())
+	}
+	defer func() {
+		if err := portFilters.Exclude(port); err != nil {
+			log.Printf("[ERROR] selftest: stop capturing port %d (%s)", port, err.Error())
+		}
+	}()
+	listeningPorts.Pin(port)
+	defer listeningPorts.Unpin(port)
+
+	client := &http.Client{Timeout: selfTestInterval}
+	url := "http://" + ln.Addr().String() + s.path
+	timeout := time.After(selfTestTimeout)
+	ticker := time.NewTicker(selfTestInterval)
+	defer ticker.Stop()
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			log.Printf("[ERROR] selftest: FAIL, request (%s)", err.Error())
+			return
+		}
+		req.Header.Set("User-Agent", "prism-selftest")
+		if resp, err := client.Do(req); err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			log.Printf("[PRISM] selftest: PASS, %s was captured, parsed and stored", s.path)
+			return
+		case <-timeout:
+			log.Printf("[ERROR] selftest: FAIL, no record of %s stored within %s", s.path, selfTestTimeout)
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var sessions = SessionTable{mp: map[string]*Session{}}
+
+// Session is a time-bounded capture window. Records stored while it is active carry its id.
+type Session struct {
+	Id      string    `json:"id"`
+	Name    string    `json:"name"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Records int       `json:"records"`
+	Active  bool      `json:"active"`
+}
+
+// SessionTable save the capture sessions, keyed by id
+type SessionTable struct {
+	mp   map[string]*Session
+	lock sync.RWMutex
+}
+
+// Start opens a session for the given duration; only one session can be active at a time
+func (s *SessionTable) Start(name string, duration time.Duration) (Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if current := s.current(); current != nil {
+		return Session{}, fmt.Errorf("session %s is active until %s", current.Id, current.End.Format(time.RFC3339))
+	}
+
+	now := time.Now()
+	session := &Session{
+		Id:    fmt.Sprintf("%d", now.UnixNano()),
+		Name:  name,
+		Start: now,
+		End:   now.Add(duration),
+	}
+	s.mp[session.Id] = session
+	return *session, nil
+}
+
+// Stop ends a session before its deadline
+func (s *SessionTable) Stop(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.mp[id]
+	if !ok {
+		return errors.New("no such session")
+	}
+	if now := time.Now(); now.Before(session.End) {
+		session.End = now
+	}
+	return nil
+}
+
+// Track stamps a record with the active session, if any
+func (s *SessionTable) Track(md *model) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if current := s.current(); current != nil {
+		md.Session = current.Id
+		current.Records++
+	}
+}
+
+func (s *SessionTable) List() []Session {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	now := time.Now()
+	ret := make([]Session, 0, len(s.mp))
+	for _, v := range s.mp {
+		session := *v
+		session.Active = now.Before(session.End)
+		ret = append(ret, session)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Start.After(ret[j].Start)
+	})
+	return ret
+}
+
+func (s *SessionTable) current() *Session {
+	now := time.Now()
+	for _, v := range s.mp {
+		if !now.Before(v.Start) && now.Before(v.End) {
+			return v
+		}
+	}
+	return nil
+}
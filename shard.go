@@ -0,0 +1,171 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// Shard is the db of the records captured on an interface, with -n name=path,...
+type Shard struct {
+	Iface string
+	Path  string
+	db    *leveldb.DB
+	hosts *HostTable
+	save  chan model
+	edits chan tagEdit
+	// saved is closed once save is closed and its records stored
+	saved chan struct{}
+}
+
+// shards is empty unless -n maps interfaces to data paths, shardLinks maps the links
+// attached for a shard, its bond members included, to it
+var (
+	shards     []*Shard
+	shardLinks = map[string]*Shard{}
+	shardFlows = ShardFlowTable{mp: map[uint32]shardFlow{}}
+)
+
+// parseShards parses "eth0=./db-eth0,eth1=./db-eth1". A plain interface name is not
+// sharded and returns nil.
+func parseShards(s string) ([]*Shard, error) {
+	if !strings.Contains(s, "=") {
+		return nil, nil
+	}
+	var ret []*Shard
+	ifaces, paths := map[string]bool{}, map[string]bool{}
+	for _, part := range strings.Split(s, ",") {
+		iface, path, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || len(iface) == 0 || len(path) == 0 {
+			return nil, fmt.Errorf("bad interface %q, must be name=path", part)
+		}
+		if ifaces[iface] {
+			return nil, fmt.Errorf("interface %s is given twice", iface)
+		}
+		if paths[path] {
+			return nil, fmt.Errorf("data path %s is given to two interfaces", path)
+		}
+		ifaces[iface], paths[path] = true, true
+		ret = append(ret, &Shard{Iface: iface, Path: path})
+	}
+	return ret, nil
+}
+
+// shardOf returns the shard of an interface, or nil
+func shardOf(iface string) *Shard {
+	for _, v := range shards {
+		if v.Iface == iface {
+			return v
+		}
+	}
+	return nil
+}
+
+// openShards opens the db of every shard and starts storing its records
+func openShards(options *opt.Options) {
+	for _, shard := range shards {
+		db, err := leveldb.OpenFile(shard.Path, options)
+		if err != nil {
+			log.Fatalf("open data path of %s: %s", shard.Iface, err)
+		}
+		if err := migrate(db); err != nil {
+			log.Fatalf("migrate db of %s: %s", shard.Iface, err)
+		}
+		shard.db = db
+		shard.hosts = &HostTable{mp: map[string]*list.List{}, owner: map[string]*list.Element{}}
+		shard.save = make(chan model, 100)
+		shard.edits = make(chan tagEdit)
+		shard.saved = make(chan struct{})
+		go func(shard *Shard) {
+			SaveHttpData(shard.db, shard.hosts, shard.save, shard.edits)
+			close(shard.saved)
+		}(shard)
+	}
+}
+
+// RouteShards sends every record to the shard of the interface it was captured on. A
+// record whose flow was forgotten goes to the first shard. Once save is closed it closes
+// the queues of the shards and returns when their records are stored.
+func RouteShards(save <-chan model) {
+	for md := range save {
+		shard := shardOf(md.Interface)
+		if shard == nil {
+			shard = shards[0]
+		}
+		shard.save <- md
+	}
+	for _, shard := range shards {
+		close(shard.save)
+		<-shard.saved
+	}
+}
+
+type shardFlow struct {
+	iface string
+	seen  time.Time
+}
+
+// ShardFlowTable save the interface a flow was read on, keyed by flowHash, so that its
+// records are stored in the db of that interface
+type ShardFlowTable struct {
+	mp     map[uint32]shardFlow
+	pruned time.Time
+	lock   sync.Mutex
+}
+
+// Set records that the flow of data was read on link
+func (f *ShardFlowTable) Set(data []byte, link string) {
+	shard, ok := shardLinks[link]
+	if !ok {
+		return
+	}
+	h := flowHash(data)
+	now := time.Now()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if now.Sub(f.pruned) > ConnIdleTimeout {
+		for k, v := range f.mp {
+			if now.Sub(v.seen) > connRetention {
+				delete(f.mp, k)
+			}
+		}
+		f.pruned = now
+	}
+	f.mp[h] = shardFlow{iface: shard.Iface, seen: now}
+}
+
+// Get returns the interface the flow of data was read on
+func (f *ShardFlowTable) Get(data []byte) string {
+	h := flowHash(data)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.mp[h].iface
+}
+
+// sharded runs fn with the db of the interface of ?interface=, the first one by default
+func (h Handler) sharded(fn func(Handler, *gin.Context)) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		iface := ctx.Query("interface")
+		if len(iface) == 0 {
+			fn(h, ctx)
+			return
+		}
+		shard := shardOf(iface)
+		if shard == nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"msg": fmt.Sprintf("no data path for interface %s, run prism with -n %s=path", iface, iface),
+			})
+			return
+		}
+		fn(Handler{db: shard.db, hosts: shard.hosts, save: shard.save, edits: shard.edits}, ctx)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	sinkQueueSize  = 1000
+	sinkBackoffMin = 500 * time.Millisecond
+	sinkBackoffMax = 30 * time.Second
+
+	// webhookMaxAttempts is how many times a record is posted before it is dropped
+	webhookMaxAttempts = 5
+	// webhookBreakerFailures failed posts in a row open the circuit breaker, nothing is
+	// posted for webhookCooldown while the records queue up to sinkQueueSize
+	webhookBreakerFailures = 10
+	webhookCooldown        = time.Minute
+)
+
+// Sink receives every record after it has been stored
+type Sink interface {
+	Publish(md model)
+}
+
+var sinks []Sink
+
+// observers are the Sinks receiving every captured record before SaveHttpData filters it
+// by content type, body size or free disk, so that they count the records not stored too
+var observers []Sink
+
+func publish(md model) {
+	for _, s := range sinks {
+		s.Publish(md)
+	}
+}
+
+func observe(md model) {
+	for _, s := range observers {
+		s.Publish(md)
+	}
+}
+
+// jitteredBackoff returns the delay before the given retry attempt. The delay is drawn
+// uniformly up to an exponentially growing cap so that many prism instances losing the
+// same collector do not reconnect in lockstep.
+func jitteredBackoff(r *rand.Rand, attempt int) time.Duration {
+	ceiling := sinkBackoffMax
+	if attempt < 16 && sinkBackoffMin<<attempt < sinkBackoffMax {
+		ceiling = sinkBackoffMin << attempt
+	}
+	return sinkBackoffMin/2 + time.Duration(r.Int63n(int64(ceiling)))
+}
+
+// isErrorStatus reports whether a response status is a client or server error
+func isErrorStatus(status int) bool {
+	return status >= http.StatusBadRequest
+}
+
+// WebhookSink posts every record as JSON to an HTTP endpoint, or only the failed ones
+type WebhookSink struct {
+	url        string
+	errorsOnly bool
+	queue      chan model
+	client     *http.Client
+	rand       *rand.Rand
+	// failures is the number of failed posts in a row
+	failures int
+}
+
+func NewWebhookSink(url string, errorsOnly bool) *WebhookSink {
+	return &WebhookSink{
+		url:        url,
+		errorsOnly: errorsOnly,
+		queue:      make(chan model, sinkQueueSize),
+		client:     &http.Client{Timeout: 10 * time.Second},
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Publish queues a record, dropping it when the endpoint cannot keep up
+func (s *WebhookSink) Publish(md model) {
+	if s.errorsOnly && !isErrorStatus(md.ResponseStatus) {
+		return
+	}
+	select {
+	case s.queue <- md:
+	default:
+		rateLog.Printf("[ERROR] webhook queue full, drop record %s", md.Id)
+		drop(DropQueueFull, 1, "sink=webhook id=%s", md.Id)
+	}
+}
+
+// Run delivers the queued records until ctx is done
+func (s *WebhookSink) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case md := <-s.queue:
+			if !s.deliver(ctx, md) {
+				return
+			}
+		}
+	}
+}
+
+// deliver posts a record, retrying it with jittered backoff up to webhookMaxAttempts
+// times. A record the endpoint rejects is dropped at once, it would be rejected again.
+// It returns false once ctx is done.
+func (s *WebhookSink) deliver(ctx context.Context, md model) bool {
+	for attempt := 1; ; attempt++ {
+		permanent, err := s.post(ctx, md)
+		if err == nil {
+			s.failures = 0
+			return true
+		}
+		if permanent {
+			s.failures = 0
+			rateLog.Printf("[ERROR] webhook rejected record %s (%s), dropped", md.Id, err.Error())
+			drop(DropSinkError, 1, "sink=webhook id=%s error=%q", md.Id, err.Error())
+			return true
+		}
+
+		s.failures++
+		delay := jitteredBackoff(s.rand, attempt-1)
+		if s.failures >= webhookBreakerFailures {
+			rateLog.Printf("[ERROR] webhook failed %d times in a row (%s), paused for %s", s.failures, err.Error(), webhookCooldown)
+			// a failure after the cool-down opens the breaker again
+			delay, s.failures = webhookCooldown, webhookBreakerFailures-1
+		} else {
+			rateLog.Printf("[ERROR] webhook post (%s), retry in %s", err.Error(), delay)
+		}
+		if attempt == webhookMaxAttempts {
+			rateLog.Printf("[ERROR] webhook did not take record %s after %d attempts, dropped", md.Id, attempt)
+			drop(DropSinkError, 1, "sink=webhook id=%s attempts=%d", md.Id, attempt)
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		if attempt == webhookMaxAttempts {
+			return true
+		}
+	}
+}
+
+// post sends a record, permanent is set when the endpoint rejected it with a 4xx other
+// than 429 Too Many Requests
+func (s *WebhookSink) post(ctx context.Context, md model) (permanent bool, err error) {
+	byt, err := json.Marshal(md)
+	if err != nil {
+		return true, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(byt))
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set(ContentType, ContentTypeJSON)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		permanent = resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests
+		return permanent, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return false, nil
+}
+
+// StdoutSink prints every record to stdout, as a summary line, a line in an access log
+// template or a JSON line
+type StdoutSink struct {
+	format   string
+	template []accessLogField
+	lock     sync.Mutex
+}
+
+// NewStdoutSink prints the records in format, line or json; a line follows template when
+// it is not empty, a template of the -access-log-format directives
+func NewStdoutSink(format, template string) (*StdoutSink, error) {
+	if format != "line" && format != "json" {
+		return nil, fmt.Errorf("unknown stdout format %q, must be line or json", format)
+	}
+	s := &StdoutSink{format: format}
+	if len(template) > 0 {
+		if format != "line" {
+			return nil, fmt.Errorf("a stdout template needs the line format, not %q", format)
+		}
+		fields, err := parseAccessLogFormat(template)
+		if err != nil {
+			return nil, err
+		}
+		s.template = fields
+	}
+	return s, nil
+}
+
+func (s *StdoutSink) Publish(md model) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.format == "json" {
+		byt, err := json.Marshal(md)
+		if err != nil {
+			log.Printf("[ERROR] marshal error (%s)", err.Error())
+			return
+		}
+		fmt.Println(string(byt))
+		return
+	}
+	if s.template != nil {
+		fmt.Print(accessLogLine(s.template, md, time.Now()))
+		return
+	}
+
+	fmt.Printf("%s %s %s%s -> %d %dB %s\n", time.Now().Format(time.RFC3339), md.RequestMethod,
+		md.host(), md.RequestURL, md.ResponseStatus, md.ResponseBodySize, stdoutLatency(md))
+}
+
+// stdoutLatency is the time the response took, e.g. 23ms, "-" for the unpaired records
+func stdoutLatency(md model) string {
+	if md.Latency == 0 {
+		return "-"
+	}
+	latency := time.Duration(md.Latency) * time.Microsecond
+	if latency >= time.Millisecond {
+		latency = latency.Round(time.Millisecond)
+	}
+	return latency.String()
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	SnapshotNDJSON  = "ndjson"
+	SnapshotLevelDB = "leveldb"
+)
+
+// snapshotAuthorized checks the bearer token of a snapshot request in constant time
+func snapshotAuthorized(ctx *gin.Context) bool {
+	token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(SnapshotToken)) == 1
+}
+
+// tokenAuthorized answers the request itself unless it carries the -snapshot-token bearer
+// token, which the routes exporting or replaying the stored traffic require
+func tokenAuthorized(ctx *gin.Context, route string) bool {
+	if len(SnapshotToken) == 0 {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"msg": route + " is disabled, run prism with -snapshot-token",
+		})
+		return false
+	}
+	if !snapshotAuthorized(ctx) {
+		ctx.JSON(http.StatusUnauthorized, gin.H{
+			"msg": "missing or wrong bearer token",
+		})
+		return false
+	}
+	return true
+}
+
+// snapshot streams a point-in-time copy of the db while capture continues: every record
+// as a JSON line, or with ?format=leveldb a tar.gz of a db holding the same records
+func (h Handler) snapshot(ctx *gin.Context) {
+	if !tokenAuthorized(ctx, "snapshot") {
+		return
+	}
+
+	format := ctx.DefaultQuery("format", SnapshotNDJSON)
+	if format != SnapshotNDJSON && format != SnapshotLevelDB {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg": fmt.Sprintf("format must be %s or %s", SnapshotNDJSON, SnapshotLevelDB),
+		})
+		return
+	}
+
+	snap, err := h.db.GetSnapshot()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	defer snap.Release()
+	// the deduplicated bodies are in a db of their own, snapshotted right after the records
+	var bodySnap *leveldb.Snapshot
+	if bodies != nil {
+		if bodySnap, err = bodies.db.GetSnapshot(); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"msg": err.Error(),
+			})
+			return
+		}
+		defer bodySnap.Release()
+	}
+
+	name := "prism-" + time.Now().Format("20060102-150405")
+	if format == SnapshotNDJSON {
+		ctx.Header("Content-Type", "application/x-ndjson")
+		ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.ndjson", name))
+		ctx.Status(http.StatusOK)
+
+		if err := writeSnapshotNDJSON(ctx.Writer, snap); err != nil {
+			log.Printf("[ERROR] snapshot iter error (%s)", err.Error())
+		}
+		return
+	}
+
+	// the live files keep changing, so the snapshot is copied to a db of its own first, under
+	// the data path rather than a tmpfs that may not hold it
+	if err := os.MkdirAll(DataPath, 0755); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	dir, err := os.MkdirTemp(DataPath, "snapshot-")
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	defer os.RemoveAll(dir)
+	if err := copySnapshot(snap, bodySnap, dir); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+
+	ctx.Header("Content-Type", "application/gzip")
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.tar.gz", name))
+	ctx.Status(http.StatusOK)
+	if err := writeTarGz(ctx.Writer, dir, name); err != nil {
+		log.Printf("[ERROR] snapshot archive error (%s)", err.Error())
+	}
+}
+
+// writeSnapshotNDJSON writes the records of a snapshot as JSON lines, with the bodies
+// deduplicated or moved to blob files put back. It stops at the first write error.
+func writeSnapshotNDJSON(w io.Writer, snap *leveldb.Snapshot) error {
+	enc := json.NewEncoder(w)
+	iter := snap.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		md := model{}
+		if err := decodeRecord(iter.Value(), &md); err != nil {
+			log.Printf("[ERROR] decode record error (%s)", err.Error())
+			continue
+		}
+		if err := resolveBodies(&md); err != nil {
+			rateLog.Printf("[ERROR] snapshot record %s body error (%s)", iter.Key(), err.Error())
+		}
+		if err := resolveBlobs(&md); err != nil {
+			rateLog.Printf("[ERROR] snapshot record %s blob error (%s)", iter.Key(), err.Error())
+		}
+		if err := enc.Encode(md); err != nil {
+			return nil
+		}
+	}
+	return iter.Error()
+}
+
+// copySnapshot lays out in dir a data path holding the records of a snapshot, as stored:
+// the db itself, the deduplicated bodies of bodySnap under bodies/ unless it is nil, and
+// the blob files the records reference under blobs/
+func copySnapshot(snap, bodySnap *leveldb.Snapshot, dir string) error {
+	blobs := map[string]struct{}{}
+	err := copyLevelDB(snap, dir, func(value []byte) {
+		md := model{}
+		if err := decodeRecord(value, &md); err != nil {
+			return
+		}
+		for _, v := range []string{md.RequestBodyBlob, md.ResponseBodyBlob} {
+			if len(v) > 0 {
+				blobs[v] = struct{}{}
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if bodySnap != nil {
+		if err := copyLevelDB(bodySnap, filepath.Join(dir, "bodies"), nil); err != nil {
+			return err
+		}
+	}
+
+	if len(blobs) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0750); err != nil {
+		return err
+	}
+	for hash := range blobs {
+		if err := linkFile(filepath.Join(blobDir(), hash), filepath.Join(dir, "blobs", hash)); err != nil {
+			// a blob released since the snapshot was taken is gone with its last record
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// copyLevelDB writes every key of a snapshot to a new db in dir, calling visit, unless
+// nil, with each value
+func copyLevelDB(snap *leveldb.Snapshot, dir string, visit func(value []byte)) error {
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	batch := new(leveldb.Batch)
+	iter := snap.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if visit != nil {
+			visit(iter.Value())
+		}
+		batch.Put(append([]byte(nil), iter.Key()...), append([]byte(nil), iter.Value()...))
+		if batch.Len() >= 1000 {
+			if err := db.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return db.Write(batch, nil)
+}
+
+// linkFile hard links src to dst, so that the copy survives src being deleted, and copies
+// it when they are on different file systems
+func linkFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil || errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeTarGz archives the files of dir and of its subdirectories under prefix
+func writeTarGz(w io.Writer, dir, prefix string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = prefix + "/" + filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+const (
+	// MethodTLS stands for the method of the records of TLS connections, which only carry the SNI
+	MethodTLS = "TLS"
+	TagTLS    = "tls"
+
+	tlsRecordHandshake  = 0x16
+	tlsClientHello      = 0x01
+	tlsExtServerName    = 0x0000
+	tlsServerNameDomain = 0x00
+)
+
+// TLSInfo is what a ClientHello tells of an encrypted connection without decrypting it
+type TLSInfo struct {
+	SNI     string `json:"sni"`
+	Version string `json:"version"`
+	// QUIC is set for the handshakes of HTTP/3 connections
+	QUIC bool `json:"quic,omitempty"`
+}
+
+// isClientHello reports whether payload starts with a TLS handshake record holding a ClientHello
+func isClientHello(payload []byte) bool {
+	return len(payload) >= 6 && payload[0] == tlsRecordHandshake && payload[1] == 3 && payload[5] == tlsClientHello
+}
+
+// parseClientHello returns the server name and client version of a ClientHello. The
+// name is empty when the client sent none, e.g. to an IP address.
+func parseClientHello(payload []byte) (*TLSInfo, error) {
+	if !isClientHello(payload) {
+		return nil, fmt.Errorf("not a tls client hello")
+	}
+	// record header (5), handshake type (1), length (3), client version (2), random (32)
+	b := payload[5+4:]
+	if len(b) < 2+32+1 {
+		return nil, fmt.Errorf("tls client hello: truncated")
+	}
+	info := &TLSInfo{Version: tlsVersion(binary.BigEndian.Uint16(b))}
+	b = b[2+32:]
+
+	// session id, cipher suites and compression methods
+	for _, size := range []int{1, 2, 1} {
+		if len(b) < size {
+			return nil, fmt.Errorf("tls client hello: truncated")
+		}
+		n := int(b[0])
+		if size == 2 {
+			n = int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < size+n {
+			return nil, fmt.Errorf("tls client hello: truncated")
+		}
+		b = b[size+n:]
+	}
+
+	// a ClientHello without extensions has no SNI
+	if len(b) < 2 {
+		return info, nil
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) > n {
+		b = b[:n]
+	}
+	for len(b) >= 4 {
+		typ := binary.BigEndian.Uint16(b)
+		size := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+size {
+			return nil, fmt.Errorf("tls client hello: truncated extension")
+		}
+		ext := b[4 : 4+size]
+		b = b[4+size:]
+		if typ != tlsExtServerName || len(ext) < 2 {
+			continue
+		}
+
+		// server name list: type (1), length (2), name
+		list := ext[2:]
+		for len(list) >= 3 {
+			nameType := list[0]
+			nameLen := int(binary.BigEndian.Uint16(list[1:]))
+			if len(list) < 3+nameLen {
+				break
+			}
+			if nameType == tlsServerNameDomain {
+				info.SNI = strings.ToLower(string(list[3 : 3+nameLen]))
+				return info, nil
+			}
+			list = list[3+nameLen:]
+		}
+	}
+	return info, nil
+}
+
+func tlsVersion(v uint16) string {
+	switch v {
+	case 0x0300:
+		return "SSL 3.0"
+	case 0x0301:
+		return "TLS 1.0"
+	case 0x0302:
+		return "TLS 1.1"
+	case 0x0303:
+		return "TLS 1.2"
+	case 0x0304:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// tlsRecord is the record of a TLS connection, stored for its ClientHello, or of an
+// HTTP/3 connection for the ClientHello of its QUIC handshake
+func tlsRecord(hello FlyHttp) model {
+	md := model{
+		SchemaVersion:   schemaVersion,
+		IPFamily:        hello.Family,
+		RequestSrcMAC:   hello.SrcMAC,
+		RequestDstMAC:   hello.DstMAC,
+		RequestSrcIP:    hello.SrcIP,
+		RequestDstIP:    hello.DstIP,
+		RequestSrcPort:  hello.SrcPort,
+		RequestDstPort:  hello.DstPort,
+		RequestMethod:   MethodTLS,
+		RequestHost:     hello.Data.TLS.SNI,
+		RequestSize:     hello.Size,
+		Retransmissions: hello.Retransmits,
+		Reset:           hello.RST,
+		TLS:             hello.Data.TLS,
+		Tag:             []string{TagTLS},
+		Interface:       hello.Iface,
+		CapturedAt:      int(hello.CreateTime.Unix()),
+	}
+	if len(md.RequestHost) == 0 {
+		md.RequestHost = requestHost(nil, &url.URL{}, hello.DstIP, hello.DstPort)
+	}
+	if keyPerExchange() {
+		md.Id = contentID(&md, []uint32{hello.Seq})
+	}
+	if md.TLS.QUIC {
+		md.RequestMethod, md.Tag = MethodQUIC, []string{TagQUIC}
+		if Verbose {
+			log.Printf("[PRISM] HTTP/3 (QUIC) connection to %s", md.RequestHost)
+		}
+		return md
+	}
+	if Verbose {
+		log.Printf("[PRISM] TLS connection to %s", md.RequestHost)
+	}
+	return md
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// spills is set with -spill-dir, nil keeps every buffered body in memory
+var spills *SpillStore
+
+// spillQueueLen is how many bodies wait for the spill writer, the next ones stay in memory
+const spillQueueLen = 256
+
+type spillFile struct {
+	size    int64
+	created time.Time
+}
+
+// SpillStore save the bodies of in-flight messages in files of a temporary directory while
+// the connection table buffers more than -spill-high-water, at most limit bytes on disk.
+// The files are written by a goroutine of their own, so that the connection table does no
+// file I/O under its lock; a body waits in pending until its file is written. A body is
+// read back and its file removed when its message is paired.
+type SpillStore struct {
+	dir     string
+	limit   int64
+	used    int64
+	next    uint64
+	files   map[string]spillFile
+	pending map[string][]byte
+	queue   chan string
+	written chan struct{}
+	closed  bool
+	lock    sync.Mutex
+}
+
+// NewSpillStore creates a spill area under dir, limit 0 is unlimited
+func NewSpillStore(dir string, limit int64) (*SpillStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp(dir, "prism-spill-")
+	if err != nil {
+		return nil, err
+	}
+	s := &SpillStore{
+		dir:     tmp,
+		limit:   limit,
+		files:   map[string]spillFile{},
+		pending: map[string][]byte{},
+		queue:   make(chan string, spillQueueLen),
+		written: make(chan struct{}),
+	}
+	go s.write()
+	return s, nil
+}
+
+// Put hands a body to the writer and returns the name of its spill file, or "" when the
+// spill area or the queue of the writer is full
+func (s *SpillStore) Put(body []byte) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	size := int64(len(body))
+	if s.closed || (s.limit > 0 && s.used+size > s.limit) {
+		return ""
+	}
+
+	name := fmt.Sprintf("%016x", s.next+1)
+	select {
+	case s.queue <- name:
+	default:
+		return ""
+	}
+	s.next++
+	s.pending[name] = body
+	s.files[name] = spillFile{size: size, created: time.Now()}
+	s.used += size
+	stats.Set(StatSpilledBytes, s.used)
+	return name
+}
+
+// write writes the files of the queued bodies. A body removed before its file is written
+// has its file removed right after, one that fails to be written stays in memory.
+func (s *SpillStore) write() {
+	defer close(s.written)
+	for name := range s.queue {
+		s.lock.Lock()
+		body, ok := s.pending[name]
+		s.lock.Unlock()
+		if !ok {
+			continue
+		}
+
+		path := filepath.Join(s.dir, name)
+		err := os.WriteFile(path, body, 0600)
+		s.lock.Lock()
+		if _, ok := s.pending[name]; !ok {
+			os.Remove(path)
+		} else if err != nil {
+			rateLog.Printf("[ERROR] spill body (%s)", err.Error())
+		} else {
+			delete(s.pending, name)
+		}
+		s.lock.Unlock()
+	}
+}
+
+// Peek reads a spilled body, keeping its file
+func (s *SpillStore) Peek(name string) ([]byte, error) {
+	s.lock.Lock()
+	body, ok := s.pending[name]
+	s.lock.Unlock()
+	if ok {
+		return body, nil
+	}
+	return os.ReadFile(filepath.Join(s.dir, name))
+}
+
+// Take reads a spilled body back and removes its file
+func (s *SpillStore) Take(name string) ([]byte, error) {
+	body, err := s.Peek(name)
+	s.remove(name)
+	return body, err
+}
+
+func (s *SpillStore) remove(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f, ok := s.files[name]
+	if !ok {
+		return
+	}
+	// the writer removes the file of a pending body once written
+	if _, ok := s.pending[name]; ok {
+		delete(s.pending, name)
+	} else {
+		os.Remove(filepath.Join(s.dir, name))
+	}
+	delete(s.files, name)
+	s.used -= f.size
+	stats.Set(StatSpilledBytes, s.used)
+}
+
+// Prune removes the files of the messages dropped without being paired, older than maxAge
+func (s *SpillStore) Prune(maxAge time.Duration) {
+	s.lock.Lock()
+	var stale []string
+	for name, f := range s.files {
+		if time.Since(f.created) > maxAge {
+			stale = append(stale, name)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, name := range stale {
+		s.remove(name)
+	}
+}
+
+// Close stops the writer and removes the spill area
+func (s *SpillStore) Close() error {
+	s.lock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.files, s.pending = map[string]spillFile{}, map[string][]byte{}
+	s.used = 0
+	s.lock.Unlock()
+
+	<-s.written
+	return os.RemoveAll(s.dir)
+}
+
+// bodyLen is the length of the body of a segment, spilled or not
+func (f *FlyHttp) bodyLen() int {
+	if len(f.Spill) > 0 {
+		return f.SpillLen
+	}
+	return len(f.Data.Body)
+}
+
+// body returns the body of a segment, reading it from the spill area if needed
+func (f *FlyHttp) body() []byte {
+	if len(f.Spill) == 0 {
+		return f.Data.Body
+	}
+	body, err := spills.Peek(f.Spill)
+	if err != nil {
+		log.Printf("[ERROR] read spilled body (%s)", err.Error())
+	}
+	return body
+}
+
+// spill moves the body of a segment to the spill area, it returns the bytes freed
+func (f *FlyHttp) spill() int {
+	if len(f.Spill) > 0 || len(f.Data.Body) == 0 {
+		return 0
+	}
+	name := spills.Put(f.Data.Body)
+	if len(name) == 0 {
+		return 0
+	}
+
+	size := len(f.Data.Body)
+	f.Spill, f.SpillLen, f.Data.Body = name, size, nil
+	return size
+}
+
+// unspill reads the body of a segment back into memory
+func (f *FlyHttp) unspill() {
+	if len(f.Spill) == 0 {
+		return
+	}
+	body, err := spills.Take(f.Spill)
+	if err != nil {
+		log.Printf("[ERROR] read spilled body (%s)", err.Error())
+	}
+	f.Data.Body, f.Spill, f.SpillLen = body, "", 0
+}
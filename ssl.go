@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// SSLCaptureName is the capture of the -tls uprobes in /captures and the records
+	SSLCaptureName = "openssl"
+
+	// sslEventData is MAX_DATA_SIZE of ssl_uprobe.c
+	sslEventData = 1024 * 4
+	// sslEventHeader is the size of the fields before data in struct ssl_data_event
+	sslEventHeader = 28
+
+	sslOpWrite = 0
+	sslOpRead  = 1
+
+	// sslServerPort is the port of the server side of the synthetic connections
+	sslServerPort = 443
+)
+
+// libSSLDirs are searched for libssl when -libssl is not given
+var libSSLDirs = []string{
+	"/usr/lib/x86_64-linux-gnu", "/lib/x86_64-linux-gnu",
+	"/usr/lib/aarch64-linux-gnu", "/lib/aarch64-linux-gnu",
+	"/usr/lib64", "/lib64", "/usr/lib", "/lib",
+}
+
+// the synthetic addresses of the client and the server of the connections read by -tls
+var (
+	sslClientIP = []byte{127, 0, 0, 1}
+	sslServerIP = []byte{127, 0, 0, 2}
+)
+
+var sslConns = SSLConnTable{mp: map[sslConnKey]*sslConn{}}
+
+// sslDataEvent is a decoded ssl_data_event, Data refers to the raw record. Data is the
+// chunk at Offset of a buffer of MaxLen bytes.
+type sslDataEvent struct {
+	SSL    uint64
+	Pid    uint32
+	Op     uint32
+	MaxLen uint32
+	Offset uint32
+	Data   []byte
+}
+
+// decodeSSLEvent decodes a ring buffer record of the uprobes
+func decodeSSLEvent(raw []byte) (sslDataEvent, error) {
+	if len(raw) < sslEventHeader+sslEventData {
+		return sslDataEvent{}, fmt.Errorf("ssl event record is %d bytes, expected %d", len(raw), sslEventHeader+sslEventData)
+	}
+	size := binary.LittleEndian.Uint32(raw[16:])
+	if size > sslEventData {
+		return sslDataEvent{}, fmt.Errorf("ssl event data_len %d exceeds %d bytes", size, sslEventData)
+	}
+	maxLen, offset := binary.LittleEndian.Uint32(raw[20:]), binary.LittleEndian.Uint32(raw[24:])
+	if uint64(offset)+uint64(size) > uint64(maxLen) {
+		return sslDataEvent{}, fmt.Errorf("ssl event chunk at %d of %d bytes exceeds the %d bytes buffer", offset, size, maxLen)
+	}
+	return sslDataEvent{
+		SSL:    binary.LittleEndian.Uint64(raw),
+		Pid:    binary.LittleEndian.Uint32(raw[8:]),
+		Op:     binary.LittleEndian.Uint32(raw[12:]),
+		MaxLen: maxLen,
+		Offset: offset,
+		Data:   raw[sslEventHeader : sslEventHeader+size],
+	}, nil
+}
+
+// findLibSSL returns -libssl, or the libssl shared library found in libSSLDirs, the
+// highest version first
+func findLibSSL() (string, error) {
+	if len(LibSSLPath) > 0 {
+		return LibSSLPath, nil
+	}
+	for _, dir := range libSSLDirs {
+		matches, _ := filepath.Glob(filepath.Join(dir, "libssl.so*"))
+		if len(matches) == 0 {
+			continue
+		}
+		sort.Strings(matches)
+		return matches[len(matches)-1], nil
+	}
+	return "", errors.New("no libssl found, set its path with -libssl")
+}
+
+// attachSSL attaches the uprobes to SSL_write and SSL_read of libssl and queues the
+// buffers they read, in clear text, as the packets of synthetic tcp connections
+func attachSSL(ctx context.Context, queueTask chan<- []byte) error {
+	if captureMode.Mode != ModeRingBuf {
+		return fmt.Errorf("capturing TLS requires a kernel >= %s", maxKernelVer)
+	}
+	path, err := findLibSSL()
+	if err != nil {
+		return err
+	}
+	ex, err := link.OpenExecutable(path)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", path, err)
+	}
+
+	objs := sslObjects{}
+	if err := loadSslObjects(&objs, nil); err != nil {
+		log.Fatalf("loading objects: %s", err)
+	}
+	defer objs.Close()
+
+	probes := []struct {
+		symbol string
+		prog   *ebpf.Program
+		ret    bool
+	}{
+		{"SSL_write", objs.ProbeSslWriteEntry, false},
+		{"SSL_write", objs.ProbeSslWriteReturn, true},
+		{"SSL_read", objs.ProbeSslReadEntry, false},
+		{"SSL_read", objs.ProbeSslReadReturn, true},
+	}
+	for _, v := range probes {
+		attach := ex.Uprobe
+		if v.ret {
+			attach = ex.Uretprobe
+		}
+		l, err := attach(v.symbol, v.prog, nil)
+		if err != nil {
+			return fmt.Errorf("attach uprobe to %s of %s: %w", v.symbol, path, err)
+		}
+		defer l.Close()
+	}
+
+	captures.Add(SSLCaptureName, 0)
+	bpfObjects.Add(SSLCaptureName, map[string]*ebpf.Map{
+		"ssl_events":    objs.SslEvents,
+		"active_reads":  objs.ActiveReads,
+		"active_writes": objs.ActiveWrites,
+	}, map[string]*ebpf.Program{
+		"probe_ssl_write_entry":  objs.ProbeSslWriteEntry,
+		"probe_ssl_write_return": objs.ProbeSslWriteReturn,
+		"probe_ssl_read_entry":   objs.ProbeSslReadEntry,
+		"probe_ssl_read_return":  objs.ProbeSslReadReturn,
+	})
+	captures.SetAttach(SSLCaptureName, "uprobe", "uprobe")
+	log.Printf("[PRISM] capturing TLS in clear text from %s", path)
+
+	rd, err := ringbuf.NewReader(objs.SslEvents)
+	if err != nil {
+		log.Fatalf("opening ringbuf reader: %s", err)
+	}
+	go func() {
+		<-ctx.Done()
+		if err := rd.Close(); err != nil {
+			log.Fatalf("closing ssl ringbuf reader: %s", err)
+		}
+	}()
+
+	runSSL(queueTask, rd)
+	return nil
+}
+
+func runSSL(queueTask chan<- []byte, rd *ringbuf.Reader) {
+	for {
+		record, err := rd.Read()
+		if err != nil {
+			if errors.Is(err, perf.ErrClosed) {
+				return
+			}
+			rateLog.Printf("reading from ssl ringbuf reader: %s", err)
+			continue
+		}
+
+		event, err := decodeSSLEvent(record.RawSample)
+		if err != nil {
+			rateLog.Printf("parsing ssl event: %s", err)
+			drop(DropDecodeError, 1, "iface=%s err=%q", SSLCaptureName, err)
+			continue
+		}
+		stats.Add(StatEvents, 1)
+
+		captures.Touch(SSLCaptureName)
+		if !captures.Enabled(SSLCaptureName) {
+			drop(DropCaptureDisabled, 1, "iface=%s", SSLCaptureName)
+			continue
+		}
+
+		if data, ok := acceptEvent(SSLCaptureName, sslConns.Frame(event)); ok {
+			queueTask <- data
+		}
+	}
+}
+
+// sslConnKey is an SSL object of a process, the SSL pointers of different processes
+// may be equal
+type sslConnKey struct {
+	pid uint32
+	ssl uint64
+}
+
+// sslConn is the synthetic tcp connection of an SSL object, its client being the side
+// that wrote first
+type sslConn struct {
+	port         uint16
+	clientWrites bool
+	// seq is the next sequence number of the client and of the server, start the one of
+	// the buffer their last chunk is of
+	seq   [2]uint32
+	start [2]uint32
+	seen  time.Time
+}
+
+// SSLConnTable save the synthetic connections of the SSL objects, keyed by pid and SSL
+// pointer, so that their buffers are parsed as tcp streams
+type SSLConnTable struct {
+	mp       map[sslConnKey]*sslConn
+	nextPort uint16
+	pruned   time.Time
+	lock     sync.Mutex
+}
+
+// Frame returns the ethernet/ipv4/tcp packet carrying the buffer of an event. The first
+// event of an SSL object opens its connection, whose SYN is passed to newConnections.
+func (s *SSLConnTable) Frame(event sslDataEvent) []byte {
+	key := sslConnKey{pid: event.Pid, ssl: event.SSL}
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if now.Sub(s.pruned) > ConnIdleTimeout {
+		for k, v := range s.mp {
+			if now.Sub(v.seen) > ConnIdleTimeout {
+				delete(s.mp, k)
+			}
+		}
+		s.pruned = now
+	}
+
+	conn, ok := s.mp[key]
+	if !ok {
+		// the ephemeral ports are reused once they wrapped
+		if s.nextPort < 1024 {
+			s.nextPort = 1024
+		}
+		conn = &sslConn{port: s.nextPort, clientWrites: event.Op == sslOpWrite, seq: [2]uint32{1, 1}}
+		s.nextPort++
+		s.mp[key] = conn
+		newConnections.Accept(SSLCaptureName, sslFrame(conn.port, true, 0, 0, nil))
+	}
+	conn.seen = now
+
+	fromClient := (event.Op == sslOpWrite) == conn.clientWrites
+	dir := 0
+	if !fromClient {
+		dir = 1
+	}
+	// the whole buffer takes its sequence numbers, the bytes past the chunks the uprobes
+	// send are missing from the stream as a lost segment would be
+	if event.Offset == 0 {
+		conn.start[dir] = conn.seq[dir]
+		conn.seq[dir] += event.MaxLen
+	}
+	return sslFrame(conn.port, fromClient, conn.start[dir]+event.Offset, conn.seq[1-dir], event.Data)
+}
+
+// sslFrame builds a packet of the synthetic connection on port, from the client or
+// from the server. A nil payload makes it the SYN of the client.
+func sslFrame(port uint16, fromClient bool, seq, ack uint32, payload []byte) []byte {
+	const ethLen, ipLen, tcpLen = 14, 20, 20
+	frame := make([]byte, ethLen+ipLen+tcpLen, ethLen+ipLen+tcpLen+len(payload))
+	binary.BigEndian.PutUint16(frame[12:], uint16(layers.EthernetTypeIPv4))
+
+	ip := frame[ethLen:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(ipLen+tcpLen+len(payload)))
+	ip[8] = 64
+	ip[9] = byte(layers.IPProtocolTCP)
+	src, dst := sslClientIP, sslServerIP
+	srcPort, dstPort := port, uint16(sslServerPort)
+	if !fromClient {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+	copy(ip[12:], src)
+	copy(ip[16:], dst)
+
+	tcp := frame[ethLen+ipLen:]
+	binary.BigEndian.PutUint16(tcp, srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = tcpLen / 4 << 4
+	tcp[13] = tcpFlagSyn
+	if payload != nil {
+		// PSH|ACK
+		tcp[13] = 0x18
+	}
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	return append(frame, payload...)
+}
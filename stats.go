@@ -0,0 +1,102 @@
+package main
+
+import "sync"
+
+var stats = StatsTable{mp: map[string]int64{}}
+
+const (
+	// StatEvents counts the events read from the eBPF programs or a capture file
+	StatEvents = "events_read"
+	// StatParsed counts the events parsed into a segment
+	StatParsed = "events_parsed"
+	// StatSaved counts the records written to the db
+	StatSaved = "records_saved"
+	// StatDiskLow is 1 while storage is suspended because the disk is almost full
+	StatDiskLow = "disk_low"
+	// StatTrackedConnections is the number of connections with messages being paired
+	StatTrackedConnections = "tracked_connections"
+	// StatEvictedConnections counts the connections evicted above -max-connections
+	StatEvictedConnections = "evicted_connections"
+	// StatEvictedEndpoints counts the endpoints whose call count was forgotten above -max-endpoints
+	StatEvictedEndpoints = "evicted_endpoints"
+	// StatPaired counts the requests paired with their response
+	StatPaired = "records_paired"
+	// StatRequestOnly counts the requests stored without a response
+	StatRequestOnly = "records_request_only"
+	// StatResponseOnly counts the responses stored without a request
+	StatResponseOnly = "records_response_only"
+	// StatAnomalousMethods counts the requests whose method is not a standard HTTP method
+	StatAnomalousMethods = "anomalous_methods"
+	// StatDedupedBytes counts the body bytes not stored again thanks to -dedupe-threshold
+	StatDedupedBytes = "bytes_saved_dedupe"
+	// StatBufferedBytes is the size of the bodies buffered in memory until they are paired
+	StatBufferedBytes = "bytes_buffered"
+	// StatSpilledBytes is the size of the buffered bodies moved to -spill-dir
+	StatSpilledBytes = "bytes_spilled"
+	// StatCompressedBytes counts the body bytes saved by -compress-bodies
+	StatCompressedBytes = "bytes_saved_compression"
+)
+
+// the counters of every ip family, named by familyStat
+const (
+	// StatFamilySegments counts the segments parsed
+	StatFamilySegments = "segments"
+	// StatFamilyBytes counts the payload bytes of the segments parsed
+	StatFamilyBytes = "bytes"
+	// StatFamilyRecords counts the records paired, stored or not
+	StatFamilyRecords = "records"
+)
+
+// familyStat names a counter of an ip family, e.g. ipv6_segments
+func familyStat(family, name string) string {
+	return family + "_" + name
+}
+
+// StatsTable save the pipeline counters and gauges, keyed by name
+type StatsTable struct {
+	mp   map[string]int64
+	lock sync.RWMutex
+}
+
+func (s *StatsTable) Add(name string, n int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.mp[name] += n
+}
+
+func (s *StatsTable) Set(name string, v int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.mp[name] = v
+}
+
+func (s *StatsTable) Get(name string) int64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.mp[name]
+}
+
+func (s *StatsTable) List() map[string]int64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ret := make(map[string]int64, len(s.mp))
+	for k, v := range s.mp {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Families breaks the segments, bytes and records down by ip family, both families being
+// listed even without traffic
+func (s *StatsTable) Families() map[string]map[string]int64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ret := map[string]map[string]int64{}
+	for _, family := range []string{FamilyIPv4, FamilyIPv6} {
+		ret[family] = map[string]int64{}
+		for _, name := range []string{StatFamilySegments, StatFamilyBytes, StatFamilyRecords} {
+			ret[family][name] = s.mp[familyStat(family, name)]
+		}
+	}
+	return ret
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsColumns are the counters of a -stats-csv row after the time, fixed so that the rows
+// appended by later runs line up with the header
+var statsColumns = []string{
+	StatEvents,
+	StatParsed,
+	"dropped",
+	StatPaired,
+	StatRequestOnly,
+	StatResponseOnly,
+	StatAnomalousMethods,
+	StatSaved,
+	StatTrackedConnections,
+	StatEvictedConnections,
+	StatEvictedEndpoints,
+	StatBufferedBytes,
+	StatSpilledBytes,
+	StatDiskLow,
+	"db_bytes",
+}
+
+// WriteStatsCSV appends a row of the counters to path every interval until ctx is done,
+// the header is written when the file is new or empty
+func WriteStatsCSV(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := appendStatsRow(path, now); err != nil {
+				log.Printf("[ERROR] write stats csv %s (%s)", path, err.Error())
+			}
+		}
+	}
+}
+
+func appendStatsRow(path string, now time.Time) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(f)
+	if info.Size() == 0 {
+		if err := w.Write(append([]string{"time"}, statsColumns...)); err != nil {
+			return err
+		}
+	}
+	w.Write(statsRow(now))
+	w.Flush()
+	return w.Error()
+}
+
+func statsRow(now time.Time) []string {
+	all := stats.List()
+	var dropped int64
+	for k, v := range all {
+		if strings.HasPrefix(k, dropStatPrefix) {
+			dropped += v
+		}
+	}
+
+	row := []string{now.Format(time.RFC3339)}
+	for _, name := range statsColumns {
+		var v int64
+		switch name {
+		case "dropped":
+			v = dropped
+		case "db_bytes":
+			v = dbSize()
+		default:
+			v = all[name]
+		}
+		row = append(row, strconv.FormatInt(v, 10))
+	}
+	return row
+}
+
+// dbSize returns the size of the db, of every db with -n name=path,...
+func dbSize() int64 {
+	if NoDB {
+		return 0
+	}
+	if len(shards) == 0 {
+		return dirSize(DataPath)
+	}
+	var size int64
+	for _, v := range shards {
+		size += dirSize(v.Path)
+	}
+	return size
+}
+
+// dirSize returns the size of the files under dir, the files removed meanwhile by a
+// compaction are skipped
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SummaryText = "text"
+	SummaryJSON = "json"
+	SummaryNone = "none"
+
+	// summaryHosts is the number of hosts listed in the summary
+	summaryHosts = 5
+)
+
+// Summary is what a capture yielded, printed when prism exits
+type Summary struct {
+	Start    time.Time        `json:"start"`
+	Duration string           `json:"duration"`
+	Events   int64            `json:"events"`
+	Parsed   int64            `json:"parsed"`
+	Dropped  map[string]int64 `json:"dropped"`
+	Records  int64            `json:"records"`
+	DBBytes  int64            `json:"db_bytes"`
+	TopHosts []HostCalls      `json:"top_hosts"`
+}
+
+// HostCalls is the number of calls captured to a host
+type HostCalls struct {
+	Host  string `json:"host"`
+	Calls int    `json:"calls"`
+}
+
+func buildSummary(start time.Time) Summary {
+	all := stats.List()
+	ret := Summary{
+		Start:    start,
+		Duration: time.Since(start).Round(time.Second).String(),
+		Events:   all[StatEvents],
+		Parsed:   all[StatParsed],
+		Dropped:  map[string]int64{},
+		Records:  all[StatSaved],
+		DBBytes:  dbSize(),
+	}
+	for k, v := range all {
+		if strings.HasPrefix(k, dropStatPrefix) && v > 0 {
+			ret.Dropped[strings.TrimPrefix(k, dropStatPrefix)] = v
+		}
+	}
+
+	// the calls captured since start, not the records the db held before
+	hosts := map[string]int{}
+	for _, v := range endpoints.List() {
+		hosts[v.Host] += v.Count
+	}
+	for host, n := range hosts {
+		ret.TopHosts = append(ret.TopHosts, HostCalls{Host: host, Calls: n})
+	}
+	sort.Slice(ret.TopHosts, func(i, j int) bool {
+		if ret.TopHosts[i].Calls != ret.TopHosts[j].Calls {
+			return ret.TopHosts[i].Calls > ret.TopHosts[j].Calls
+		}
+		return ret.TopHosts[i].Host < ret.TopHosts[j].Host
+	})
+	if len(ret.TopHosts) > summaryHosts {
+		ret.TopHosts = ret.TopHosts[:summaryHosts]
+	}
+	return ret
+}
+
+// printSummary logs the summary of the capture started at start, or with -summary json
+// writes it to stdout as a single JSON object
+func printSummary(start time.Time, format string) {
+	summary := buildSummary(start)
+	switch format {
+	case SummaryNone:
+	case SummaryJSON:
+		byt, err := json.Marshal(summary)
+		if err != nil {
+			log.Printf("[ERROR] marshal summary (%s)", err.Error())
+			return
+		}
+		fmt.Fprintln(os.Stdout, string(byt))
+	default:
+		var dropped []string
+		for k, v := range summary.Dropped {
+			dropped = append(dropped, fmt.Sprintf("%s=%d", k, v))
+		}
+		sort.Strings(dropped)
+		var hosts []string
+		for _, v := range summary.TopHosts {
+			hosts = append(hosts, fmt.Sprintf("%s (%d)", v.Host, v.Calls))
+		}
+
+		log.Printf("[PRISM] captured for %s since %s", summary.Duration, summary.Start.Format(time.RFC3339))
+		log.Printf("[PRISM]   events:  %d read, %d parsed", summary.Events, summary.Parsed)
+		log.Printf("[PRISM]   dropped: %s", joinOrNone(dropped))
+		log.Printf("[PRISM]   records: %d stored, db %d KiB", summary.Records, summary.DBBytes>>10)
+		log.Printf("[PRISM]   hosts:   %s", joinOrNone(hosts))
+	}
+}
+
+func joinOrNone(list []string) string {
+	if len(list) == 0 {
+		return "none"
+	}
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// systemTags are set by prism from what was captured, they cannot be added or removed
+// through the API
+var systemTags = []string{
+	XForwardedFor, TagUnknownMethod, TagRetransmission, TagReset, TagTunnel,
+	TagQUIC, TagTLS, TagGrpc, TagReplay,
+}
+
+// tagEdit adds and removes the tags of a stored record. It is applied by the save
+// goroutine of the db, so that it never races with a record overwriting the same key.
+type tagEdit struct {
+	id     string
+	add    []string
+	remove []string
+	// done receives the tags of the record once edited
+	done chan tagResult
+}
+
+type tagResult struct {
+	tags []string
+	err  error
+}
+
+// checkTags returns an error if a tag is empty, holds a comma or is a system tag
+func checkTags(tags []string) error {
+	for _, tag := range tags {
+		if len(tag) == 0 || strings.Contains(tag, ",") {
+			return fmt.Errorf("tag %q must be a non-empty word without commas", tag)
+		}
+		if hasTags(systemTags, []string{tag}) {
+			return fmt.Errorf("tag %q is set by prism and cannot be changed", tag)
+		}
+	}
+	return nil
+}
+
+// editTags applies an edit to the stored record, leveldb.ErrNotFound if there is none
+func editTags(db *leveldb.DB, edit tagEdit) ([]string, error) {
+	value, err := db.Get([]byte(edit.id), nil)
+	if err != nil {
+		return nil, err
+	}
+	md := model{}
+	if err := decodeRecord(value, &md); err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for _, v := range md.Tag {
+		if !hasTags(edit.remove, []string{v}) {
+			tags = append(tags, v)
+		}
+	}
+	for _, v := range edit.add {
+		if !hasTags(tags, []string{v}) {
+			tags = append(tags, v)
+		}
+	}
+	md.Tag = tags
+
+	byt, err := encodeRecord(md)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Put([]byte(edit.id), byt, &opt.WriteOptions{Sync: DBSync != SyncNone}); err != nil {
+		return nil, err
+	}
+	return md.Tag, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	bpflink "github.com/cilium/ebpf/link"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// AttachTCX attaches with a TCX link, owned by prism and detached when it is closed
+	AttachTCX = "tcx"
+	// AttachNetlink attaches with a clsact qdisc filter, which another tool may replace
+	AttachNetlink = "netlink"
+)
+
+// useTCX is set when the kernel is recent enough for TCX links
+var useTCX bool
+
+// StatReattached counts the clsact filters found removed and attached again
+const StatReattached = "filters_reattached"
+
+// TCAttachment is a program attached to the ingress or egress of a link
+type TCAttachment struct {
+	Mechanism string
+	link      bpflink.Link
+	filter    *netlink.BpfFilter
+
+	// qdiscCreated is set when attaching the filter, or attaching it again, created the
+	// clsact qdisc of the link
+	qdiscCreated bool
+
+	// what the program is attached again from when another tool removed the filter or
+	// the capture stalled
+	iface    netlink.Link
+	prog     *ebpf.Program
+	progName string
+	progID   int
+	parent   uint32
+	closed   bool
+	lock     sync.Mutex
+}
+
+// Close detaches the program
+func (t *TCAttachment) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closed = true
+	switch {
+	case t.link != nil:
+		return t.link.Close()
+	case t.filter != nil:
+		return nlHandle.FilterDel(t.filter)
+	}
+	return nil
+}
+
+// Reattach detaches the program and attaches it again the same way, to the link of the
+// same name which may have been created again, e.g. when its capture stalled although
+// the program is still attached. A program that fails to attach again stays detached.
+func (t *TCAttachment) Reattach() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil
+	}
+	iface, err := nlHandle.LinkByName(t.iface.Attrs().Name)
+	if err != nil {
+		return err
+	}
+
+	if t.link != nil {
+		if err := t.link.Close(); err != nil {
+			return err
+		}
+		t.link = nil
+		l, err := bpflink.AttachTCX(tcxOptions(iface, t.prog, t.parent))
+		if err != nil {
+			return err
+		}
+		t.link, t.iface = l, iface
+		captures.SetIndex(iface.Attrs().Name, iface.Attrs().Index)
+		stats.Add(StatReattached, 1)
+		return nil
+	}
+
+	if t.filter != nil {
+		// the filter may be gone with the link
+		nlHandle.FilterDel(t.filter)
+		t.filter = nil
+	}
+	filter, created, err := attachTC(iface, t.prog, t.progName, t.parent)
+	if err != nil {
+		return err
+	}
+	t.filter, t.iface = filter, iface
+	t.qdiscCreated = t.qdiscCreated || created
+	captures.SetIndex(iface.Attrs().Name, iface.Attrs().Index)
+	stats.Add(StatReattached, 1)
+	return nil
+}
+
+// QdiscCreated reports whether prism created the clsact qdisc of the link, when the
+// filter was attached or attached again since
+func (t *TCAttachment) QdiscCreated() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.qdiscCreated
+}
+
+// detach closes the attachments of link, the last one first, then deletes the clsact
+// qdisc of the link if prism created it. One that existed before is left to its owner.
+func detach(link netlink.Link, attachments []*TCAttachment) {
+	qdiscCreated := false
+	for i := len(attachments) - 1; i >= 0; i-- {
+		qdiscCreated = qdiscCreated || attachments[i].QdiscCreated()
+		attachments[i].Close()
+	}
+	if qdiscCreated {
+		deleteQdisc(link)
+	}
+}
+
+// present reports whether the filter is still attached with its handle, priority and
+// program, or name if the id of the program is unknown. A TCX link cannot be removed by
+// tc, it is always present.
+func (t *TCAttachment) present() (bool, error) {
+	if t.link != nil {
+		return true, nil
+	}
+	if t.filter == nil {
+		// it failed to attach again
+		return false, nil
+	}
+	filters, err := nlHandle.FilterList(t.iface, t.filter.Parent)
+	if err != nil {
+		return false, fmt.Errorf("list tc filters of %s: %w", t.iface.Attrs().Name, err)
+	}
+	for _, v := range filters {
+		bpf, ok := v.(*netlink.BpfFilter)
+		if !ok || bpf.Handle != t.filter.Handle || bpf.Priority != t.filter.Priority {
+			continue
+		}
+		// without the id of the program, when the kernel did not give it, the filter is
+		// known by the name it was attached with
+		if (t.progID != 0 && bpf.Id == t.progID) || (t.progID == 0 && bpf.Name == t.filter.Name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// check attaches the filter again if it was removed, e.g. by a tc filter del
+func (t *TCAttachment) check() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	ok, err := t.present()
+	if err != nil {
+		log.Printf("[ERROR] check %s filter (%s)", t.progName, err.Error())
+		return
+	}
+	if ok {
+		return
+	}
+
+	log.Printf("[ERROR] %s filter of %s was removed, attaching it again", t.progName, t.iface.Attrs().Name)
+	filter, created, err := attachTC(t.iface, t.prog, t.progName, t.parent)
+	if err != nil {
+		log.Printf("[ERROR] reattach %s (%s)", t.progName, err.Error())
+		return
+	}
+	t.filter = filter
+	t.qdiscCreated = t.qdiscCreated || created
+	stats.Add(StatReattached, 1)
+}
+
+// WatchFilters checks every interval that the clsact filters of attachments are still
+// attached, until ctx is done, and attaches again the ones another tool removed
+func WatchFilters(ctx context.Context, interval time.Duration, attachments ...*TCAttachment) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, v := range attachments {
+				v.check()
+			}
+		}
+	}
+}
+
+// writeReattachMetrics writes the reattached filters as prism_filters_reattached_total
+func writeReattachMetrics(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP prism_filters_reattached_total Filters removed by another tool and attached again.\n"+
+		"# TYPE prism_filters_reattached_total counter\nprism_filters_reattached_total %d\n", stats.List()[StatReattached])
+	return err
+}
+
+// attachProgram attaches prog with a TCX link when the kernel supports it, and falls back
+// to a clsact filter otherwise or if the link cannot be created
+func attachProgram(link netlink.Link, prog *ebpf.Program, progName string, qdiscParent uint32) (*TCAttachment, error) {
+	if useTCX {
+		l, err := bpflink.AttachTCX(tcxOptions(link, prog, qdiscParent))
+		if err == nil {
+			return &TCAttachment{Mechanism: AttachTCX, link: l, iface: link, prog: prog, progName: progName, parent: qdiscParent}, nil
+		}
+		log.Printf("[WARN] tcx attach of %s to %s failed (%s), using a clsact filter", progName, link.Attrs().Name, err.Error())
+	}
+
+	filter, created, err := attachTC(link, prog, progName, qdiscParent)
+	if err != nil {
+		return nil, fmt.Errorf("attach %s: %w", progName, err)
+	}
+	ret := &TCAttachment{Mechanism: AttachNetlink, qdiscCreated: created, filter: filter, iface: link, prog: prog, progName: progName, parent: qdiscParent}
+	if info, err := prog.Info(); err == nil {
+		if id, ok := info.ID(); ok {
+			ret.progID = int(id)
+		}
+	}
+	return ret, nil
+}
+
+// tcxOptions attaches prog to the ingress or the egress of link, as qdiscParent selects
+func tcxOptions(link netlink.Link, prog *ebpf.Program, qdiscParent uint32) bpflink.TCXOptions {
+	attachType := ebpf.AttachTCXIngress
+	if qdiscParent == netlink.HANDLE_MIN_EGRESS {
+		attachType = ebpf.AttachTCXEgress
+	}
+	return bpflink.TCXOptions{
+		Interface: link.Attrs().Index,
+		Program:   prog,
+		Attach:    attachType,
+	}
+}
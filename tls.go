@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the API certificate and reloads it when the files are rotated
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	cert    *tls.Certificate
+	modTime time.Time
+	lock    sync.RWMutex
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// lastModified returns the newest modification time of the certificate and key
+func (r *certReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return last, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// watch polls the certificate files and reloads them when they change
+func (r *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		modTime, err := r.lastModified()
+		if err != nil {
+			log.Printf("[ERROR] stat tls certificate (%s)", err.Error())
+			continue
+		}
+
+		r.lock.RLock()
+		changed := modTime.After(r.modTime)
+		r.lock.RUnlock()
+		if !changed {
+			continue
+		}
+
+		// keep serving the previous certificate if the new pair is half written
+		if err := r.reload(); err != nil {
+			log.Printf("[ERROR] reload tls certificate (%s)", err.Error())
+			continue
+		}
+		log.Printf("[PRISM] reloaded tls certificate %s", r.certFile)
+	}
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -13,11 +16,13 @@ import (
 const (
 	minKernelVer = "4.8.0"
 	maxKernelVer = "5.8.0"
+	tcxKernelVer = "6.6.0"
 )
 
 var (
 	isMinKernelVer = MustCompile(">=" + minKernelVer)
 	isMaxKernelVer = MustCompile(">=" + maxKernelVer)
+	isTCXKernelVer = MustCompile(">=" + tcxKernelVer)
 )
 
 // MustCompile wraps go-version.NewConstraint, panicing when an error is
@@ -107,3 +112,34 @@ func GetKernelVersion() (semver.Version, error) {
 	}
 	return parseKernelVersion(string(unameBuf.Release[:]))
 }
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// quietWriter drops the informational "[PRISM]" log lines and keeps the "[WARN]" and
+// "[ERROR]" ones and the fatal messages
+type quietWriter struct {
+	w io.Writer
+}
+
+func (q quietWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("[PRISM]")) {
+		return len(p), nil
+	}
+	return q.w.Write(p)
+}
+
+// isTerminal reports whether f is a terminal
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
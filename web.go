@@ -1,16 +1,27 @@
 package main
 
 import (
+	"container/heap"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
-func RunListening(db *leveldb.DB, addr string) {
+func RunListening(db *leveldb.DB, hosts *HostTable, save chan<- model, edits chan<- tagEdit, addr string, stop <-chan struct{}) {
 	router := gin.New()
 	router.Use(gin.Recovery())
 	router.LoadHTMLGlob("/web/*.html")
@@ -19,24 +30,182 @@ func RunListening(db *leveldb.DB, addr string) {
 	router.StaticFile("/", "/web/index.html") //前端接口
 
 	var h = Handler{
-		db: db,
+		db:    db,
+		hosts: hosts,
+		save:  save,
+		edits: edits,
 	}
 
-	router.GET("/interface", h.list)
-	router.GET("/refresh", h.refresh)
+	// ?interface= selects the db of an interface when -n maps interfaces to data paths, the
+	// routes reading the db answer 501 with -no-db
+	router.GET("/interface", stored(h.sharded(Handler.list)))
+	router.GET("/refresh", stored(h.sharded(Handler.refresh)))
+	router.GET("/records/*id", stored(h.sharded(Handler.record)))
+	router.GET("/record", stored(h.sharded(Handler.record)))
+	router.POST("/records/*id", stored(h.sharded(Handler.recordAction)))
+	router.GET("/diff", stored(h.sharded(Handler.diff)))
+	router.GET("/hosts", stored(h.sharded(Handler.listHosts)))
+	router.GET("/paths", stored(h.sharded(Handler.listPaths)))
+	router.GET("/blobs/:hash", stored(h.blob))
+	router.GET("/connections", h.connections)
+	router.GET("/config", h.config)
+	router.GET("/stats", h.sharded(Handler.stats))
+	router.GET("/metrics", h.metrics)
+	router.GET("/readyz", h.readyz)
+	router.GET("/debug/info", h.debugInfo)
+	router.GET("/meta", stored(h.meta))
+	router.GET("/snapshot", stored(h.sharded(Handler.snapshot)))
+	router.GET("/recent", h.recent)
+	router.GET("/captures", h.captures)
+	router.PUT("/captures/:name", h.setCapture)
+	router.GET("/interfaces", h.captures)
+	router.POST("/interfaces/:name/pause", h.pauseCapture)
+	router.POST("/interfaces/:name/resume", h.resumeCapture)
+	router.GET("/sessions", h.sessions)
+	router.POST("/sessions", h.startSession)
+	router.DELETE("/sessions/:id", h.stopSession)
 
-	router.Run(addr)
+	listener, err := listen(addr)
+	if err != nil {
+		log.Fatalf("http listen %s: %s", addr, err)
+	}
+
+	server := &http.Server{
+		Handler: router,
+	}
+	// once stopped, the requests being served finish so that nothing sends to save after
+	// RunListening returned
+	shutdown := make(chan struct{})
+	go func() {
+		<-stop
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("[ERROR] http server shutdown (%s)", err.Error())
+		}
+		close(shutdown)
+	}()
+
+	if len(HttpTLSCert) > 0 || len(HttpTLSKey) > 0 {
+		reloader, err := newCertReloader(HttpTLSCert, HttpTLSKey)
+		if err != nil {
+			log.Fatalf("load http tls certificate: %s", err)
+		}
+		go reloader.watch(10 * time.Second)
+
+		server.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		<-shutdown
+		return
+	}
+	if err != nil {
+		log.Fatalf("http server: %s", err)
+	}
+}
+
+// listen opens the API listener. A socket passed by systemd socket activation takes
+// precedence; "unix:/path/prism.sock" binds a unix socket that only the owner and group
+// can connect to, anything else is a tcp address.
+func listen(addr string) (net.Listener, error) {
+	if listener, err := systemdListener(); listener != nil || err != nil {
+		return listener, err
+	}
+
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+
+	// remove the socket left behind by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// sdListenFdsStart is the first file descriptor passed by systemd, see sd_listen_fds(3)
+const sdListenFdsStart = 3
+
+// systemdListener returns the first socket passed by systemd, or nil if prism was not
+// socket activated
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+
+	// the sockets must not leak to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds > 1 {
+		log.Printf("[WARN] systemd passed %d sockets, only the first one is used", fds)
+	}
+
+	syscall.CloseOnExec(sdListenFdsStart)
+	file := os.NewFile(sdListenFdsStart, "systemd-socket")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[PRISM] http server uses the socket activated by systemd")
+	return listener, nil
 }
 
 type Handler struct {
 	db    *leveldb.DB
-	cache *[]model
+	hosts *HostTable
+	// save stores a record through the save goroutine of db, edits edits the tags of one
+	save  chan<- model
+	edits chan<- tagEdit
 }
 
 type Search struct {
-	Name   string `form:"name"`
-	Offset int    `form:"offset" binding:"required,min=1"`
-	Limit  int    `form:"limit" binding:"required,min=10"`
+	Name       string `form:"name"`
+	Host       string `form:"host"`
+	Path       string `form:"path"`
+	Since      string `form:"since"`
+	Until      string `form:"until"`
+	Grpc       bool   `form:"grpc"`
+	Session    string `form:"session"`
+	Param      string `form:"param"`
+	ParamKey   string `form:"param-key"`
+	ParamValue string `form:"param-value"`
+	Tag        string `form:"tag"`
+	Cookie     string `form:"cookie"`
+	FormField  string `form:"form-field"`
+	RequestID  string `form:"request-id"`
+	Collapse   bool   `form:"collapse"`
+	Sort       string `form:"sort"`
+	Unpaired   string `form:"unpaired"`
+	ErrorsOnly bool   `form:"errors-only"`
+	SNI        string `form:"sni"`
+	MinBody    *int   `form:"min-body"`
+	MaxBody    *int   `form:"max-body"`
+	Reset      *bool  `form:"reset"`
+	Anomalous  *bool  `form:"anomalous"`
+	Offset     int    `form:"offset" binding:"required,min=1"`
+	Limit      int    `form:"limit" binding:"required,min=10"`
+
+	// since and until are the unix times of Since and Until, 0 if not given
+	since, until int
 }
 
 func (h Handler) list(ctx *gin.Context) {
@@ -48,72 +217,876 @@ func (h Handler) list(ctx *gin.Context) {
 		return
 	}
 
-	if h.cache == nil {
-		h.load()
+	var err error
+	now := time.Now()
+	if search.since, err = parseTimeBound(search.Since, now); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg": "since: " + err.Error(),
+		})
+		return
+	}
+	if search.until, err = parseTimeBound(search.Until, now); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg": "until: " + err.Error(),
+		})
+		return
+	}
+
+	left := (search.Offset - 1) * search.Limit
+	right := search.Offset * search.Limit
+
+	if search.Collapse {
+		h.listCollapsed(ctx, search, left, right)
+		return
+	}
+	switch search.Sort {
+	case "":
+	case "size":
+		h.listBySize(ctx, search, left, right)
+		return
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg": "unknown sort " + search.Sort + ", must be size",
+		})
+		return
 	}
 
-	cache := *h.cache
+	// records are written as they are read from the db so that memory stays flat whatever
+	// the limit, the total is only known once every record was read and comes last
+	ctx.Header("Content-Type", "application/json; charset=utf-8")
+	ctx.Status(http.StatusOK)
+	w := ctx.Writer
+	enc := json.NewEncoder(w)
+	_, _ = w.WriteString(`{"data":[`)
 
-	// filter by name
-	if len(search.Name) > 0 {
-		var tmp []model
-		for i, _ := range cache {
-			if strings.Contains(cache[i].RequestURL, search.Name) {
-				tmp = append(tmp, cache[i])
+	total := 0
+	iter := h.db.NewIterator(search.keyRange(), nil)
+	for iter.Next() {
+		md := model{}
+		if err := decodeRecord(iter.Value(), &md); err != nil {
+			log.Printf("[ERROR] json unmarshal error (%s)", err.Error())
+			continue
+		}
+		if !search.match(&md) {
+			continue
+		}
+
+		if total >= left && total < right {
+			if total > left {
+				_, _ = w.WriteString(",")
+			}
+			if err := enc.Encode(md); err != nil {
+				log.Printf("[ERROR] marshal error (%s)", err.Error())
 			}
+			w.Flush()
 		}
-		cache = tmp
+		total++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		log.Printf("[ERROR] iter error (%s)", err.Error())
 	}
 
-	left := (search.Offset - 1) * search.Limit
-	right := search.Offset * search.Limit
-	if left >= len(cache) {
+	_, _ = fmt.Fprintf(w, `],"total":%d}`, total)
+}
+
+// listBySize lists the records the largest first, by their request and response bytes.
+// Only the records up to the page are kept while reading the db.
+func (h Handler) listBySize(ctx *gin.Context, search Search, left, right int) {
+	var largest sizeHeap
+	total := 0
+	iter := h.db.NewIterator(search.keyRange(), nil)
+	for iter.Next() {
+		md := model{}
+		if err := decodeRecord(iter.Value(), &md); err != nil {
+			log.Printf("[ERROR] json unmarshal error (%s)", err.Error())
+			continue
+		}
+		if !search.match(&md) {
+			continue
+		}
+		total++
+		heap.Push(&largest, md)
+		if largest.Len() > right {
+			heap.Pop(&largest)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		log.Printf("[ERROR] iter error (%s)", err.Error())
+	}
+
+	ret := largest.largest()
+	if left >= len(ret) {
+		ret = nil
+	} else {
+		ret = ret[left:]
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"data":  ret,
+		"total": total,
+	})
+}
+
+// CollapsedRecord is the representative of the records of an endpoint, with its count
+type CollapsedRecord struct {
+	model
+	Count int `json:"count"`
+}
+
+// listCollapsed lists one record per endpoint, the most called first. The count is the
+// number of calls captured since prism started, at least the number of stored records.
+func (h Handler) listCollapsed(ctx *gin.Context, search Search, left, right int) {
+	var ret []CollapsedRecord
+	groups := map[Endpoint]int{}
+	iter := h.db.NewIterator(search.keyRange(), nil)
+	for iter.Next() {
+		md := model{}
+		if err := decodeRecord(iter.Value(), &md); err != nil {
+			log.Printf("[ERROR] json unmarshal error (%s)", err.Error())
+			continue
+		}
+		if !search.match(&md) {
+			continue
+		}
+
+		key := endpointOf(&md)
+		if i, ok := groups[key]; ok {
+			ret[i].Count++
+			continue
+		}
+		groups[key] = len(ret)
+		ret = append(ret, CollapsedRecord{model: md, Count: 1})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		log.Printf("[ERROR] iter error (%s)", err.Error())
+	}
+
+	for key, i := range groups {
+		if n := endpoints.Count(key); n > ret[i].Count {
+			ret[i].Count = n
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Count > ret[j].Count
+	})
+
+	if left >= len(ret) {
 		ctx.JSON(http.StatusOK, gin.H{
 			"msg": "no data",
 		})
 		return
 	}
+	if right > len(ret) {
+		right = len(ret)
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"data":  ret[left:right],
+		"total": len(ret),
+	})
+}
+
+// match reports whether md passes every filter of the search
+func (s Search) match(md *model) bool {
+	// filter by name
+	if len(s.Name) > 0 && !strings.Contains(md.RequestURL, s.Name) {
+		return false
+	}
+
+	// filter by host, with or without its port
+	if len(s.Host) > 0 && !matchHost(md.host(), s.Host) {
+		return false
+	}
+
+	// filter by path, without the query
+	if len(s.Path) > 0 && md.path() != s.Path {
+		return false
+	}
+
+	// filter by capture time, the records captured before it was recorded only match
+	// without a window
+	if (s.since > 0 || s.until > 0) && (md.CapturedAt == 0 || md.CapturedAt < s.since || (s.until > 0 && md.CapturedAt > s.until)) {
+		return false
+	}
+
+	// filter by the correlation id the request carried, both sides of a transaction being
+	// in its record
+	if len(s.RequestID) > 0 && requestID(md) != s.RequestID {
+		return false
+	}
+
+	// filter by capture session
+	if len(s.Session) > 0 && md.Session != s.Session {
+		return false
+	}
+
+	// filter by query parameter, "name" or "name=value"
+	if len(s.Param) > 0 && !matchParam(md.RequestParma, s.Param) {
+		return false
+	}
+
+	// filter by query parameter key and value, a value alone matches any key
+	if (len(s.ParamKey) > 0 || len(s.ParamValue) > 0) && !matchParamKeyValue(md.RequestParma, s.ParamKey, s.ParamValue) {
+		return false
+	}
+
+	// filter by tags, "a,b" requires both
+	if len(s.Tag) > 0 && !hasTags(md.Tag, strings.Split(s.Tag, ",")) {
+		return false
+	}
+
+	// filter by the name of a cookie the request sent or the response set
+	if len(s.Cookie) > 0 && !hasCookie(md, s.Cookie) {
+		return false
+	}
+
+	// filter by form field, "name" or "name=value", of a urlencoded or multipart body
+	if len(s.FormField) > 0 && !hasFormField(md, s.FormField) {
+		return false
+	}
+
+	// filter gRPC calls
+	if s.Grpc && md.Grpc == nil {
+		return false
+	}
+
+	// filter the failed requests, answered with a 4xx or 5xx
+	if s.ErrorsOnly && !isErrorStatus(md.ResponseStatus) {
+		return false
+	}
+
+	// filter the TLS connections by server name
+	if len(s.SNI) > 0 && (md.TLS == nil || !strings.EqualFold(md.TLS.SNI, s.SNI)) {
+		return false
+	}
+
+	// filter the requests without a response, or the responses without a request
+	if len(s.Unpaired) > 0 && md.Unpaired != s.Unpaired {
+		return false
+	}
+
+	// filter by body size, e.g. the oddly large or empty responses
+	if s.MinBody != nil && md.bodySize() < *s.MinBody {
+		return false
+	}
+	if s.MaxBody != nil && md.bodySize() > *s.MaxBody {
+		return false
+	}
+
+	// filter the exchanges whose connection was reset, or the ones it was not
+	if s.Reset != nil && md.Reset != *s.Reset {
+		return false
+	}
+
+	// filter the requests with an anomalous method, or the ones without
+	if s.Anomalous != nil && hasTags(md.Tag, []string{TagUnknownMethod}) != *s.Anomalous {
+		return false
+	}
+	return true
+}
+
+// keyRange returns the keys the matching records can be stored under with -key-layout,
+// nil for every key. Host keys sort before the keys of the same host with a port, so
+// only the start of a host-time range is narrowed by the window.
+func (s Search) keyRange() *util.Range {
+	switch {
+	case KeyLayout == KeyTime && (s.since > 0 || s.until > 0):
+		rng := &util.Range{Start: []byte(keyTime(s.since))}
+		if s.until > 0 {
+			rng.Limit = []byte(keyTime(s.until + 1))
+		}
+		return rng
+	case KeyLayout == KeyHostTime && len(s.Host) > 0:
+		prefix := strings.ToLower(s.Host)
+		rng := util.BytesPrefix([]byte(prefix))
+		if s.since > 0 {
+			rng.Start = []byte(prefix + " " + keyTime(s.since))
+		}
+		return rng
+	case KeyLayout == KeyPathTime && len(s.Path) > 0:
+		rng := util.BytesPrefix([]byte(s.Path + " "))
+		if s.since > 0 {
+			rng.Start = []byte(s.Path + " " + keyTime(s.since))
+		}
+		if s.until > 0 {
+			rng.Limit = []byte(s.Path + " " + keyTime(s.until+1))
+		}
+		return rng
+	}
+	return nil
+}
+
+// requestID returns the value of the -correlation-header of the request of a record,
+// X-Request-ID if none is set
+func requestID(md *model) string {
+	name := CorrelationHeader
+	if len(name) == 0 {
+		name = "X-Request-ID"
+	}
+	headers := md.RequestHeaders
+	if headers == nil {
+		headers = parseHeaders(md.RequestHeadersRaw)
+	}
+	return headerValue(headers, name)
+}
+
+func matchHost(host, filter string) bool {
+	if strings.EqualFold(host, filter) {
+		return true
+	}
+	hostname, _, err := net.SplitHostPort(host)
+	return err == nil && strings.EqualFold(hostname, filter)
+}
+
+func matchParam(params map[string][]string, filter string) bool {
+	kv := strings.SplitN(filter, "=", 2)
+	values, ok := params[kv[0]]
+	if !ok || len(kv) == 1 {
+		return ok
+	}
+	for _, v := range values {
+		if v == kv[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// matchParamKeyValue reports whether a query parameter is named key and, if value is set,
+// has the value among its values. An empty key matches every parameter.
+func matchParamKeyValue(params map[string][]string, key, value string) bool {
+	for k, values := range params {
+		if len(key) > 0 && k != key {
+			continue
+		}
+		if len(value) == 0 {
+			return true
+		}
+		for _, v := range values {
+			if v == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasTags(tags []string, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, t := range tags {
+			if t == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// stored answers the routes that read the db with 501 when prism runs with -no-db
+func stored(fn gin.HandlerFunc) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if NoDB {
+			ctx.JSON(http.StatusNotImplemented, gin.H{
+				"msg": "no records are stored with -no-db, use /recent or -stdout",
+			})
+			return
+		}
+		fn(ctx)
+	}
+}
+
+// refresh is kept for the web UI, the listing reads the db on every request so there is
+// nothing to reload
+func (h Handler) refresh(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg": "success",
+	})
+}
+
+func (h Handler) record(ctx *gin.Context) {
+	md, ok := h.getRecord(ctx)
+	if !ok {
+		return
+	}
+	if err := resolveBodies(&md); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
 
-	if right > len(cache) {
+	switch ctx.Query("format") {
+	case "curl":
+		ctx.String(http.StatusOK, curlCommand(md))
+	case "pcap":
+		if len(md.RawPackets) == 0 {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"msg": "no raw packets, run prism with -capture-raw",
+			})
+			return
+		}
+		ctx.Header("Content-Type", "application/vnd.tcpdump.pcap")
+		ctx.Header("Content-Disposition", `attachment; filename="prism.pcap"`)
+		if err := writePcap(ctx.Writer, md.RawPackets); err != nil {
+			log.Printf("[ERROR] write pcap (%s)", err.Error())
+		}
+	case "", "json":
+		if err := resolveBlobs(&md); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"msg": err.Error(),
+			})
+			return
+		}
 		ctx.JSON(http.StatusOK, gin.H{
-			"data":  cache[left:],
-			"total": len(cache),
+			"data": md,
+		})
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg": "unknown format " + ctx.Query("format"),
+		})
+	}
+}
+
+func (h Handler) blob(ctx *gin.Context) {
+	data, err := readBlob(ctx.Param("hash"))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"msg": err.Error(),
 		})
 		return
 	}
+	ctx.Data(http.StatusOK, "application/octet-stream", data)
+}
+
+// getRecord loads the record named by the id parameter, or by ?id= for the keys of
+// -key-layout content, answering the error itself if it fails
+func (h Handler) getRecord(ctx *gin.Context) (model, bool) {
+	id := strings.TrimPrefix(ctx.Param("id"), "/")
+	if len(id) == 0 {
+		id = ctx.Query("id")
+	}
+	return h.loadRecord(ctx, id)
+}
 
+// loadRecord loads the record stored under id, answering the error itself if it fails
+func (h Handler) loadRecord(ctx *gin.Context, id string) (model, bool) {
+	md := model{}
+	value, err := h.db.Get([]byte(id), nil)
+	if err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"msg": "no data",
+			})
+			return md, false
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"msg": err.Error(),
+		})
+		return md, false
+	}
+
+	if err := decodeRecord(value, &md); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"msg": err.Error(),
+		})
+		return md, false
+	}
+	md.parseRawHeaders()
+	return md, true
+}
+
+// recordAction runs the action named by the last segment of POST /records/:id/<action>,
+// the ids themselves holding slashes
+func (h Handler) recordAction(ctx *gin.Context) {
+	id := strings.TrimPrefix(ctx.Param("id"), "/")
+	i := strings.LastIndexByte(id, '/')
+	if i < 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"msg": "no action, POST /records/:id/replay or /records/:id/tags",
+		})
+		return
+	}
+	switch id, action := id[:i], id[i+1:]; action {
+	case "replay":
+		h.replay(ctx, id)
+	case "tags":
+		h.tags(ctx, id)
+	default:
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"msg": fmt.Sprintf("unknown record action %q", action),
+		})
+	}
+}
+
+// replay sends a stored request again to its original destination, or to ?target=host:port
+// among its Host and -replay-targets, and with ?store=true stores the response it got as a
+// record tagged replay
+func (h Handler) replay(ctx *gin.Context, id string) {
+	if !AllowReplay {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"msg": "replay is disabled, run prism with -allow-replay",
+		})
+		return
+	}
+	if !tokenAuthorized(ctx, "replay") {
+		return
+	}
+
+	md, ok := h.loadRecord(ctx, id)
+	if !ok {
+		return
+	}
+	if err := resolveBodies(&md); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	target, err := replayTarget(md, ctx.Query("target"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+
+	result, err := replayRequest(ctx.Request.Context(), md, target)
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	if store, _ := strconv.ParseBool(ctx.Query("store")); store {
+		h.save <- replayedRecord(md, result)
+	}
 	ctx.JSON(http.StatusOK, gin.H{
-		"data":  cache[left:right],
-		"total": len(cache),
+		"data": result,
 	})
-	return
 }
 
-func (h Handler) refresh(ctx *gin.Context) {
-	stat := time.Now()
-	h.load()
-	log.Printf("[PRISM] load data success %fs", time.Since(stat).Seconds())
+// tags adds the tags of ?add= to a record and removes the ones of ?remove=, both comma
+// separated, and returns its tags
+func (h Handler) tags(ctx *gin.Context, id string) {
+	edit := tagEdit{id: id, done: make(chan tagResult, 1)}
+	if v := ctx.Query("add"); len(v) > 0 {
+		edit.add = strings.Split(v, ",")
+	}
+	if v := ctx.Query("remove"); len(v) > 0 {
+		edit.remove = strings.Split(v, ",")
+	}
+	if len(edit.add)+len(edit.remove) == 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg": "no tag to change, set ?add= or ?remove=",
+		})
+		return
+	}
+	if err := checkTags(append(edit.add, edit.remove...)); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+
+	var result tagResult
+	select {
+	case h.edits <- edit:
+		result = <-edit.done
+	case <-ctx.Request.Context().Done():
+		return
+	}
+	if errors.Is(result.err, leveldb.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"msg": "no data",
+		})
+		return
+	}
+	if result.err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"msg": result.err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"data": result.tags,
+	})
+}
+
+func (h Handler) connections(ctx *gin.Context) {
+	sortBy := ctx.Query("sort")
+	if sortBy != "" && sortBy != "bytes" && sortBy != "requests" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg": "sort must be bytes or requests",
+		})
+		return
+	}
+
+	list := connStats.List(sortBy)
+	ctx.JSON(http.StatusOK, gin.H{
+		"data":  list,
+		"total": len(list),
+	})
+}
+
+func (h Handler) captures(ctx *gin.Context) {
+	list := captures.List()
+	ctx.JSON(http.StatusOK, gin.H{
+		"data":  list,
+		"total": len(list),
+	})
+}
+
+// setCapture enables or disables the capture of an interface with ?enabled=true|false
+func (h Handler) setCapture(ctx *gin.Context) {
+	enabled, err := strconv.ParseBool(ctx.Query("enabled"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg": "enabled must be true or false",
+		})
+		return
+	}
+	h.enableCapture(ctx, enabled)
+}
+
+// pauseCapture disables the capture of an interface, as PUT /captures/:name?enabled=false
+func (h Handler) pauseCapture(ctx *gin.Context) {
+	h.enableCapture(ctx, false)
+}
+
+// resumeCapture enables the capture of an interface, as PUT /captures/:name?enabled=true
+func (h Handler) resumeCapture(ctx *gin.Context) {
+	h.enableCapture(ctx, true)
+}
+
+func (h Handler) enableCapture(ctx *gin.Context, enabled bool) {
+	if !captures.SetEnabled(ctx.Param("name"), enabled) {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"msg": "not attached to " + ctx.Param("name"),
+		})
+		return
+	}
+	log.Printf("[PRISM] capture on %s enabled: %t", ctx.Param("name"), enabled)
 	ctx.JSON(http.StatusOK, gin.H{
 		"msg": "success",
 	})
-	return
 }
 
-func (h *Handler) load() {
-	var ret []model
-	iter := h.db.NewIterator(nil, nil)
-	for iter.Next() {
-		// Remember that the contents of the returned slice should not be modified, and only valid until the next call to Next.
-		value := iter.Value()
-		md := model{}
-		if err := json.Unmarshal(value, &md); err != nil {
-			log.Printf("[PRISM] json unmarshal error (%s)", err.Error())
+func (h Handler) sessions(ctx *gin.Context) {
+	list := sessions.List()
+	ctx.JSON(http.StatusOK, gin.H{
+		"data":  list,
+		"total": len(list),
+	})
+}
+
+// startSession opens a capture session with ?name=&duration=, e.g. duration=10m
+func (h Handler) startSession(ctx *gin.Context) {
+	duration, err := time.ParseDuration(ctx.Query("duration"))
+	if err != nil || duration <= 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"msg": "duration must be a positive duration such as 10m",
+		})
+		return
+	}
+
+	session, err := sessions.Start(ctx.Query("name"), duration)
+	if err != nil {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"data": session,
+	})
+}
+
+func (h Handler) stopSession(ctx *gin.Context) {
+	if err := sessions.Stop(ctx.Param("id")); err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg": "success",
+	})
+}
+
+// config returns the effective value of every flag
+func (h Handler) config(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"data": gin.H{
+			"version": version,
+			"flags":   effectiveConfig(),
+		},
+	})
+}
+
+// recent lists the last stored records from memory, the most recent first, ?limit= of them
+func (h Handler) recent(ctx *gin.Context) {
+	if recentRecords == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"msg": "recent records are disabled, run prism with -recent",
+		})
+		return
+	}
+
+	limit, _ := strconv.Atoi(ctx.Query("limit"))
+	ret := recentRecords.List(limit)
+	ctx.JSON(http.StatusOK, gin.H{
+		"data":  ret,
+		"total": len(ret),
+	})
+}
+
+func (h Handler) stats(ctx *gin.Context) {
+	// group=endpoint adds the calls captured to each endpoint, the most called first
+	if ctx.Query("group") == "endpoint" {
+		ctx.JSON(http.StatusOK, gin.H{
+			"data":      stats.List(),
+			"capture":   captureMode,
+			"families":  stats.Families(),
+			"endpoints": endpoints.List(),
+		})
+		return
+	}
+
+	// group=bytes adds the bytes captured for each host and the paths with the most bytes,
+	// ?top= of them
+	if ctx.Query("group") == "bytes" {
+		top, err := strconv.Atoi(ctx.DefaultQuery("top", "10"))
+		if err != nil || top < 1 {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"msg": "top must be a positive number",
+			})
+			return
 		}
-		ret = append(ret, md)
+		ctx.JSON(http.StatusOK, gin.H{
+			"data":     stats.List(),
+			"capture":  captureMode,
+			"families": stats.Families(),
+			"hosts":    bandwidth.Hosts(),
+			"paths":    bandwidth.TopPaths(top),
+		})
+		return
 	}
-	iter.Release()
-	if err := iter.Error(); err != nil {
-		log.Printf("[PRISM] iter error (%s)", err.Error())
+
+	// group=host adds the records stored for each host, the most first
+	if ctx.Query("group") == "host" {
+		if NoDB {
+			ctx.JSON(http.StatusNotImplemented, gin.H{
+				"msg": "no records are stored with -no-db",
+			})
+			return
+		}
+		hosts := h.hosts.List()
+		if PerHostCap <= 0 {
+			var err error
+			if hosts, err = countHosts(h.db); err != nil {
+				ctx.JSON(http.StatusInternalServerError, gin.H{
+					"msg": err.Error(),
+				})
+				return
+			}
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"data":     stats.List(),
+			"capture":  captureMode,
+			"families": stats.Families(),
+			"hosts":    hosts,
+		})
+		return
 	}
-	h.cache = &ret
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"data":     stats.List(),
+		"capture":  captureMode,
+		"families": stats.Families(),
+	})
+}
+
+// meta describes the runs of prism that captured the db
+func (h Handler) meta(ctx *gin.Context) {
+	if metaRecorder != nil {
+		ctx.JSON(http.StatusOK, gin.H{
+			"data": metaRecorder.Get(),
+		})
+		return
+	}
+
+	meta, err := readMeta(DataPath)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"data": meta,
+	})
+}
+
+// debugInfo reports the build and how events are captured, to diagnose lost events
+func (h Handler) debugInfo(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"data": gin.H{
+			"version":  version,
+			"capture":  captureMode,
+			"workers":  ParseWorkers,
+			"captures": captures.List(),
+			"ebpf":     bpfObjects.List(),
+		},
+	})
+}
+
+func (h Handler) metrics(ctx *gin.Context) {
+	ctx.Header("Content-Type", "text/plain; version=0.0.4")
+	ctx.Status(http.StatusOK)
+	if _, err := latencyMetrics.WriteTo(ctx.Writer); err != nil {
+		log.Printf("[ERROR] write metrics (%s)", err.Error())
+		return
+	}
+	if _, err := requestMetrics.WriteTo(ctx.Writer); err != nil {
+		log.Printf("[ERROR] write metrics (%s)", err.Error())
+		return
+	}
+	if err := writeDropMetrics(ctx.Writer); err != nil {
+		log.Printf("[ERROR] write metrics (%s)", err.Error())
+		return
+	}
+	if err := writeReattachMetrics(ctx.Writer); err != nil {
+		log.Printf("[ERROR] write metrics (%s)", err.Error())
+		return
+	}
+	if err := writeAnomalyMetrics(ctx.Writer); err != nil {
+		log.Printf("[ERROR] write metrics (%s)", err.Error())
+		return
+	}
+	if _, err := captures.WriteTo(ctx.Writer); err != nil {
+		log.Printf("[ERROR] write metrics (%s)", err.Error())
+		return
+	}
+	if _, err := bpfObjects.WriteTo(ctx.Writer); err != nil {
+		log.Printf("[ERROR] write metrics (%s)", err.Error())
+	}
+}
+
+// readyz answers 503 until a capture is attached and while one of them is stalled
+func (h Handler) readyz(ctx *gin.Context) {
+	if err := captures.Ready(); err != nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg": "ready",
+	})
 }